@@ -0,0 +1,105 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The Informo feeder agent is a reference implementation of a signing agent
+// for the Informo feeder. It holds the sources' keys, and signs content on
+// behalf of feeders connecting to its Unix socket, so that the feeders, which
+// are exposed to the network, never hold the key material.
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+
+	"informo-feeder/config"
+	"informo-feeder/signing"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	configFile = flag.String("config", "agent.yaml", "Configuration file")
+	debug      = flag.Bool("debug", false, "Print debugging messages")
+)
+
+// agentConfig represents the configuration of the agent. Keys uses the same
+// settings as the feeder's, and Sources lists the identifiers of the sources
+// which keys are held by the agent.
+type agentConfig struct {
+	Socket  string            `yaml:"socket"`
+	Keys    config.KeysConfig `yaml:"keys"`
+	Sources []string          `yaml:"sources"`
+}
+
+func main() {
+	flag.Parse()
+
+	if *debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		logrus.Panic(err)
+	}
+
+	listener, err := listen(cfg.Socket)
+	if err != nil {
+		logrus.Panic(err)
+	}
+
+	logrus.WithField("socket", cfg.Socket).Info("Signing agent started")
+
+	logrus.Panic(signing.ServeAgent(listener, signing.NewLocalSigner(&cfg.Keys)))
+}
+
+// loadConfig loads the agent's configuration from the given file, and loads
+// the keys of the sources it lists.
+// Returns an error if the file couldn't be read or parsed, or if the keys
+// couldn't be loaded.
+func loadConfig(filePath string) (cfg *agentConfig, err error) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return
+	}
+
+	cfg = new(agentConfig)
+	if err = yaml.Unmarshal(content, cfg); err != nil {
+		return
+	}
+
+	err = cfg.Keys.Load(cfg.Sources)
+	return
+}
+
+// listen listens on the Unix socket at the given path, after removing any
+// socket left over by a previous run. The socket is only accessible by the
+// agent's user and group, so the feeder needs to run as a member of this group.
+// Returns an error if the socket couldn't be created.
+func listen(socketPath string) (net.Listener, error) {
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	oldMask := syscall.Umask(0117)
+	listener, err := net.Listen("unix", socketPath)
+	syscall.Umask(oldMask)
+
+	return listener, err
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appservice
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+
+	"informo-feeder/config"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Registration represents the registration file of the application service,
+// which must be added to the homeserver's configuration.
+type Registration struct {
+	ID              string     `yaml:"id"`
+	URL             string     `yaml:"url"`
+	ASToken         string     `yaml:"as_token"`
+	HSToken         string     `yaml:"hs_token"`
+	SenderLocalpart string     `yaml:"sender_localpart"`
+	RateLimited     bool       `yaml:"rate_limited"`
+	Namespaces      namespaces `yaml:"namespaces"`
+}
+
+type namespaces struct {
+	Users   []namespace `yaml:"users"`
+	Aliases []namespace `yaml:"aliases"`
+	Rooms   []namespace `yaml:"rooms"`
+}
+
+type namespace struct {
+	Exclusive bool   `yaml:"exclusive"`
+	Regex     string `yaml:"regex"`
+}
+
+// WriteRegistration generates the registration file of the application service
+// from its settings, and writes it to the given path. If the AS or HS tokens
+// aren't set in the settings, random ones are generated and set into the
+// settings, so the caller can let the user know about them.
+// Returns an error if generating a token, serialising the registration or
+// writing the file failed.
+func WriteRegistration(cfg *config.AppServiceConfig, path string) (err error) {
+	if len(cfg.ASToken) == 0 {
+		if cfg.ASToken, err = randomToken(); err != nil {
+			return
+		}
+	}
+
+	if len(cfg.HSToken) == 0 {
+		if cfg.HSToken, err = randomToken(); err != nil {
+			return
+		}
+	}
+
+	reg := Registration{
+		ID:              cfg.ID,
+		URL:             cfg.URL,
+		ASToken:         cfg.ASToken,
+		HSToken:         cfg.HSToken,
+		SenderLocalpart: cfg.SenderLocalpart,
+		// The feeder already handles rate limiting, but publishing news from
+		// several sources at once shouldn't be slowed down by the homeserver.
+		RateLimited: false,
+		Namespaces: namespaces{
+			Users: []namespace{
+				{Exclusive: true, Regex: cfg.UserRegexp()},
+			},
+			Aliases: []namespace{},
+			Rooms:   []namespace{},
+		},
+	}
+
+	content, err := yaml.Marshal(reg)
+	if err != nil {
+		return
+	}
+
+	return ioutil.WriteFile(path, content, 0600)
+}
+
+// randomToken returns a random 32-bytes long token, encoded as hexadecimal.
+// Returns an error if generating the random bytes failed.
+func randomToken() (string, error) {
+	var data [32]byte
+	if _, err := rand.Read(data[:]); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(data[:]), nil
+}
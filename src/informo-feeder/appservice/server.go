@@ -0,0 +1,155 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"informo-feeder/config"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/sirupsen/logrus"
+)
+
+// pathPrefixes lists the prefixes of the paths the homeserver can send its
+// requests to, the legacy one (with no prefix) and the versioned one.
+var pathPrefixes = []string{"/_matrix/app/v1", ""}
+
+// Server describes the HTTP server implementing the application service API,
+// i.e. the endpoints the homeserver sends transactions and queries to.
+type Server struct {
+	cfg *config.Config
+	// users contains the Matrix ID of every virtual user publishing one of the
+	// configured feeds.
+	users map[string]bool
+}
+
+type transaction struct {
+	Events []gomatrix.Event `json:"events"`
+}
+
+// NewServer instantiates a new Server.
+func NewServer(cfg *config.Config) *Server {
+	users := make(map[string]bool)
+	for _, feed := range cfg.Feeds {
+		users[cfg.AppService.UserID(feed.Identifier)] = true
+	}
+
+	return &Server{
+		cfg:   cfg,
+		users: users,
+	}
+}
+
+// ListenAndServe starts the HTTP server on the address from the application
+// service settings. It blocks until the server stops.
+// Returns an error if the server stopped because of an error.
+func (s *Server) ListenAndServe() error {
+	logrus.WithField(
+		"address", s.cfg.AppService.ListenAddress,
+	).Info("Application service listening")
+
+	return http.ListenAndServe(s.cfg.AppService.ListenAddress, s)
+}
+
+// ServeHTTP implements http.Handler. It checks that the request was sent by
+// the homeserver, then routes it according to its method and path.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	token := req.URL.Query().Get("access_token")
+	if len(token) == 0 {
+		writeError(w, http.StatusUnauthorized, "M_UNAUTHORIZED", "Missing token")
+		return
+	}
+
+	if token != s.cfg.AppService.HSToken {
+		writeError(w, http.StatusForbidden, "M_FORBIDDEN", "Invalid token")
+		return
+	}
+
+	for _, prefix := range pathPrefixes {
+		if !strings.HasPrefix(req.URL.Path, prefix+"/") {
+			continue
+		}
+
+		parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, prefix+"/"), "/", 2)
+		if len(parts) != 2 {
+			break
+		}
+
+		switch {
+		case parts[0] == "transactions" && req.Method == http.MethodPut:
+			s.handleTransaction(w, req, parts[1])
+			return
+		case parts[0] == "users" && req.Method == http.MethodGet:
+			s.handleUserQuery(w, parts[1])
+			return
+		case parts[0] == "rooms" && req.Method == http.MethodGet:
+			// The application service doesn't manage any room alias.
+			writeError(w, http.StatusNotFound, "M_NOT_FOUND", "Unknown alias")
+			return
+		}
+	}
+
+	writeError(w, http.StatusNotFound, "M_UNRECOGNIZED", "Unrecognized request")
+}
+
+// handleTransaction processes a transaction sent by the homeserver. The feeder
+// only publishes news, so the events are only logged.
+func (s *Server) handleTransaction(
+	w http.ResponseWriter, req *http.Request, txnID string,
+) {
+	var txn transaction
+	if err := json.NewDecoder(req.Body).Decode(&txn); err != nil {
+		writeError(w, http.StatusBadRequest, "M_NOT_JSON", "Invalid transaction")
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"txnID":  txnID,
+		"events": len(txn.Events),
+	}).Debug("Received transaction from the homeserver")
+
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// handleUserQuery tells the homeserver whether the given user exists, i.e.
+// whether it is a virtual user publishing one of the configured feeds.
+func (s *Server) handleUserQuery(w http.ResponseWriter, userID string) {
+	if !s.users[userID] {
+		writeError(w, http.StatusNotFound, "M_NOT_FOUND", "Unknown user")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// writeError writes a Matrix error with the given HTTP status code, error code
+// and message to the response.
+func writeError(w http.ResponseWriter, code int, errCode string, message string) {
+	writeJSON(w, code, gomatrix.RespError{ErrCode: errCode, Err: message})
+}
+
+// writeJSON writes the given content, serialised as JSON, to the response with
+// the given HTTP status code.
+func writeJSON(w http.ResponseWriter, code int, content interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(content); err != nil {
+		logrus.Error(err)
+	}
+}
@@ -15,5 +15,20 @@
 
 package common
 
+// InformoRoomID and InformoNewsEventTypePrefix describe the main Informo
+// network, which is used as the default network profile.
 const InformoRoomID = "!xkMuBYHNWUOLHIoOEw:matrix.org"
 const InformoNewsEventTypePrefix = "network.informo.news."
+
+// SourceEventType is the type of the state events describing the sources
+// allowed to publish on an Informo network. The state key is the type of the
+// source's news events.
+const SourceEventType = "network.informo.source"
+
+// SourceProposalEventType is the type of the events sent by publishers to
+// propose the registration of a new source to the network's administrators.
+const SourceProposalEventType = "network.informo.source.proposal"
+
+// KeyTransitionEventType is the type of the events sent by publishers to
+// announce the rotation of a source's key.
+const KeyTransitionEventType = "network.informo.source.key_transition"
@@ -0,0 +1,46 @@
+// Copyright 2017 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/sirupsen/logrus"
+)
+
+// IsTooManyRequestsError checks if the given error is a rate limit error sent by
+// the Matrix server.
+// Logs (if debugging logging is enabled) if the error is an HTTP error sent by
+// a Matrix server, then returns the result.
+func IsTooManyRequestsError(err error) bool {
+	// Checks whether the error is an HTTP error retrieved from a Matrix server.
+	httpErr, ok := err.(gomatrix.HTTPError)
+	if !ok || httpErr.Code != http.StatusTooManyRequests {
+		if ok {
+			// If it is an HTTP error sent by a Matrix server but not a 429 Too
+			// Many Requests error, log it.
+			logrus.WithFields(logrus.Fields{
+				"code":    httpErr.Code,
+				"message": httpErr.Message,
+			}).Debug("HTTP error isn't 429 Too Many Requests")
+		}
+		return false
+	}
+
+	logrus.Debug("Got 429 Too Many Requests error")
+	return true
+}
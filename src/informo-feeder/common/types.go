@@ -16,8 +16,7 @@
 package common
 
 // NewsContent represents the content of the news Matrix event sent to the
-// Informo network. We set the signature to omitempty so we don't have an empty
-// "signature" property when singing the JSON generated from the content.
+// Informo network.
 type NewsContent struct {
 	Headline    string `json:"headline"`
 	Content     string `json:"content"`
@@ -25,5 +24,69 @@ type NewsContent struct {
 	Date        int64  `json:"date"` // Timestamp in seconds
 	Author      string `json:"author"`
 	Link        string `json:"link"`
-	Signature   string `json:"signature,omitempty"`
+	// Source, EventType and RoomID bind the content to the source, the event's
+	// type and the room it's sent into, so it can't be sent again elsewhere.
+	// They are only set from the version 2 of the signature scheme.
+	Source    string `json:"source,omitempty"`
+	EventType string `json:"event_type,omitempty"`
+	RoomID    string `json:"room_id,omitempty"`
+	// SignedAt and Nonce let readers detect replayed events. They are only set
+	// from the version 2 of the signature scheme.
+	SignedAt int64  `json:"signed_at,omitempty"` // Timestamp in seconds
+	Nonce    string `json:"nonce,omitempty"`
+	// SignatureVersion is the version of the signature scheme, omitted in
+	// version 1.
+	SignatureVersion int `json:"signature_version,omitempty"`
+	// Sequence is the position of the event in the chain of the events
+	// published for the source into the room, starting at 1, and PrevHash the
+	// hash of the previous event of the chain (empty for the first one), so
+	// readers can detect missing or reordered events. Both are only set from
+	// the version 3 of the signature scheme.
+	Sequence int64  `json:"sequence,omitempty"`
+	PrevHash string `json:"prev_hash,omitempty"`
+	// KeyID tells readers which of the source's keys to check the signature
+	// against. It is part of the signed JSON.
+	KeyID string `json:"key_id,omitempty"`
+	// Signature is the signature in the legacy format. It is omitted if empty,
+	// so there's no empty "signature" property in the signed JSON.
+	Signature string `json:"signature,omitempty"`
+	// Signatures holds the signatures in the format Matrix uses for signed JSON
+	// objects, i.e. mapping the source's identifier to a map of key IDs to
+	// signatures. It isn't part of the JSON signed in the legacy format, but
+	// covers the "signature" property if both formats are used.
+	Signatures map[string]map[string]string `json:"signatures,omitempty"`
+}
+
+// SourceRegistration represents the metadata of a source, along with its public
+// key and the Matrix ID of its publisher, as sent to the Informo network (or to
+// an administrator) to register the source. The registration is signed with
+// the source's private key, so the administrator can check that it was
+// generated by whoever holds the key. As with NewsContent, the signature is set
+// to omitempty so it doesn't appear in the signed JSON.
+type SourceRegistration struct {
+	Identifier string `json:"identifier"`
+	EventType  string `json:"event_type"`
+	Name       string `json:"name"`
+	Website    string `json:"website,omitempty"`
+	FeedURL    string `json:"feed_url"`
+	Logo       string `json:"logo,omitempty"` // mxc:// URL
+	PublicKey  string `json:"public_key"`     // Encoded as base64
+	KeyID      string `json:"key_id"`
+	Publisher  string `json:"publisher"`
+	Signature  string `json:"signature,omitempty"`
+}
+
+// KeyTransition represents the statement a source publishes when rotating its
+// key, announcing the new key and the end of the old key's validity period. It
+// is signed with the old key, so readers who trust the old key can trust the
+// new one.
+type KeyTransition struct {
+	Identifier   string `json:"identifier"`
+	OldKeyID     string `json:"old_key_id"`
+	OldPublicKey string `json:"old_public_key"`  // Encoded as base64
+	OldValidTo   int64  `json:"old_valid_until"` // Timestamp in seconds
+	NewKeyID     string `json:"new_key_id"`
+	NewPublicKey string `json:"new_public_key"` // Encoded as base64
+	NewValidFrom int64  `json:"new_valid_from"` // Timestamp in seconds
+	Signature    string `json:"signature,omitempty"`
 }
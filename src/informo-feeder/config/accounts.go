@@ -0,0 +1,100 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNoMatrixCredentials is returned if neither an access token nor a
+	// password has been provided in the settings of a Matrix account.
+	ErrNoMatrixCredentials = errors.New("Either an access token or a password must be provided in the Matrix settings")
+)
+
+// AccountFor returns the settings of the Matrix account to publish the news
+// from a given feed with. If the application service mode is enabled, this is
+// the virtual user publishing the feed's source.
+// Returns an error if there's no feed with this identifier, or if the feed
+// references an account that doesn't exist.
+func (c *Config) AccountFor(feedIdentifier string) (mxCfg MatrixConfig, err error) {
+	feed, ok := c.Feed(feedIdentifier)
+	if !ok {
+		err = fmt.Errorf("Unknown feed %s", feedIdentifier)
+		return
+	}
+
+	if c.AppService.Enabled {
+		return MatrixConfig{
+			Homeserver:  c.AppService.Homeserver,
+			AccessToken: c.AppService.ASToken,
+			MXID:        c.AppService.UserID(feed.Identifier),
+			AppService:  true,
+		}, nil
+	}
+
+	if len(feed.Account) == 0 {
+		return c.Matrix, nil
+	}
+
+	mxCfg, ok = c.Accounts[feed.Account]
+	if !ok {
+		err = fmt.Errorf(
+			"Feed %s references unknown account %s", feedIdentifier, feed.Account,
+		)
+	}
+
+	return
+}
+
+// Feed returns the feed with the given identifier, and whether such a feed
+// exists.
+func (c *Config) Feed(identifier string) (Feed, bool) {
+	for _, feed := range c.Feeds {
+		if feed.Identifier == identifier {
+			return feed, true
+		}
+	}
+
+	return Feed{}, false
+}
+
+// checkAccounts checks that every Matrix account used by at least one feed
+// exists and has credentials.
+// Returns an error if a feed references an account that doesn't exist, or if
+// an account doesn't have any credentials.
+func (c *Config) checkAccounts() error {
+	for _, feed := range c.Feeds {
+		mxCfg, err := c.AccountFor(feed.Identifier)
+		if err != nil {
+			return err
+		}
+
+		// The application service's token is checked separately.
+		if mxCfg.AppService {
+			continue
+		}
+
+		if len(mxCfg.AccessToken) == 0 && len(mxCfg.Password) == 0 {
+			return fmt.Errorf(
+				"%s (used by feed %s)", ErrNoMatrixCredentials.Error(), feed.Identifier,
+			)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+const (
+	// defaultAppServiceUserPrefix is the prefix of the localpart of the virtual
+	// users publishing the sources if none is specified in the configuration
+	// file.
+	defaultAppServiceUserPrefix = "informo_"
+	// defaultAppServiceSenderLocalpart is the localpart of the application
+	// service's own user if none is specified in the configuration file.
+	defaultAppServiceSenderLocalpart = "informo-feeder"
+)
+
+var (
+	// ErrAppServiceIncomplete is returned if the application service mode is
+	// enabled but some of the required settings are missing.
+	ErrAppServiceIncomplete = errors.New("The application service settings must include an ID, the homeserver's URL and server name")
+	// ErrAppServiceNoTokens is returned if the application service mode is
+	// enabled but the AS and HS tokens haven't been set yet.
+	ErrAppServiceNoTokens = errors.New("The application service settings must include the AS and HS tokens, which can be generated along with the registration file")
+)
+
+// AppServiceConfig represents the settings of the application service mode as
+// specified in the configuration file. If enabled, each source is published by
+// a virtual user from the application service's namespace, instead of using
+// the accounts from the Matrix settings.
+type AppServiceConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// ID is the unique identifier of the application service on the
+	// homeserver.
+	ID string `yaml:"id"`
+	// URL is the URL the homeserver can reach the application service at.
+	URL string `yaml:"url"`
+	// ListenAddress is the address the application service's HTTP server binds
+	// to, e.g. "localhost:8090".
+	ListenAddress string `yaml:"listen_address"`
+	// Homeserver is the URL of the homeserver the application service is
+	// registered on.
+	Homeserver string `yaml:"homeserver"`
+	// ServerName is the server name of the homeserver, used to build the
+	// Matrix IDs of the virtual users.
+	ServerName string `yaml:"server_name"`
+	// ASToken is the token the application service authenticates with on the
+	// homeserver.
+	ASToken string `yaml:"as_token"`
+	// HSToken is the token the homeserver authenticates with on the
+	// application service.
+	HSToken string `yaml:"hs_token"`
+	// SenderLocalpart is the localpart of the application service's own user.
+	SenderLocalpart string `yaml:"sender_localpart,omitempty"`
+	// UserPrefix is prepended to the identifier of a source to build the
+	// localpart of the virtual user publishing it.
+	UserPrefix string `yaml:"user_prefix,omitempty"`
+}
+
+// UserLocalpart returns the localpart of the virtual user publishing a given
+// source.
+func (a *AppServiceConfig) UserLocalpart(identifier string) string {
+	return a.UserPrefix + identifier
+}
+
+// UserID returns the Matrix ID of the virtual user publishing a given source.
+func (a *AppServiceConfig) UserID(identifier string) string {
+	return fmt.Sprintf("@%s:%s", a.UserLocalpart(identifier), a.ServerName)
+}
+
+// UserRegexp returns the regular expression matching the Matrix IDs of the
+// virtual users in the application service's namespace.
+func (a *AppServiceConfig) UserRegexp() string {
+	return fmt.Sprintf(
+		"@%s.*:%s", regexp.QuoteMeta(a.UserPrefix), regexp.QuoteMeta(a.ServerName),
+	)
+}
+
+// loadAppService fills the default values of the application service settings
+// and checks that the required ones (except for the tokens) are provided if
+// the application service mode is enabled.
+// Returns ErrAppServiceIncomplete if a required setting is missing.
+func (c *Config) loadAppService() error {
+	a := &c.AppService
+
+	if len(a.UserPrefix) == 0 {
+		a.UserPrefix = defaultAppServiceUserPrefix
+	}
+
+	if len(a.SenderLocalpart) == 0 {
+		a.SenderLocalpart = defaultAppServiceSenderLocalpart
+	}
+
+	if !a.Enabled {
+		return nil
+	}
+
+	if len(a.ID) == 0 || len(a.Homeserver) == 0 || len(a.ServerName) == 0 {
+		return ErrAppServiceIncomplete
+	}
+
+	return nil
+}
+
+// CheckTokens checks that both the AS and HS tokens are set. This isn't done
+// when loading the configuration file so that the tokens can be generated
+// along with the registration file.
+// Returns ErrAppServiceNoTokens if one of the tokens is missing.
+func (a *AppServiceConfig) CheckTokens() error {
+	if len(a.ASToken) == 0 || len(a.HSToken) == 0 {
+		return ErrAppServiceNoTokens
+	}
+
+	return nil
+}
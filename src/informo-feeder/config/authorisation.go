@@ -0,0 +1,73 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+)
+
+const (
+	// AuthorisationModeWarn makes the feeder log a warning when it isn't
+	// authorised to publish a source into a network, but publish anyway.
+	AuthorisationModeWarn = "warn"
+	// AuthorisationModeEnforce makes the feeder refuse to publish a source
+	// into a network it isn't authorised to publish it into.
+	AuthorisationModeEnforce = "enforce"
+	// AuthorisationModeOff disables the authorisation check.
+	AuthorisationModeOff = "off"
+
+	// defaultAuthorisationCheckInterval is the default interval, in seconds,
+	// between two authorisation checks.
+	defaultAuthorisationCheckInterval = 3600
+)
+
+// AuthorisationConfig represents the settings of the check made at startup
+// (then periodically) that the feeder's accounts are authorised to publish the
+// sources it polls, and that the sources' keys match with the ones registered
+// on the networks. Mode is one of "warn" (the default), "enforce" and "off".
+// CheckInterval is the time to wait between two checks, in seconds.
+type AuthorisationConfig struct {
+	Mode          string `yaml:"mode,omitempty"`
+	CheckInterval int64  `yaml:"check_interval,omitempty"`
+}
+
+// Enforced returns true if the feeder must refuse to publish a source into a
+// network it isn't authorised to publish it into.
+func (a AuthorisationConfig) Enforced() bool {
+	return a.Mode == AuthorisationModeEnforce
+}
+
+// loadAuthorisation fills the default values of the authorisation settings.
+// Returns an error if the mode is unknown.
+func (c *Config) loadAuthorisation() error {
+	switch c.Authorisation.Mode {
+	case "":
+		c.Authorisation.Mode = AuthorisationModeWarn
+	case AuthorisationModeWarn, AuthorisationModeEnforce, AuthorisationModeOff:
+	default:
+		return fmt.Errorf(
+			"Unknown authorisation mode '%s', must be one of %s, %s or %s",
+			c.Authorisation.Mode, AuthorisationModeWarn, AuthorisationModeEnforce,
+			AuthorisationModeOff,
+		)
+	}
+
+	if c.Authorisation.CheckInterval <= 0 {
+		c.Authorisation.CheckInterval = defaultAuthorisationCheckInterval
+	}
+
+	return nil
+}
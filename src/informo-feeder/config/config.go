@@ -23,39 +23,58 @@ import (
 )
 
 // MatrixConfig represents the Matrix settings as specified in the configuration
-// file.
+// file. Either an access token or a password must be provided. If a password is
+// provided, the access token obtained by logging in is stored in the database.
+// AppService is true if the account is a virtual user of the application
+// service, in which case requests are sent with the application service's token
+// on behalf of this user.
 type MatrixConfig struct {
 	Homeserver  string `yaml:"homeserver"`
-	AccessToken string `yaml:"access_token"`
+	AccessToken string `yaml:"access_token,omitempty"`
 	MXID        string `yaml:"mxid"`
-}
-
-// DatabaseConfig represents the database settings as specified in the
-// configuration file.
-type DatabaseConfig struct {
-	Path string `yaml:"path,omitempty"`
+	User        string `yaml:"user,omitempty"`
+	Password    string `yaml:"password,omitempty"`
+	DeviceID    string `yaml:"device_id,omitempty"`
+	AppService  bool   `yaml:"-"`
 }
 
 // Feed represents a feed that the Informo feeder will poll at a given frequency.
+// Networks lists the names of the network profiles the feed publishes into.
+// Account is the name of the Matrix account to publish the feed's news with. If
+// empty, the account from the top-level Matrix settings is used. Name, Website
+// and Logo (either a URL or a path to a local file) describe the source when
+// registering it on the network.
 type Feed struct {
-	URL          string `yaml:"url"`
-	Identifier   string `yaml:"identifier"`
-	PollInterval int64  `yaml:"poll_interval"`
+	URL          string   `yaml:"url"`
+	Identifier   string   `yaml:"identifier"`
+	PollInterval int64    `yaml:"poll_interval"`
+	Networks     []string `yaml:"networks,omitempty"`
+	Account      string   `yaml:"account,omitempty"`
+	Name         string   `yaml:"name,omitempty"`
+	Website      string   `yaml:"website,omitempty"`
+	Logo         string   `yaml:"logo,omitempty"`
 }
 
 // Config represents the top-level configuration structure for the Informo feeder.
 type Config struct {
-	Keys     KeysConfig     `yaml:"keys"`
-	Matrix   MatrixConfig   `yaml:"matrix"`
-	Feeds    []Feed         `yaml:"feeds"`
-	Database DatabaseConfig `yaml:"database"`
+	Keys          KeysConfig              `yaml:"keys"`
+	Signing       SigningConfig           `yaml:"signing,omitempty"`
+	Matrix        MatrixConfig            `yaml:"matrix"`
+	Accounts      map[string]MatrixConfig `yaml:"accounts,omitempty"`
+	AppService    AppServiceConfig        `yaml:"appservice,omitempty"`
+	Networks      map[string]*Network     `yaml:"networks,omitempty"`
+	Authorisation AuthorisationConfig     `yaml:"authorisation,omitempty"`
+	Feeds         []Feed                  `yaml:"feeds"`
+	Database      DatabaseConfig          `yaml:"database"`
 }
 
 // Load creates a new instance of the Config structure, marshal the content from
-// the configuration file into it, and loads the pair of signing keys into it.
+// the configuration file into it, checks the network profiles, and loads the
+// pair of signing keys into it.
 // It then returns a reference to the Config instance.
 // Returns an error if there was an issue opening the configuration file, parsing
-// it or loading the keys.
+// it, checking the application service settings, the Matrix accounts, the
+// network profiles, the authorisation or signing settings, or loading the keys.
 func Load(filePath string) (cfg *Config, err error) {
 	content, err := ioutil.ReadFile(filePath)
 	if err != nil {
@@ -67,6 +86,30 @@ func Load(filePath string) (cfg *Config, err error) {
 		return
 	}
 
+	if err = cfg.loadAppService(); err != nil {
+		return
+	}
+
+	if err = cfg.checkAccounts(); err != nil {
+		return
+	}
+
+	if err = cfg.loadNetworks(); err != nil {
+		return
+	}
+
+	if err = cfg.loadAuthorisation(); err != nil {
+		return
+	}
+
+	if err = cfg.loadDatabase(); err != nil {
+		return
+	}
+
+	if err = cfg.loadSigning(); err != nil {
+		return
+	}
+
 	if err = cfg.loadKeys(); err != nil {
 		return
 	}
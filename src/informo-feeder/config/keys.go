@@ -18,6 +18,7 @@ package config
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/pem"
 	"errors"
@@ -25,18 +26,109 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ed25519"
 )
 
+const (
+	// pemBlockType is the type of the PEM blocks containing the seeds of the
+	// sources' keys.
+	pemBlockType = "INFORMO FEEDER PRIVATE KEY"
+	// The headers of the PEM blocks containing the key's ID and the bounds of
+	// its validity period (formatted as RFC 3339). The headers are optional,
+	// since the key ID can be computed from the key, and a key with no bound
+	// is valid indefinitely.
+	keyIDHeader      = "Key-ID"
+	validFromHeader  = "Valid-From"
+	validUntilHeader = "Valid-Until"
+)
+
 // KeysConfig contains the settings required to load the signing keys as loaded
-// from the configuration file, along with the actual pairs of keys.
+// from the configuration file, along with the actual pairs of keys. Sources maps
+// the identifier of each source to its keys, sorted by the start of their
+// validity period. If Encrypt is true, new keys are encrypted with a passphrase
+// (read from the PassphraseEnv environment variable, the PassphraseFile file,
+// or the terminal) before being written to disk. If Agent is set, the keys
+// are held by the signing agent listening on this Unix socket, and aren't
+// loaded by the feeder.
 type KeysConfig struct {
-	Directory   string                        `yaml:"directory"`
-	Prefix      string                        `yaml:"prefix,omitempty"`
-	PublicKeys  map[string]ed25519.PublicKey  `yaml:"-"`
-	PrivateKeys map[string]ed25519.PrivateKey `yaml:"-"`
+	Directory      string                  `yaml:"directory"`
+	Prefix         string                  `yaml:"prefix,omitempty"`
+	Agent          string                  `yaml:"agent,omitempty"`
+	Encrypt        bool                    `yaml:"encrypt,omitempty"`
+	PassphraseEnv  string                  `yaml:"passphrase_env,omitempty"`
+	PassphraseFile string                  `yaml:"passphrase_file,omitempty"`
+	Sources        map[string][]*SourceKey `yaml:"-"`
+	// LoadErrors maps the identifier of each source which keys couldn't be
+	// loaded to the error encountered.
+	LoadErrors map[string]error `yaml:"-"`
+	// passphraseBytes is the passphrase, once it has been obtained.
+	passphraseBytes []byte
+	// passphraseVerified is true if a key has been successfully decrypted
+	// with the passphrase, i.e. if the passphrase is known to be right.
+	passphraseVerified bool
+}
+
+// SourceKey is a pair of keys a source signs its news with, along with its ID
+// and its validity period. A zero ValidFrom or ValidUntil means the validity
+// period isn't bounded on this side. A source can have several keys, which
+// validity periods overlap during a key rotation. Encrypted is true if the key
+// is encrypted with the passphrase on disk.
+type SourceKey struct {
+	ID         string
+	Path       string
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+	ValidFrom  time.Time
+	ValidUntil time.Time
+	Encrypted  bool
+}
+
+// ValidAt returns true if the key is valid at the given time.
+func (k *SourceKey) ValidAt(t time.Time) bool {
+	if !k.ValidFrom.IsZero() && t.Before(k.ValidFrom) {
+		return false
+	}
+
+	return k.ValidUntil.IsZero() || t.Before(k.ValidUntil)
+}
+
+// KeyID computes the ID of a key from its public key. It is made of the
+// algorithm's name and the beginning of the SHA-256 hash of the public key, so
+// it doesn't need to be stored alongside the key.
+func KeyID(pub ed25519.PublicKey) string {
+	hash := sha256.Sum256(pub)
+	return "ed25519:" + base64.RawURLEncoding.EncodeToString(hash[:6])
+}
+
+// ActiveKey returns the key to sign the given source's news with, i.e. the
+// currently valid key which validity period started last, or nil if the source
+// has no valid key.
+func (k *KeysConfig) ActiveKey(identifier string) (active *SourceKey) {
+	now := time.Now()
+	for _, key := range k.Sources[identifier] {
+		if key.ValidAt(now) {
+			active = key
+		}
+	}
+
+	return
+}
+
+// Key returns the key of the given source with the given ID, or nil if there's
+// no such key.
+func (k *KeysConfig) Key(identifier string, keyID string) *SourceKey {
+	for _, key := range k.Sources[identifier] {
+		if key.ID == keyID {
+			return key
+		}
+	}
+
+	return nil
 }
 
 var (
@@ -46,21 +138,52 @@ var (
 	// ErrKeyNotInformoPrivateKey is returned if the PEM block that was expected
 	// to be an Informo feeder private key isn't.
 	ErrKeyNotInformoPrivateKey = errors.New("Key isn't an informo feeder private key")
+	// ErrKeyNotPEM is returned if a key file doesn't contain exactly one PEM
+	// block.
+	ErrKeyNotPEM = errors.New("Key file doesn't contain exactly one PEM block")
+	// ErrInvalidSeed is returned if the seed contained in a key file doesn't
+	// have the right size.
+	ErrInvalidSeed = errors.New("Key file contains a seed of the wrong size")
+	// ErrNoKey is returned if a source has no key.
+	ErrNoKey = errors.New("The source has no key, generate one with the 'keys generate' command")
+	// ErrKeyExists is returned if a key can't be generated or imported because
+	// the source already has it, or already has a key when generating its first
+	// one.
+	ErrKeyExists = errors.New("The source already has this key")
 )
 
 // loadKeys fills the KeysConfig member of a Config instance with the public
-// and private key for each source. If there's no key for a source, one is
-// generated and saved on disk. If the directory where the keys are supposed to
-// be stored doesn't exist, creates it.
+// and private keys for each source, unless the keys are held by a signing
+// agent, in which case the feeder never loads them.
+// Returns an error if the keys couldn't be loaded.
+func (c *Config) loadKeys() error {
+	if len(c.Keys.Agent) > 0 {
+		logrus.WithField("socket", c.Keys.Agent).Info("Using signing agent, not loading the keys")
+		return nil
+	}
+
+	identifiers := make([]string, 0, len(c.Feeds))
+	for _, source := range c.Feeds {
+		identifiers = append(identifiers, source.Identifier)
+	}
+
+	return c.Keys.Load(identifiers)
+}
+
+// Load fills the KeysConfig instance with the public and private keys for each
+// of the given sources. If the directory where the keys are supposed to be
+// stored doesn't exist, creates it.
 // Returns an error if there was an issue creating the keys directory or if its
 // path exists but isn't a directory. If an error is encountered while loading
-// or generating a key pair, only log the error and iterates to the next source.
-func (c *Config) loadKeys() (err error) {
+// the keys of a source (including if it has no key), records it in
+// LoadErrors, logs it and iterates to the next source, so the other sources can
+// still be used.
+func (k *KeysConfig) Load(identifiers []string) (err error) {
 	// Check if the keys directory exists from the value of the error returned by
 	// a stat on its path.
-	info, err := os.Stat(c.Keys.Directory)
+	info, err := os.Stat(k.Directory)
 	var created bool
-	if created, err = c.createKeysDirIfNotExists(err); err != nil {
+	if created, err = k.createKeysDirIfNotExists(err); err != nil {
 		return
 	}
 
@@ -81,31 +204,34 @@ func (c *Config) loadKeys() (err error) {
 			warnMsg = warnMsg + " recommended to set this to 700 (using 'chmod 700'"
 			warnMsg = warnMsg + " for example)."
 			logrus.WithFields(logrus.Fields{
-				"path": c.Keys.Directory,
+				"path": k.Directory,
 				"mode": info.Mode(),
 			}).Warnf(warnMsg, info.Mode().Perm())
 		}
 	}
 
-	// Initiate the maps for the public and private keys so we don't panic because
-	// we try to write to a forbidden memory address.
-	c.Keys.PublicKeys = make(map[string]ed25519.PublicKey)
-	c.Keys.PrivateKeys = make(map[string]ed25519.PrivateKey)
+	// Initiate the maps for the keys and errors so we don't panic because we
+	// try to write to a forbidden memory address.
+	k.Sources = make(map[string][]*SourceKey)
+	k.LoadErrors = make(map[string]error)
 	// Iterate over the sources.
-	for _, source := range c.Feeds {
-		id := source.Identifier
-		// Load the pair of keys for this source. If there's no key for a source,
-		// it will be generated then loaded.
-		c.Keys.PublicKeys[id], c.Keys.PrivateKeys[id], err = c.loadOrGenerateKeys(id)
-		if err != nil {
-			// Only log any error returned here so we don't break the loop.
+	for _, id := range identifiers {
+		// Load the keys for this source.
+		keys, loadErr := k.loadSourceKeys(id)
+		if loadErr != nil {
+			// Only record and log any error returned here so we don't break
+			// the loop.
+			k.LoadErrors[id] = loadErr
 			logrus.WithField(
 				"identifier", id,
-			).Error(err.Error())
+			).Error(loadErr.Error())
+			continue
 		}
+
+		k.Sources[id] = keys
 	}
 
-	return
+	return nil
 }
 
 // createKeysDirIfNotExists checks if an error (returned by os.Stat()) is
@@ -115,63 +241,152 @@ func (c *Config) loadKeys() (err error) {
 // If the error isn't os.ErrNotExist, returns it so the calling function can
 // process it.
 // Returns an error if the directory couldn't be created.
-func (c *Config) createKeysDirIfNotExists(pathErr error) (created bool, err error) {
+func (k *KeysConfig) createKeysDirIfNotExists(pathErr error) (created bool, err error) {
 	// Check the error
 	if !os.IsNotExist(pathErr) {
 		return
 	}
 
 	logrus.WithField(
-		"path", c.Keys.Directory,
+		"path", k.Directory,
 	).Info("Attempting to create keys directory")
 
 	// Create the directory
-	if err = os.Mkdir(c.Keys.Directory, 0700); err != nil {
+	if err = os.Mkdir(k.Directory, 0700); err != nil {
 		return
 	}
 
 	created = true
 
 	logrus.WithField(
-		"path", c.Keys.Directory,
+		"path", k.Directory,
 	).Info("Keys directory created")
 
 	return
 }
 
-// loadOrGenerateKeys returns the public and private keys for a source, identified
-// with a given identifier, loaded from a PEM file. If the PEM file doesn't exist,
-// it is created and filled with a randomly-generated string which will be used
-// as a constant seed to generate the key pair for this source. In both cases,
-// both the public key and the private key are returned.
-// Returns an error if there was an issue checking if the PEM file exists or
-// loading or generating the keys.
-func (c *Config) loadOrGenerateKeys(
-	identifier string,
-) (pub ed25519.PublicKey, priv ed25519.PrivateKey, err error) {
-	// Check if the PEM file exists.
-	path := filepath.Join(c.Keys.Directory, identifier+".pem")
-	_, err = os.Stat(path)
-	pemFileExists := !os.IsNotExist(err)
-	if err != nil && pemFileExists {
+// loadSourceKeys returns the keys for a source, identified with a given
+// identifier, loaded from PEM files. The first key of a source is stored in
+// <identifier>.pem, and the keys generated by key rotations in
+// <identifier>.<key ID>.pem (without the algorithm's name). The keys are
+// returned sorted by the start of their validity period.
+// Returns ErrNoKey if there's no PEM file for the source, or an error if there
+// was an issue listing the PEM files or loading one of the keys, or if two
+// files contain the same key.
+func (k *KeysConfig) loadSourceKeys(identifier string) (keys []*SourceKey, err error) {
+	paths, err := k.keyFiles(identifier)
+	if err != nil {
 		return
 	}
 
-	// Decide what to do based on the existence of the PEM file, and log the
-	// chosen operation once it is complete.
-	var logMessage string
-	if pemFileExists {
-		logMessage = "Loaded keys"
-		pub, priv, err = c.loadKeyFromFile(path, identifier)
-	} else {
-		logMessage = "Generated keys"
-		pub, priv, err = c.generateAndSaveKey(path, identifier)
+	if len(paths) == 0 {
+		return nil, ErrNoKey
+	}
+
+	ids := make(map[string]bool)
+	for _, path := range paths {
+		var key *SourceKey
+		if key, err = k.loadKeyFromFile(path, identifier); err != nil {
+			err = fmt.Errorf("Couldn't load %s: %v", path, err)
+			return
+		}
+
+		if ids[key.ID] {
+			err = fmt.Errorf("Key %s is stored in several files", key.ID)
+			return
+		}
+
+		ids[key.ID] = true
+
+		logrus.WithFields(logrus.Fields{
+			"identifier": identifier,
+			"key_id":     key.ID,
+			"public_key": base64.StdEncoding.EncodeToString(key.PublicKey),
+		}).Info("Loaded keys")
+
+		keys = append(keys, key)
 	}
 
-	logrus.WithFields(logrus.Fields{
-		"identifier": identifier,
-		"public_key": base64.StdEncoding.EncodeToString(pub),
-	}).Info(logMessage)
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].ValidFrom.Before(keys[j].ValidFrom)
+	})
+
+	return
+}
+
+// keyFiles returns the paths of the PEM files containing the keys of the given
+// source.
+// Returns an error if the keys directory couldn't be listed.
+func (k *KeysConfig) keyFiles(identifier string) (paths []string, err error) {
+	path := filepath.Join(k.Directory, identifier+".pem")
+	if _, err = os.Stat(path); err == nil {
+		paths = append(paths, path)
+	} else if !os.IsNotExist(err) {
+		return
+	}
+
+	matches, err := filepath.Glob(
+		filepath.Join(k.Directory, identifier+".*.pem"),
+	)
+	if err != nil {
+		return
+	}
+
+	for _, match := range matches {
+		// Make sure the file doesn't belong to another source which identifier
+		// starts with this one's, followed by a dot.
+		suffix := strings.TrimSuffix(
+			strings.TrimPrefix(filepath.Base(match), identifier+"."), ".pem",
+		)
+		if !strings.Contains(suffix, ".") {
+			paths = append(paths, match)
+		}
+	}
+
+	return
+}
+
+// GenerateRotationKey generates a new key for the given source, valid from the
+// given time, and saves it in a new PEM file. It then limits the validity of
+// the source's key which is currently active to the given overlap after the
+// new key's validity starts, so readers can still verify the news signed with
+// it in the meantime.
+// Returns the previously active key and the new one, or an error if the source
+// has no active key, or if there was an issue generating or saving the keys.
+func (c *Config) GenerateRotationKey(
+	identifier string, validFrom time.Time, overlap time.Duration,
+) (oldKey *SourceKey, newKey *SourceKey, err error) {
+	if oldKey = c.Keys.ActiveKey(identifier); oldKey == nil {
+		err = fmt.Errorf("Source %s has no active key to rotate", identifier)
+		return
+	}
+
+	seed, err := randomSeed()
+	if err != nil {
+		return
+	}
+
+	newKey, err = newSourceKey(seed)
+	if err != nil {
+		return
+	}
+
+	newKey.ValidFrom = validFrom
+	newKey.Path = filepath.Join(
+		c.Keys.Directory,
+		identifier+"."+strings.TrimPrefix(newKey.ID, "ed25519:")+".pem",
+	)
+
+	if err = c.Keys.writeKeyFile(newKey); err != nil {
+		return
+	}
+
+	oldKey.ValidUntil = validFrom.Add(overlap)
+	if err = c.Keys.writeKeyFile(oldKey); err != nil {
+		return
+	}
+
+	c.Keys.Sources[identifier] = append(c.Keys.Sources[identifier], newKey)
 
 	return
 }
@@ -182,33 +397,26 @@ func (c *Config) loadOrGenerateKeys(
 // to do with it.
 // Returns an error if there was an issue generating the randomised seed, opening
 // the PEM file, writing the seed in it or getting the pair of keys from it.
-func (c *Config) generateAndSaveKey(
+func (k *KeysConfig) generateAndSaveKey(
 	pemPath string, identifier string,
-) (pub ed25519.PublicKey, priv ed25519.PrivateKey, err error) {
+) (key *SourceKey, err error) {
 	// Generate a 32-bytes randomised string.
-	var data [32]byte
-	if _, err = rand.Read(data[:]); err != nil {
+	seed, err := randomSeed()
+	if err != nil {
 		return
 	}
 
-	// Open/create the file for writing with the correct permissions.
-	keyOut, err := os.OpenFile(pemPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
+	// Get the public and private keys from the seed.
+	if key, err = newSourceKey(seed); err != nil {
 		return
 	}
-	defer keyOut.Close()
 
 	// Write the seed to the file as a PEM block.
-	if err = pem.Encode(keyOut, &pem.Block{
-		Type:  "INFORMO FEEDER PRIVATE KEY",
-		Bytes: data[:],
-	}); err != nil {
+	key.Path = pemPath
+	if err = k.writeKeyFile(key); err != nil {
 		return
 	}
 
-	// Get the public and private keys from the seed.
-	pub, priv, err = ed25519.GenerateKey(bytes.NewBuffer(data[:]))
-
 	// Print out an informational message about the keys. The public key is
 	// encoded as base64 (which the JS client can read) so it can be printed in
 	// a terminal.
@@ -216,47 +424,265 @@ func (c *Config) generateAndSaveKey(
 	keyGenLogMsg = keyGenLogMsg + "A key pair has been generated for the source %s\n"
 	keyGenLogMsg = keyGenLogMsg + "The private key is located at %s\n"
 	keyGenLogMsg = keyGenLogMsg + "The public key is %s\n"
-	keyGenLogMsg = keyGenLogMsg + "Please let the Informo moderation team know"
-	keyGenLogMsg = keyGenLogMsg + " about your new public key in order for your"
-	keyGenLogMsg = keyGenLogMsg + " news to be verified by the users.\n"
+	keyGenLogMsg = keyGenLogMsg + "Please register your source on the Informo"
+	keyGenLogMsg = keyGenLogMsg + " network (using the register-source command)"
+	keyGenLogMsg = keyGenLogMsg + " in order for your news to be verified by the"
+	keyGenLogMsg = keyGenLogMsg + " users.\n"
 	keyGenLogMsg = keyGenLogMsg + "\n\n"
 
 	fmt.Printf(
 		keyGenLogMsg,
 		identifier,
 		pemPath,
-		base64.StdEncoding.EncodeToString(pub),
+		base64.StdEncoding.EncodeToString(key.PublicKey),
 	)
 
 	return
 }
 
-// loadKeyFromFile reads the content of a PEM file and extracts the seed from it.
-// It then returns the public and private keys generated from the seed.
-// Returns an error if there was an issue reading the file, generating the keys,
-// or if the PEM block isn't an Informo feeder private key block.
-func (c *Config) loadKeyFromFile(
+// loadKeyFromFile reads the content of a PEM file and parses the key it
+// contains. Logs a warning if the file can be accessed by other users than its
+// owner.
+// Returns an error if there was an issue reading the file or parsing the key.
+func (k *KeysConfig) loadKeyFromFile(
 	pemPath string, identifier string,
-) (pub ed25519.PublicKey, priv ed25519.PrivateKey, err error) {
+) (key *SourceKey, err error) {
+	info, err := os.Stat(pemPath)
+	if err != nil {
+		return
+	}
+
+	if info.Mode().Perm()&0077 != 0 {
+		logrus.WithFields(logrus.Fields{
+			"identifier": identifier,
+			"path":       pemPath,
+			"mode":       info.Mode(),
+		}).Warn("The key file can be accessed by other users, it is recommended to set its mode to 600")
+	}
+
 	// Read the PEM file's content.
 	content, err := ioutil.ReadFile(pemPath)
 	if err != nil {
 		return
 	}
 
-	// Decode the PEM content.
-	keyBlock, _ := pem.Decode(content)
+	if key, err = k.parseKey(content); err != nil {
+		return
+	}
+
+	key.Path = pemPath
+	return
+}
+
+// parseKey extracts the seed from the given PEM-encoded key, decrypting it
+// with the passphrase if it's encrypted, along with the key's validity period
+// from the PEM headers. It then returns the key generated from the seed.
+// Returns an error if the content isn't a single PEM block, if the PEM block
+// isn't an Informo feeder private key block, if it has unknown or invalid
+// headers, if the seed couldn't be decrypted or doesn't have the right size, or
+// if the key ID doesn't match with the key.
+func (k *KeysConfig) parseKey(content []byte) (key *SourceKey, err error) {
+	// Decode the PEM content, and make sure there's nothing else in the file.
+	keyBlock, rest := pem.Decode(content)
+	if keyBlock == nil || len(bytes.TrimSpace(rest)) > 0 {
+		err = ErrKeyNotPEM
+		return
+	}
+
 	// If the block isn't of the right type, return with an error as we can't be
 	// sure of the content (either the file was generated by another program or
 	// it has been tempered with).
-	if keyBlock.Type != "INFORMO FEEDER PRIVATE KEY" {
-		logrus.WithField(
-			"identifier", identifier,
-		).Error(ErrKeyNotInformoPrivateKey.Error())
+	encrypted := keyBlock.Type == encryptedPEMBlockType
+	if keyBlock.Type != pemBlockType && !encrypted {
 		err = ErrKeyNotInformoPrivateKey
 		return
 	}
 
-	// Generate and return the keys.
-	return ed25519.GenerateKey(bytes.NewReader(keyBlock.Bytes))
+	for header := range keyBlock.Headers {
+		if !knownHeader(header, encrypted) {
+			err = fmt.Errorf("Unknown header %s", header)
+			return
+		}
+	}
+
+	// Decrypt the seed if it's encrypted.
+	seed := keyBlock.Bytes
+	if encrypted {
+		var passphrase []byte
+		if passphrase, err = k.passphrase(false); err != nil {
+			return
+		}
+
+		if seed, err = decryptSeed(keyBlock, passphrase); err != nil {
+			return
+		}
+
+		k.passphraseVerified = true
+	}
+
+	if len(seed) != 32 {
+		err = ErrInvalidSeed
+		return
+	}
+
+	// Generate the keys.
+	if key, err = newSourceKey(seed); err != nil {
+		return
+	}
+
+	key.Encrypted = encrypted
+
+	// Make sure the key ID, if any, is the one of the key. If not, the file
+	// has been tampered with.
+	if id, ok := keyBlock.Headers[keyIDHeader]; ok && id != key.ID {
+		err = fmt.Errorf(
+			"The ID of the key (%s) doesn't match with the key (%s)", id, key.ID,
+		)
+		return
+	}
+
+	if key.ValidFrom, err = parseValidityHeader(keyBlock, validFromHeader); err != nil {
+		return
+	}
+
+	if key.ValidUntil, err = parseValidityHeader(keyBlock, validUntilHeader); err != nil {
+		return
+	}
+
+	if !key.ValidFrom.IsZero() && !key.ValidUntil.IsZero() &&
+		!key.ValidFrom.Before(key.ValidUntil) {
+		err = errors.New("The validity period of the key ends before it starts")
+	}
+
+	return
+}
+
+// knownHeader returns true if the given header can be found in the PEM block
+// of a key, encrypted or not.
+func knownHeader(header string, encrypted bool) bool {
+	switch header {
+	case keyIDHeader, validFromHeader, validUntilHeader:
+		return true
+	case kdfHeader, saltHeader, nonceHeader:
+		return encrypted
+	}
+
+	return false
+}
+
+// newSourceKey generates the pair of keys matching with the given seed.
+// Returns an error if the keys couldn't be generated.
+func newSourceKey(seed []byte) (*SourceKey, error) {
+	pub, priv, err := ed25519.GenerateKey(bytes.NewReader(seed))
+	if err != nil {
+		return nil, err
+	}
+
+	return &SourceKey{
+		ID:         KeyID(pub),
+		PublicKey:  pub,
+		PrivateKey: priv,
+	}, nil
+}
+
+// writeKeyFile writes the seed of the given key to the key's PEM file, along
+// with its ID and validity period as PEM headers. The seed is encrypted with
+// the passphrase if the key is already encrypted or if the configuration says
+// new keys must be. The file is replaced atomically, so a failed write never
+// loses the key it held.
+// Returns an error if there was an issue encrypting the seed or writing the PEM
+// file.
+func (k *KeysConfig) writeKeyFile(key *SourceKey) (err error) {
+	// The seed is the first half of the private key.
+	block := &pem.Block{
+		Type:    pemBlockType,
+		Headers: map[string]string{keyIDHeader: key.ID},
+		Bytes:   key.PrivateKey[:32],
+	}
+
+	if !key.ValidFrom.IsZero() {
+		block.Headers[validFromHeader] = key.ValidFrom.UTC().Format(time.RFC3339)
+	}
+	if !key.ValidUntil.IsZero() {
+		block.Headers[validUntilHeader] = key.ValidUntil.UTC().Format(time.RFC3339)
+	}
+
+	if key.Encrypted || k.Encrypt {
+		// Ask for a confirmation if the passphrase is typed in the terminal
+		// and hasn't been used to decrypt a key yet.
+		var passphrase []byte
+		if passphrase, err = k.passphrase(!k.passphraseVerified); err != nil {
+			return
+		}
+
+		if block, err = encryptSeed(block.Bytes, passphrase, block.Headers); err != nil {
+			return
+		}
+
+		key.Encrypted = true
+	}
+
+	return writeFileAtomically(key.Path, pem.EncodeToMemory(block))
+}
+
+// writeFileAtomically writes the given content to a temporary file only its
+// owner can access, in the same directory as the file at the given path, syncs
+// it, then renames it over the file. This way, the file is either replaced
+// with the full content or left untouched, even if the feeder crashes or the
+// disk is full while writing it, which matters since it may hold the only copy
+// of a private key.
+// Returns an error if the temporary file couldn't be created, written, synced
+// or renamed.
+func writeFileAtomically(path string, content []byte) (err error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if err = tmp.Chmod(0600); err != nil {
+		return
+	}
+	if _, err = tmp.Write(content); err != nil {
+		return
+	}
+	if err = tmp.Sync(); err != nil {
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// randomSeed generates a 32-bytes randomised string to be used as the seed of
+// a pair of keys.
+// Returns an error if the random generator failed.
+func randomSeed() (seed []byte, err error) {
+	seed = make([]byte, 32)
+	_, err = rand.Read(seed)
+	return
+}
+
+// parseValidityHeader parses the given header of a PEM block as a RFC 3339
+// time. Returns a zero time if the header isn't set.
+// Returns an error if the header's value isn't a valid time.
+func parseValidityHeader(block *pem.Block, header string) (t time.Time, err error) {
+	value, ok := block.Headers[header]
+	if !ok {
+		return
+	}
+
+	if t, err = time.Parse(time.RFC3339, value); err != nil {
+		err = fmt.Errorf("Invalid %s header: %v", header, err)
+	}
+
+	return
 }
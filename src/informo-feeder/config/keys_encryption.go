@@ -0,0 +1,292 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	// encryptedPEMBlockType is the type of the PEM blocks containing the
+	// encrypted seeds of the sources' keys.
+	encryptedPEMBlockType = "INFORMO FEEDER ENCRYPTED PRIVATE KEY"
+	// The headers of the encrypted PEM blocks containing the parameters needed
+	// to derive the encryption key from the passphrase, and to decrypt the
+	// seed with it.
+	kdfHeader   = "KDF"
+	saltHeader  = "Salt"
+	nonceHeader = "Nonce"
+
+	// The cost parameters of the scrypt key derivation, as recommended for
+	// interactive logins in 2017.
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+
+	// defaultPassphraseEnv is the name of the environment variable the
+	// passphrase is read from if none is specified in the configuration file.
+	defaultPassphraseEnv = "INFORMO_FEEDER_KEYS_PASSPHRASE"
+)
+
+var (
+	// ErrNoPassphrase is returned if a passphrase is needed to encrypt or
+	// decrypt a key but none could be obtained.
+	ErrNoPassphrase = errors.New("A passphrase is needed to encrypt or decrypt the keys, but none was provided in the environment or in a file, and no terminal is available to prompt for it")
+	// ErrPassphraseMismatch is returned if the passphrase and its confirmation
+	// typed in the terminal don't match.
+	ErrPassphraseMismatch = errors.New("The passphrases don't match")
+	// ErrWrongPassphrase is returned if a key couldn't be decrypted, which
+	// means either the passphrase is wrong or the key has been tampered with.
+	ErrWrongPassphrase = errors.New("Couldn't decrypt the key, the passphrase is probably wrong")
+	// ErrUnsupportedKDF is returned if a key has been encrypted with other key
+	// derivation parameters than the ones the feeder uses, which could
+	// otherwise make it use an unbounded amount of memory and time to derive
+	// the encryption key.
+	ErrUnsupportedKDF = errors.New("The key has been encrypted with unsupported key derivation parameters")
+)
+
+// EncryptKeys encrypts, with the passphrase, the keys of the given sources (or
+// of all the sources if none is given) that are stored in plain text.
+// Returns the number of keys that have been encrypted, or an error if the
+// passphrase couldn't be obtained or a key couldn't be written.
+func (c *Config) EncryptKeys(identifiers []string) (count int, err error) {
+	if len(identifiers) == 0 {
+		for identifier := range c.Keys.Sources {
+			identifiers = append(identifiers, identifier)
+		}
+	}
+
+	for _, identifier := range identifiers {
+		keys, ok := c.Keys.Sources[identifier]
+		if !ok {
+			err = fmt.Errorf("Unknown source %s", identifier)
+			return
+		}
+
+		for _, key := range keys {
+			if key.Encrypted {
+				continue
+			}
+
+			key.Encrypted = true
+			if err = c.Keys.writeKeyFile(key); err != nil {
+				return
+			}
+
+			count++
+		}
+	}
+
+	return
+}
+
+// passphrase returns the passphrase to encrypt and decrypt the keys with. It
+// is read from the environment variable specified in the configuration file
+// (or INFORMO_FEEDER_KEYS_PASSPHRASE), then from the file specified in the
+// configuration file, and, failing that, typed in the terminal. If confirm is
+// true, the passphrase typed in the terminal has to be typed twice, since it
+// is about to be used to encrypt a key. The passphrase is only obtained once.
+// Returns ErrNoPassphrase if no passphrase could be obtained, or an error if
+// the passphrase file couldn't be read or the passphrases typed in the terminal
+// don't match.
+func (k *KeysConfig) passphrase(confirm bool) ([]byte, error) {
+	if k.passphraseBytes != nil {
+		return k.passphraseBytes, nil
+	}
+
+	envName := k.PassphraseEnv
+	if len(envName) == 0 {
+		envName = defaultPassphraseEnv
+	}
+
+	if value := os.Getenv(envName); len(value) > 0 {
+		k.passphraseBytes = []byte(value)
+		return k.passphraseBytes, nil
+	}
+
+	if len(k.PassphraseFile) > 0 {
+		content, err := ioutil.ReadFile(k.PassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+
+		k.passphraseBytes = []byte(strings.TrimRight(string(content), "\r\n"))
+		return k.passphraseBytes, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, ErrNoPassphrase
+	}
+
+	passphrase, err := readPassphrase(fd, "Passphrase for the keys: ")
+	if err != nil {
+		return nil, err
+	}
+
+	if confirm {
+		confirmation, err := readPassphrase(fd, "Confirm the passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+
+		if !bytes.Equal(passphrase, confirmation) {
+			return nil, ErrPassphraseMismatch
+		}
+	}
+
+	k.passphraseBytes = passphrase
+	return k.passphraseBytes, nil
+}
+
+// readPassphrase prints out the given prompt and reads a passphrase from the
+// terminal without echoing it.
+// Returns an error if the passphrase couldn't be read.
+func readPassphrase(fd int, prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+
+	return terminal.ReadPassword(fd)
+}
+
+// encryptSeed encrypts the given seed with AES-256-GCM, using a key derived
+// from the given passphrase with scrypt and a random salt. The given headers,
+// i.e. the key's ID and validity period, are copied into the PEM block and
+// authenticated along with the seed, so an encrypted seed can't be passed off
+// as another key, nor its validity period changed.
+// Returns the PEM block containing the encrypted seed, or an error if the
+// encryption failed.
+func encryptSeed(
+	seed []byte, passphrase []byte, headers map[string]string,
+) (*pem.Block, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	block := &pem.Block{
+		Type: encryptedPEMBlockType,
+		Headers: map[string]string{
+			kdfHeader:   kdfParameters(),
+			saltHeader:  base64.StdEncoding.EncodeToString(salt),
+			nonceHeader: base64.StdEncoding.EncodeToString(nonce),
+		},
+		Bytes: aead.Seal(nil, nonce, seed, additionalData(headers)),
+	}
+
+	for header, value := range headers {
+		block.Headers[header] = value
+	}
+
+	return block, nil
+}
+
+// decryptSeed decrypts the seed contained in the given encrypted PEM block,
+// using the given passphrase.
+// Returns ErrWrongPassphrase if the seed couldn't be decrypted,
+// ErrUnsupportedKDF if the block's key derivation parameters aren't the ones
+// the feeder uses, or an error if the block's other headers are missing or
+// invalid.
+func decryptSeed(block *pem.Block, passphrase []byte) ([]byte, error) {
+	if block.Headers[kdfHeader] != kdfParameters() {
+		return nil, ErrUnsupportedKDF
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(block.Headers[saltHeader])
+	if err != nil || len(salt) == 0 {
+		return nil, fmt.Errorf("Invalid %s header", saltHeader)
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(block.Headers[nonceHeader])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s header", nonceHeader)
+	}
+
+	aead, err := newAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("Invalid %s header", nonceHeader)
+	}
+
+	seed, err := aead.Open(nil, nonce, block.Bytes, additionalData(block.Headers))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	return seed, nil
+}
+
+// additionalData returns the data authenticated along with an encrypted seed,
+// from the headers of its PEM block: the name and value of the key ID and
+// validity headers, in this order, one per line. The value of a header which
+// isn't set is empty.
+func additionalData(headers map[string]string) []byte {
+	var data bytes.Buffer
+	for _, header := range []string{keyIDHeader, validFromHeader, validUntilHeader} {
+		fmt.Fprintf(&data, "%s: %s\n", header, headers[header])
+	}
+
+	return data.Bytes()
+}
+
+// kdfParameters returns the value of the header describing the key derivation
+// parameters the feeder encrypts the seeds with.
+func kdfParameters() string {
+	return fmt.Sprintf("scrypt N=%d r=%d p=%d", scryptN, scryptR, scryptP)
+}
+
+// newAEAD derives a 256-bit key from the given passphrase and salt with scrypt
+// and the feeder's cost parameters, and returns an AES-GCM AEAD using this key.
+// Returns an error if the key couldn't be derived.
+func newAEAD(passphrase []byte, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,175 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+)
+
+// testHeaders returns the headers of the PEM block of a key which validity
+// period is bounded on both sides.
+func testHeaders() map[string]string {
+	return map[string]string{
+		keyIDHeader:      "1",
+		validFromHeader:  "2018-01-01T00:00:00Z",
+		validUntilHeader: "2019-01-01T00:00:00Z",
+	}
+}
+
+func TestDecryptSeed(t *testing.T) {
+	seed := bytes.Repeat([]byte{0x42}, 32)
+	passphrase := []byte("correct horse battery staple")
+
+	tests := []struct {
+		name       string
+		passphrase []byte
+		tamper     func(block *pem.Block)
+		wantErr    error
+		wantAnyErr bool
+	}{
+		{
+			name:       "right passphrase",
+			passphrase: passphrase,
+		},
+		{
+			name:       "wrong passphrase",
+			passphrase: []byte("wrong"),
+			wantErr:    ErrWrongPassphrase,
+		},
+		{
+			name:       "other key ID",
+			passphrase: passphrase,
+			tamper:     func(block *pem.Block) { block.Headers[keyIDHeader] = "other" },
+			wantErr:    ErrWrongPassphrase,
+		},
+		{
+			name:       "other validity start",
+			passphrase: passphrase,
+			tamper: func(block *pem.Block) {
+				block.Headers[validFromHeader] = "2017-01-01T00:00:00Z"
+			},
+			wantErr: ErrWrongPassphrase,
+		},
+		{
+			name:       "removed validity end",
+			passphrase: passphrase,
+			tamper:     func(block *pem.Block) { delete(block.Headers, validUntilHeader) },
+			wantErr:    ErrWrongPassphrase,
+		},
+		{
+			name:       "altered ciphertext",
+			passphrase: passphrase,
+			tamper:     func(block *pem.Block) { block.Bytes[0] ^= 1 },
+			wantErr:    ErrWrongPassphrase,
+		},
+		{
+			name:       "expensive KDF parameters",
+			passphrase: passphrase,
+			tamper: func(block *pem.Block) {
+				block.Headers[kdfHeader] = "scrypt N=1073741824 r=8 p=1"
+			},
+			wantErr: ErrUnsupportedKDF,
+		},
+		{
+			name:       "cheap KDF parameters",
+			passphrase: passphrase,
+			tamper: func(block *pem.Block) {
+				block.Headers[kdfHeader] = "scrypt N=2 r=1 p=1"
+			},
+			wantErr: ErrUnsupportedKDF,
+		},
+		{
+			name:       "missing KDF header",
+			passphrase: passphrase,
+			tamper:     func(block *pem.Block) { delete(block.Headers, kdfHeader) },
+			wantErr:    ErrUnsupportedKDF,
+		},
+		{
+			name:       "missing salt",
+			passphrase: passphrase,
+			tamper:     func(block *pem.Block) { delete(block.Headers, saltHeader) },
+			wantAnyErr: true,
+		},
+		{
+			name:       "short nonce",
+			passphrase: passphrase,
+			tamper: func(block *pem.Block) {
+				block.Headers[nonceHeader] = base64.StdEncoding.EncodeToString([]byte("short"))
+			},
+			wantAnyErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		block, err := encryptSeed(seed, passphrase, testHeaders())
+		if err != nil {
+			t.Fatalf("encryptSeed: %v", err)
+		}
+
+		if bytes.Contains(block.Bytes, seed) {
+			t.Fatalf("the encrypted block contains the seed in plain text")
+		}
+
+		if test.tamper != nil {
+			test.tamper(block)
+		}
+
+		got, err := decryptSeed(block, test.passphrase)
+		switch {
+		case test.wantErr != nil:
+			if err != test.wantErr {
+				t.Errorf("%s: got error %v, want %v", test.name, err, test.wantErr)
+			}
+		case test.wantAnyErr:
+			if err == nil {
+				t.Errorf("%s: got no error", test.name)
+			}
+		case err != nil:
+			t.Errorf("%s: got error %v", test.name, err)
+		case !bytes.Equal(got, seed):
+			t.Errorf("%s: got seed %x, want %x", test.name, got, seed)
+		}
+	}
+}
+
+func TestEncryptSeedIsRandomised(t *testing.T) {
+	seed := bytes.Repeat([]byte{0x42}, 32)
+
+	first, err := encryptSeed(seed, []byte("passphrase"), testHeaders())
+	if err != nil {
+		t.Fatalf("encryptSeed: %v", err)
+	}
+
+	second, err := encryptSeed(seed, []byte("passphrase"), testHeaders())
+	if err != nil {
+		t.Fatalf("encryptSeed: %v", err)
+	}
+
+	if first.Headers[saltHeader] == second.Headers[saltHeader] {
+		t.Error("two encryptions used the same salt")
+	}
+
+	if first.Headers[nonceHeader] == second.Headers[nonceHeader] {
+		t.Error("two encryptions used the same nonce")
+	}
+
+	if bytes.Equal(first.Bytes, second.Bytes) {
+		t.Error("two encryptions produced the same ciphertext")
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// publicPEMBlockType is the type of the PEM blocks containing the exported
+// public keys of the sources.
+const publicPEMBlockType = "INFORMO FEEDER PUBLIC KEY"
+
+// ErrActiveKey is returned if the key currently used to sign a source's news
+// is about to be deleted without being forced to.
+var ErrActiveKey = errors.New("The key is currently used to sign the source's news, use -force to delete it anyway")
+
+// Generate generates the first key of the given source and saves it in
+// <identifier>.pem in the keys directory.
+// Returns an error if the source already has a key, or if there was an issue
+// generating or saving the key.
+func (k *KeysConfig) Generate(identifier string) (key *SourceKey, err error) {
+	paths, err := k.keyFiles(identifier)
+	if err != nil {
+		return
+	}
+
+	if len(paths) > 0 {
+		err = fmt.Errorf(
+			"Source %s already has a key, use the 'keys rotate' command to add a new one",
+			identifier,
+		)
+		return
+	}
+
+	key, err = k.generateAndSaveKey(
+		filepath.Join(k.Directory, identifier+".pem"), identifier,
+	)
+	if err != nil {
+		return
+	}
+
+	k.addKey(identifier, key)
+	return
+}
+
+// Import validates the key stored in the PEM file at the given path, and
+// saves it as a key of the given source in the keys directory, encrypting it if
+// the configuration says new keys must be. The file is named <identifier>.pem
+// if the source has no key yet, or <identifier>.<key ID>.pem (without the
+// algorithm's name) otherwise.
+// Returns ErrKeyExists if the source already has this key, or an error if the
+// file doesn't contain a valid key or if there was an issue saving it.
+func (k *KeysConfig) Import(identifier string, path string) (key *SourceKey, err error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	if key, err = k.parseKey(content); err != nil {
+		return
+	}
+
+	if k.Key(identifier, key.ID) != nil {
+		err = ErrKeyExists
+		return
+	}
+
+	paths, err := k.keyFiles(identifier)
+	if err != nil {
+		return
+	}
+
+	key.Path = filepath.Join(k.Directory, identifier+".pem")
+	if len(paths) > 0 {
+		key.Path = filepath.Join(
+			k.Directory,
+			identifier+"."+strings.TrimPrefix(key.ID, "ed25519:")+".pem",
+		)
+	}
+
+	// Don't overwrite a file we couldn't load the key from.
+	if _, err = os.Stat(key.Path); err == nil {
+		err = ErrKeyExists
+		return
+	} else if !os.IsNotExist(err) {
+		return
+	}
+
+	if err = k.writeKeyFile(key); err != nil {
+		return
+	}
+
+	k.addKey(identifier, key)
+	return
+}
+
+// Delete deletes the key of the given source with the given ID, along with the
+// PEM file it's stored in. The key currently used to sign the source's news is
+// only deleted if force is true.
+// Returns ErrActiveKey if the key is the active one and force is false, or an
+// error if the source has no such key or if the file couldn't be deleted.
+func (k *KeysConfig) Delete(identifier string, keyID string, force bool) (err error) {
+	key := k.Key(identifier, keyID)
+	if key == nil {
+		return fmt.Errorf("Source %s has no key %s", identifier, keyID)
+	}
+
+	if key == k.ActiveKey(identifier) && !force {
+		return ErrActiveKey
+	}
+
+	if err = os.Remove(key.Path); err != nil {
+		return
+	}
+
+	keys := k.Sources[identifier][:0]
+	for _, sourceKey := range k.Sources[identifier] {
+		if sourceKey != key {
+			keys = append(keys, sourceKey)
+		}
+	}
+	k.Sources[identifier] = keys
+
+	return
+}
+
+// PublicKeyPEM returns the public key of the given key as a PEM block, along
+// with its ID and validity period.
+func PublicKeyPEM(key *SourceKey) []byte {
+	block := &pem.Block{
+		Type:    publicPEMBlockType,
+		Headers: map[string]string{keyIDHeader: key.ID},
+		Bytes:   key.PublicKey,
+	}
+
+	if !key.ValidFrom.IsZero() {
+		block.Headers[validFromHeader] = key.ValidFrom.UTC().Format(time.RFC3339)
+	}
+	if !key.ValidUntil.IsZero() {
+		block.Headers[validUntilHeader] = key.ValidUntil.UTC().Format(time.RFC3339)
+	}
+
+	return pem.EncodeToMemory(block)
+}
+
+// Fingerprint returns the fingerprint of the given public key, i.e. its
+// SHA-256 hash as colon-separated hexadecimal bytes, so it can be compared by
+// hand with the one displayed by another party.
+func Fingerprint(pub ed25519.PublicKey) string {
+	hash := sha256.Sum256(pub)
+
+	bytes := make([]string, 0, len(hash))
+	for _, b := range hash {
+		bytes = append(bytes, fmt.Sprintf("%02X", b))
+	}
+
+	return strings.Join(bytes, ":")
+}
+
+// addKey adds the given key to the keys of the given source, and forgets about
+// the source not having any key when they were loaded.
+func (k *KeysConfig) addKey(identifier string, key *SourceKey) {
+	if k.Sources == nil {
+		k.Sources = make(map[string][]*SourceKey)
+	}
+
+	k.Sources[identifier] = append(k.Sources[identifier], key)
+	if k.LoadErrors[identifier] == ErrNoKey {
+		delete(k.LoadErrors, identifier)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomically(t *testing.T) {
+	dir, err := ioutil.TempDir("", "informo-feeder-keys")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "acmenews.pem")
+	tests := []struct {
+		name    string
+		path    string
+		content []byte
+		wantErr bool
+		want    []byte
+	}{
+		{"new file", path, []byte("first"), false, []byte("first")},
+		{"existing file", path, []byte("second"), false, []byte("second")},
+		// A failed write must leave the existing file untouched.
+		{"missing directory", filepath.Join(dir, "missing", "acmenews.pem"), []byte("third"), true, []byte("second")},
+	}
+
+	for _, test := range tests {
+		err := writeFileAtomically(test.path, test.content)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%s: ReadFile: %v", test.name, err)
+		}
+
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got content %q, want %q", test.name, got, test.want)
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("%s: Stat: %v", test.name, err)
+		}
+
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("%s: got mode %s, want 0600", test.name, info.Mode())
+		}
+
+		// No temporary file must be left behind.
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("%s: ReadDir: %v", test.name, err)
+		}
+
+		if len(files) != 1 {
+			t.Errorf("%s: got %d files in the directory, want 1", test.name, len(files))
+		}
+	}
+}
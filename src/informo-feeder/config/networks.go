@@ -0,0 +1,179 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"informo-feeder/common"
+)
+
+// DefaultNetworkName is the name of the network profile feeds publish into if
+// they don't specify any. Unless it is overridden in the configuration file, it
+// refers to the main Informo network.
+const DefaultNetworkName = "informo"
+
+// Network represents a network profile as specified in the configuration file,
+// i.e. a room (on a given homeserver) to publish news into, along with the
+// prefix of the type of the news events.
+type Network struct {
+	// Homeserver is the URL of the homeserver to publish into this network
+	// through. If empty, the homeserver of the account publishing each feed
+	// is used.
+	Homeserver string `yaml:"homeserver,omitempty"`
+	// Account is the name of the Matrix account (from the "accounts" section)
+	// to publish every feed into this network with. It is required if
+	// Homeserver is set, and must be an account on that homeserver, since the
+	// feeds' own accounts can't authenticate on another homeserver.
+	Account string `yaml:"account,omitempty"`
+	// Room is either the ID or an alias of the room to publish news into.
+	Room string `yaml:"room"`
+	// EventTypePrefix is prepended to the identifier of a source to get the
+	// type of the news events for this source.
+	EventTypePrefix string `yaml:"event_type_prefix,omitempty"`
+	// RoomID is the ID of the room to publish news into, resolved from Room at
+	// startup if Room is an alias.
+	RoomID string `yaml:"-"`
+}
+
+// EventType returns the type of the news events for a given source on this
+// network.
+func (n *Network) EventType(identifier string) string {
+	return n.EventTypePrefix + identifier
+}
+
+// NetworkNames returns the names of the network profiles the feed publishes
+// into.
+func (f Feed) NetworkNames() []string {
+	if len(f.Networks) == 0 {
+		return []string{DefaultNetworkName}
+	}
+
+	return f.Networks
+}
+
+// loadNetworks fills the default values of the network profiles, adds the
+// default profile for the main Informo network if it hasn't been overridden,
+// and checks that every feed only references existing network profiles.
+// Returns an error if a network profile has no room, if it sets a homeserver
+// without an account on that homeserver, or if a feed references a network
+// profile that doesn't exist.
+func (c *Config) loadNetworks() error {
+	if c.Networks == nil {
+		c.Networks = make(map[string]*Network)
+	}
+
+	if _, ok := c.Networks[DefaultNetworkName]; !ok {
+		c.Networks[DefaultNetworkName] = &Network{
+			Room:            common.InformoRoomID,
+			EventTypePrefix: common.InformoNewsEventTypePrefix,
+		}
+	}
+
+	for name, network := range c.Networks {
+		if network == nil {
+			return fmt.Errorf("Network profile %s is empty", name)
+		}
+
+		if !strings.HasPrefix(network.Room, "!") && !strings.HasPrefix(network.Room, "#") {
+			return fmt.Errorf(
+				"Network profile %s must have a room ID or alias, got '%s'",
+				name, network.Room,
+			)
+		}
+
+		if err := c.checkNetworkAccount(name, network); err != nil {
+			return err
+		}
+
+		if len(network.EventTypePrefix) == 0 {
+			network.EventTypePrefix = common.InformoNewsEventTypePrefix
+		}
+
+		// If the room is a room ID, there's no need to resolve it.
+		if strings.HasPrefix(network.Room, "!") {
+			network.RoomID = network.Room
+		}
+	}
+
+	for _, feed := range c.Feeds {
+		for _, name := range feed.NetworkNames() {
+			if _, ok := c.Networks[name]; !ok {
+				return fmt.Errorf(
+					"Feed %s references unknown network profile %s",
+					feed.Identifier, name,
+				)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkNetworkAccount checks that a network profile which sets its own
+// homeserver also sets an account with credentials on that homeserver to
+// publish with.
+// Returns an error if the network profile sets a homeserver but no account,
+// if the account doesn't exist, has no credentials or is on another
+// homeserver, or if the feeder runs as an application service.
+func (c *Config) checkNetworkAccount(name string, network *Network) error {
+	if len(network.Homeserver) == 0 {
+		if len(network.Account) > 0 {
+			return fmt.Errorf(
+				"Network profile %s sets an account but no homeserver", name,
+			)
+		}
+
+		return nil
+	}
+
+	if c.AppService.Enabled {
+		return fmt.Errorf(
+			"Network profile %s can't set a homeserver when running as an application service",
+			name,
+		)
+	}
+
+	if len(network.Account) == 0 {
+		return fmt.Errorf(
+			"Network profile %s sets a homeserver, so it must also set an account on it",
+			name,
+		)
+	}
+
+	mxCfg, ok := c.Accounts[network.Account]
+	if !ok {
+		return fmt.Errorf(
+			"Network profile %s references unknown account %s", name, network.Account,
+		)
+	}
+
+	if mxCfg.Homeserver != network.Homeserver {
+		return fmt.Errorf(
+			"Account %s is on homeserver %s, not on the homeserver of network profile %s (%s)",
+			network.Account, mxCfg.Homeserver, name, network.Homeserver,
+		)
+	}
+
+	if len(mxCfg.AccessToken) == 0 && len(mxCfg.Password) == 0 {
+		return fmt.Errorf(
+			"%s (used by network profile %s)", ErrNoMatrixCredentials.Error(), name,
+		)
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+)
+
+const (
+	// SignatureFormatLegacy makes the feeder sign the news with a bare
+	// signature in their "signature" property.
+	SignatureFormatLegacy = "legacy"
+	// SignatureFormatMatrix makes the feeder sign the news the way Matrix
+	// signs JSON objects, in their "signatures" property.
+	SignatureFormatMatrix = "matrix"
+	// SignatureFormatBoth makes the feeder sign the news with both formats,
+	// so readers can switch to the Matrix format during a transition period.
+	SignatureFormatBoth = "both"
+
+	// SignatureVersionUnbound is the version of the signature scheme in which
+	// only the news' fields are signed.
+	SignatureVersionUnbound = 1
+	// SignatureVersionBound is the version of the signature scheme in which
+	// the signed content also includes the source's identifier, the event's
+	// type, the ID of the room it's sent into, the time it was signed at and a
+	// nonce, so that it can't be replayed under another source, event type or
+	// room, or be sent again without readers noticing.
+	SignatureVersionBound = 2
+	// SignatureVersionChained is the version of the signature scheme in which
+	// the signed content is bound as with the version 2, and also carries the
+	// event's position in the chain of the events published for the source
+	// into the room and the hash of the previous one. Events signed with an
+	// older version aren't chained.
+	SignatureVersionChained = 3
+)
+
+// SigningConfig represents the settings of the signatures of the news the
+// feeder publishes. Format is one of "legacy" (the default), "matrix" and
+// "both". Version is the version of the signature scheme, either 1, 2 or 3 (the
+// default).
+type SigningConfig struct {
+	Format  string `yaml:"format,omitempty"`
+	Version int    `yaml:"version,omitempty"`
+}
+
+// Legacy returns true if the news must carry a bare signature in their
+// "signature" property.
+func (s SigningConfig) Legacy() bool {
+	return s.Format == SignatureFormatLegacy || s.Format == SignatureFormatBoth
+}
+
+// Matrix returns true if the news must carry a signature in the Matrix format
+// in their "signatures" property.
+func (s SigningConfig) Matrix() bool {
+	return s.Format == SignatureFormatMatrix || s.Format == SignatureFormatBoth
+}
+
+// Chained returns true if the news must be chained to the previous ones
+// published for their source into each room, i.e. if the version of the
+// signature scheme is the chained one.
+func (s SigningConfig) Chained() bool {
+	return s.Version >= SignatureVersionChained
+}
+
+// loadSigning fills the default values of the signing settings.
+// Returns an error if the format or the version is unknown.
+func (c *Config) loadSigning() error {
+	switch c.Signing.Format {
+	case "":
+		c.Signing.Format = SignatureFormatLegacy
+	case SignatureFormatLegacy, SignatureFormatMatrix, SignatureFormatBoth:
+	default:
+		return fmt.Errorf(
+			"Unknown signature format '%s', must be one of %s, %s or %s",
+			c.Signing.Format, SignatureFormatLegacy, SignatureFormatMatrix,
+			SignatureFormatBoth,
+		)
+	}
+
+	switch c.Signing.Version {
+	case 0:
+		c.Signing.Version = SignatureVersionChained
+	case SignatureVersionUnbound, SignatureVersionBound, SignatureVersionChained:
+	default:
+		return fmt.Errorf(
+			"Unknown signature version %d, must be %d, %d or %d",
+			c.Signing.Version, SignatureVersionUnbound, SignatureVersionBound,
+			SignatureVersionChained,
+		)
+	}
+
+	return nil
+}
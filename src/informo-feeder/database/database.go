@@ -17,39 +17,265 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"net/url"
+	"sync"
+	"time"
 
-	// Database driver.
-	// TODO: Chose the driver from the configuration file.
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"github.com/sirupsen/logrus"
 )
 
 // Database contains a representation of the database as it is used by the feeder.
 type Database struct {
-	db     *sql.DB
-	poller pollerStatements
+	db        *sql.DB
+	poller    pollerStatements
+	outbox    outboxStatements
+	sessions  sessionsStatements
+	chains    sourceChainsStatements
+	published publishedItemsStatements
+	// memorySessions holds the sessions saved in dry-run mode, which are never
+	// written to the database, by homeserver and Matrix ID (see sessionKey).
+	// It's nil otherwise.
+	memorySessions map[string]StoredSession
+	sessionsMutex  sync.Mutex
 }
 
-// NewDatabase returns a new instance of the Database structure.
-func NewDatabase(dbPath string) (*Database, error) {
-	var db *sql.DB
-	var err error
-	if db, err = sql.Open("sqlite3", dbPath); err != nil {
+// ErrChainConflict is returned when saving events if the head of their chain
+// has moved since they were chained to it, i.e. if another feeder sharing the
+// database enqueued events for the same source and network profile meanwhile.
+var ErrChainConflict = errors.New("The head of the chain has been moved by another feeder, the events will be generated again at the next poll")
+
+// IsConflict returns whether the given error means that another feeder sharing
+// the database saved the same items or moved the same chains concurrently, i.e.
+// whether it's ErrChainConflict or the violation of a unique constraint. Since
+// nothing has been saved, the operation can be done again from scratch.
+func IsConflict(err error) bool {
+	if err == ErrChainConflict {
+		return true
+	}
+
+	switch e := err.(type) {
+	case sqlite3.Error:
+		return e.ExtendedCode == sqlite3.ErrConstraintUnique ||
+			e.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	case *pq.Error:
+		return e.Code.Name() == "unique_violation"
+	}
+
+	return false
+}
+
+const (
+	// OutcomePending is the outcome of an event waiting in the outbox, which
+	// no attempt to send failed yet.
+	OutcomePending = "pending"
+	// OutcomeRetrying is the outcome of an event waiting in the outbox after
+	// at least one failed attempt to send it.
+	OutcomeRetrying = "retrying"
+	// OutcomePublished is the outcome of an event published to Matrix.
+	OutcomePublished = "published"
+	// OutcomeFailed is the outcome of an event abandoned in the outbox after
+	// too many failed attempts to send it, until it's republished.
+	OutcomeFailed = "failed"
+)
+
+// EnqueuedItem represents an item retrieved from a feed, along with the events
+// generated from it, which are added to the outbox when the item is saved.
+type EnqueuedItem struct {
+	URL    string
+	Events []OutboxEvent
+}
+
+// PrunedItems represents the items of a feed removed from the database when
+// pruning it, and the number of items of the feed left in the database.
+type PrunedItems struct {
+	Feed string
+	URLs []string
+	Kept int
+}
+
+// OutboxEvent represents a prepared and signed event waiting in the outbox to
+// be published to Matrix. Sequence and Hash are the event's position in the
+// chain of the events published for its source into its network, and the hash
+// of its content, which become the head of the chain when the event is
+// enqueued. Headline, KeyID and Signature are the headline of the item the
+// event was generated from, and the ID of the key the event was signed with
+// along with its signature, which are recorded in the history. None of them
+// are stored in the outbox. ClaimedUntil is the time (in milliseconds) until
+// which the event is claimed by the publisher which retrieved it.
+type OutboxEvent struct {
+	ID           int64
+	Feed         string
+	ItemURL      string
+	Network      string
+	RoomID       string
+	EventType    string
+	TxnID        string
+	Content      string
+	Attempts     int
+	Sequence     int64
+	Hash         string
+	Headline     string
+	KeyID        string
+	Signature    string
+	ClaimedUntil int64
+}
+
+// StoredSession represents a session obtained by logging in with a Matrix
+// account: the device ID and access token the homeserver gave, and the hash of
+// the access token from the configuration file at that time, if any.
+type StoredSession struct {
+	DeviceID        string
+	AccessToken     string
+	ConfigTokenHash string
+}
+
+// PublishedItem represents an event of the history, i.e. an event generated
+// from a feed's item and added to the outbox, along with the outcome of its
+// publication. Times are timestamps in milliseconds, and PublishedAt is 0 if
+// the event isn't published yet.
+type PublishedItem struct {
+	ID          int64
+	Feed        string
+	ItemURL     string
+	Headline    string
+	Network     string
+	RoomID      string
+	EventType   string
+	TxnID       string
+	EventID     string
+	KeyID       string
+	Signature   string
+	ContentHash string
+	Sequence    int64
+	EnqueuedAt  int64
+	PublishedAt int64
+	Attempts    int
+	LastError   string
+	Outcome     string
+}
+
+// HistoryFilter restricts the events of the history to retrieve. Empty values
+// don't restrict anything. Since and Until are timestamps in milliseconds,
+// compared with the time the events were added to the outbox.
+type HistoryFilter struct {
+	Feeds   []string
+	Network string
+	ItemURL string
+	Outcome string
+	Since   int64
+	Until   int64
+	Limit   int
+}
+
+// RecoveredEvent represents an event published for a feed into a network
+// profile, recovered from the history of the network's room. Timestamp is the
+// time (in milliseconds) the event was sent at, and Sequence is 0 if the event
+// isn't part of a chain.
+type RecoveredEvent struct {
+	EventID   string
+	ItemURL   string
+	Headline  string
+	RoomID    string
+	EventType string
+	KeyID     string
+	Signature string
+	Hash      string
+	Sequence  int64
+	Timestamp int64
+}
+
+// RestoredEvents describes what was restored in the database from the events
+// published for a feed into a network profile: the number of items and of
+// events of the history which weren't in the database, and the head of the
+// feed's chain in the network profile if it was moved.
+type RestoredEvents struct {
+	Items    int
+	History  int
+	Sequence int64
+}
+
+// NewDatabase returns a new instance of the Database structure, connected to
+// the database described by the given driver (either "sqlite3" or "postgres")
+// and data source name. If migrateSchema is true, the database is created if
+// needed and its schema is upgraded to the latest version first. Otherwise,
+// the database is left untouched, and must already be at the latest version.
+// Returns an error if the driver isn't supported, if the database couldn't be
+// opened or migrated, or if migrateSchema is false and the database doesn't
+// exist or its schema is outdated.
+func NewDatabase(driver string, dsn string, migrateSchema bool) (*Database, error) {
+	if !migrateSchema {
+		db, _, err := openUpToDate(driver, dsn)
+		if err != nil {
+			return nil, err
+		}
+		return newDatabase(db)
+	}
+
+	db, d, err := open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := migrate(db, d)
+	if err != nil {
 		return nil, err
 	}
+	for _, m := range applied {
+		logrus.WithFields(logrus.Fields{
+			"version":     m.Version,
+			"description": m.Description,
+		}).Info("Applied database migration")
+	}
+
+	return newDatabase(db)
+}
+
+// newDatabase prepares the statements on the given database, which schema is
+// at the latest version, and returns a new instance of the Database structure
+// using them.
+// Returns an error if a statement couldn't be prepared.
+func newDatabase(db *sql.DB) (*Database, error) {
+	var err error
 	poller := pollerStatements{}
 	if err = poller.prepare(db); err != nil {
 		return nil, err
 	}
+	outbox := outboxStatements{}
+	if err = outbox.prepare(db); err != nil {
+		return nil, err
+	}
+	sessions := sessionsStatements{}
+	if err = sessions.prepare(db); err != nil {
+		return nil, err
+	}
+	chains := sourceChainsStatements{}
+	if err = chains.prepare(db); err != nil {
+		return nil, err
+	}
+	published := publishedItemsStatements{}
+	if err = published.prepare(db); err != nil {
+		return nil, err
+	}
 
-	return &Database{db, poller}, nil
+	return &Database{
+		db:        db,
+		poller:    poller,
+		outbox:    outbox,
+		sessions:  sessions,
+		chains:    chains,
+		published: published,
+	}, nil
 }
 
-// GetItemsURLsForFeed returns a slice containing the URL of each item retrieved
-// the last time the poller polled a given feed.
+// GetKnownItems returns the URLs, among the given ones, of the items which have
+// already been retrieved from a given feed.
 // Returns an error if the retrieval went wrong.
-func (d *Database) GetItemsURLsForFeed(feedIdentifier string) (map[string]bool, error) {
-	return d.poller.selectItemsURLsForFeed(feedIdentifier)
+func (d *Database) GetKnownItems(
+	feedIdentifier string, itemURLs []string,
+) (map[string]bool, error) {
+	return d.poller.selectKnownItems(feedIdentifier, itemURLs)
 }
 
 // SaveItem saves the URL of an item in the database, associated with the feed
@@ -61,7 +287,273 @@ func (d *Database) SaveItem(feedIdentifier string, itemURL string) error {
 		return err
 	}
 
-	return d.poller.insertItemForFeed(feedIdentifier, itemURL)
+	now := nowMs()
+	return d.poller.insertItemForFeed(nil, feedIdentifier, itemURL, now, now)
+}
+
+// SavePoll saves the results of a poll of a feed: it records that the known
+// items given by their URLs were seen in the feed again, saves the URL of each
+// of the given new items in the database, associated with the feed they were
+// retrieved from, adds the events generated from them to the outbox and to the
+// history, and moves the head of the chain of each event's network to the
+// event, all in a single transaction. This way, an item is either both saved
+// and queued for publication, or neither, and the chains only contain queued
+// events.
+// Returns ErrChainConflict if the head of a chain has moved since the events
+// were chained to it, or an error if an URL is invalid or if the transaction
+// went wrong.
+func (d *Database) SavePoll(
+	feedIdentifier string, knownItemURLs []string, items []EnqueuedItem,
+) error {
+	// Check if the provided URLs are valid.
+	for _, item := range items {
+		if _, err := url.Parse(item.URL); err != nil {
+			return err
+		}
+	}
+
+	// All the items of the poll are seen at the same time, so the ones of the
+	// latest poll can be told apart when pruning.
+	seen := nowMs()
+
+	return d.withTransaction(func(txn *sql.Tx) error {
+		if err := d.poller.updateItemsLastSeen(
+			txn, feedIdentifier, knownItemURLs, seen,
+		); err != nil {
+			return err
+		}
+
+		for _, item := range items {
+			if err := d.enqueueItem(txn, feedIdentifier, item, seen); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// enqueueItem saves an item seen at the given time, adds its events to the
+// outbox and moves the head of their chains to them (if they're chained) as
+// part of the given transaction.
+// Returns an error if an insertion went wrong.
+func (d *Database) enqueueItem(
+	txn *sql.Tx, feedIdentifier string, item EnqueuedItem, seen int64,
+) error {
+	if err := d.poller.insertItemForFeed(
+		txn, feedIdentifier, item.URL, seen, seen,
+	); err != nil {
+		return err
+	}
+
+	for _, e := range item.Events {
+		e.Feed = feedIdentifier
+		e.ItemURL = item.URL
+		if err := d.outbox.insertEvent(txn, e); err != nil {
+			return err
+		}
+
+		if err := d.published.insertPublishedItem(txn, e, seen); err != nil {
+			return err
+		}
+
+		// Events which aren't chained don't move the head of the chain.
+		if e.Sequence == 0 {
+			continue
+		}
+
+		if err := d.chains.advanceChain(
+			txn, feedIdentifier, e.Network, e.Sequence-1, e.Sequence, e.Hash,
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetChainHead returns the sequence number and the hash of the last event
+// enqueued for publication for a given feed into a given network profile. Both
+// are zero values if no event has been enqueued yet.
+// Returns an error if the retrieval went wrong.
+func (d *Database) GetChainHead(
+	feedIdentifier string, network string,
+) (sequence int64, hash string, err error) {
+	return d.chains.selectChain(nil, feedIdentifier, network)
+}
+
+// ClaimPendingEvents claims, until the given time, at most limit events from
+// the outbox which are due for a new publication attempt at the given time
+// (both in milliseconds) and aren't claimed by another publisher, and returns
+// them in the order they were enqueued. The events enqueued for a feed into a
+// network profile after an event which isn't due yet or is claimed by another
+// publisher are held back, so they're not published before it. A claim ends
+// when the event is marked as sent or failed, when it's released, or when it
+// expires, so the feeders sharing the database never send the same event at
+// the same time.
+// Returns an error if the retrieval or a claim went wrong.
+func (d *Database) ClaimPendingEvents(
+	now int64, limit int, until int64,
+) ([]OutboxEvent, error) {
+	events, err := d.outbox.selectPendingEvents(now, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.claimEvents(events, now, until)
+}
+
+// ClaimPendingEventsForFeed does the same as ClaimPendingEvents, but only with
+// the events generated from the given feed.
+// Returns an error if the retrieval or a claim went wrong.
+func (d *Database) ClaimPendingEventsForFeed(
+	feedIdentifier string, now int64, limit int, until int64,
+) ([]OutboxEvent, error) {
+	events, err := d.outbox.selectPendingFeedEvents(now, feedIdentifier, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.claimEvents(events, now, until)
+}
+
+// claimEvents claims the given events retrieved from the outbox at the given
+// time until the other given time, and returns the ones it could claim.
+// Returns an error if a claim went wrong.
+func (d *Database) claimEvents(
+	events []OutboxEvent, now int64, until int64,
+) (claimed []OutboxEvent, err error) {
+	// Once an event of a chain has been claimed by another publisher since it
+	// was retrieved, the next events of the chain must be left to it.
+	lost := make(map[string]bool)
+	for _, e := range events {
+		chain := e.Feed + " " + e.Network
+		if lost[chain] {
+			continue
+		}
+
+		var ok bool
+		if ok, err = d.outbox.claimEvent(e.ID, now, until); err != nil {
+			return
+		}
+
+		if !ok {
+			lost[chain] = true
+			continue
+		}
+
+		e.ClaimedUntil = until
+		claimed = append(claimed, e)
+	}
+
+	return
+}
+
+// ReleaseEvent ends the claim on an event from the outbox without attempting
+// to publish it, so it can be retrieved again right away. Does nothing if the
+// claim has expired and the event has been claimed again since.
+// Returns an error if the update went wrong.
+func (d *Database) ReleaseEvent(e OutboxEvent) error {
+	return d.outbox.releaseEvent(e.ID, e.ClaimedUntil)
+}
+
+// CountOutboxEventsForFeed returns the number of events generated from the given
+// feed in the outbox which can still be published, including the ones which
+// aren't due for a new attempt yet, and the number of its abandoned events
+// along with the events held back by them.
+// Returns an error if the retrieval went wrong.
+func (d *Database) CountOutboxEventsForFeed(
+	feedIdentifier string,
+) (pending int, abandoned int, err error) {
+	if pending, err = d.outbox.countFeedEvents(feedIdentifier); err != nil {
+		return
+	}
+
+	abandoned, err = d.outbox.countFeedAbandonedEvents(feedIdentifier)
+	return
+}
+
+// MarkEventSent removes an event from the outbox once it has been published,
+// and records its ID and the time it was published in the history, in a single
+// transaction.
+// Returns an error if the transaction went wrong.
+func (d *Database) MarkEventSent(e OutboxEvent, eventID string) error {
+	return d.withTransaction(func(txn *sql.Tx) error {
+		if err := d.outbox.deleteEvent(txn, e.ID); err != nil {
+			return err
+		}
+
+		return d.published.updatePublishedItemSent(txn, e.TxnID, eventID, nowMs())
+	})
+}
+
+// MarkEventFailed records a failed attempt to publish an event from the outbox,
+// along with the time (in milliseconds) of the next attempt, both in the outbox
+// and in the history, and ends the claim on the event.
+// Returns an error if the transaction went wrong.
+func (d *Database) MarkEventFailed(
+	e OutboxEvent, attempts int, nextAttempt int64, lastError string,
+) error {
+	return d.withTransaction(func(txn *sql.Tx) error {
+		if err := d.outbox.updateEventAttempt(
+			txn, e.ID, attempts, nextAttempt, lastError,
+		); err != nil {
+			return err
+		}
+
+		return d.published.updatePublishedItemAttempt(
+			txn, e.TxnID, attempts, lastError, OutcomeRetrying,
+		)
+	})
+}
+
+// MarkEventAbandoned gives up on an event from the outbox after the given
+// number of failed attempts to publish it, the last one with the given error,
+// and records it in the history with the "failed" outcome. The event is kept
+// in the outbox, and holds back the next events of its chain, until it's
+// republished, so the chain never has a gap.
+// Returns an error if the transaction went wrong.
+func (d *Database) MarkEventAbandoned(
+	e OutboxEvent, attempts int, lastError string,
+) error {
+	return d.withTransaction(func(txn *sql.Tx) error {
+		if err := d.outbox.abandonEvent(
+			txn, e.ID, attempts, lastError, nowMs(),
+		); err != nil {
+			return err
+		}
+
+		return d.published.updatePublishedItemAttempt(
+			txn, e.TxnID, attempts, lastError, OutcomeFailed,
+		)
+	})
+}
+
+// RepublishEvents makes the publisher try again to publish the abandoned events
+// generated from the given feed, as if they had never been tried, and records
+// them in the history with the "retrying" outcome.
+// Returns the number of republished events, or an error if the transaction went
+// wrong.
+func (d *Database) RepublishEvents(feedIdentifier string) (count int64, err error) {
+	err = d.withTransaction(func(txn *sql.Tx) error {
+		// The history must be updated first, since it looks up the abandoned
+		// events in the outbox.
+		if err := d.published.updateAbandonedItems(txn, feedIdentifier); err != nil {
+			return err
+		}
+
+		count, err = d.outbox.republishFeedEvents(txn, feedIdentifier)
+		return err
+	})
+
+	return
+}
+
+// GetHistory returns the events of the history matching the given filter, the
+// most recent first.
+// Returns an error if the retrieval went wrong.
+func (d *Database) GetHistory(filter HistoryFilter) ([]PublishedItem, error) {
+	return d.published.selectPublishedItems(filter)
 }
 
 // ClearItemsForFeed removes all items from the database associated with a given
@@ -70,3 +562,222 @@ func (d *Database) SaveItem(feedIdentifier string, itemURL string) error {
 func (d *Database) ClearItemsForFeed(feedIdentifier string) error {
 	return d.poller.deleteItemsForFeed(feedIdentifier)
 }
+
+// PruneItems removes from the database the items which haven't been seen in
+// their feed for longer than the given retention period, except the ones seen
+// during the latest poll of their feed, so an item still in its feed is never
+// considered new again. In dry-run mode, only returns the items which would be
+// removed.
+// Returns the removed items of each feed, or an error if the transaction went
+// wrong.
+func (d *Database) PruneItems(
+	retention time.Duration, dryRun bool,
+) (pruned []PrunedItems, err error) {
+	before := nowMs() - int64(retention/time.Millisecond)
+
+	err = d.withTransaction(func(txn *sql.Tx) error {
+		feeds, err := d.poller.selectItemsFeeds(txn)
+		if err != nil {
+			return err
+		}
+
+		for _, feed := range feeds {
+			p := PrunedItems{Feed: feed}
+			if p.URLs, err = d.poller.selectPrunableItems(txn, feed, before); err != nil {
+				return err
+			}
+
+			if !dryRun && len(p.URLs) > 0 {
+				if err = d.poller.deletePrunableItems(txn, feed, before); err != nil {
+					return err
+				}
+			}
+
+			if p.Kept, err = d.poller.countItemsForFeed(txn, feed); err != nil {
+				return err
+			}
+
+			if dryRun {
+				p.Kept -= len(p.URLs)
+			}
+
+			pruned = append(pruned, p)
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// RestoreEvents saves the items the given events, recovered from the history of
+// a network profile's room, were generated from, adds the events to the
+// history, and moves the head of the feed's chain in the network profile to the
+// last of the events if it's further than the current one, all in a single
+// transaction. Items and events which are already in the database are left
+// untouched. The restored items are considered as last seen now, so they're
+// only pruned once they've left their feed. In dry-run mode, the transaction is
+// rolled back, so only the outcome is returned.
+// Returns what was restored, or an error if the transaction went wrong.
+func (d *Database) RestoreEvents(
+	feedIdentifier string, network string, events []RecoveredEvent,
+	dryRun bool,
+) (restored RestoredEvents, err error) {
+	txn, err := d.db.Begin()
+	if err != nil {
+		return
+	}
+
+	restored, err = d.restoreEvents(txn, feedIdentifier, network, events)
+	if err != nil || dryRun {
+		txn.Rollback()
+		return
+	}
+
+	err = txn.Commit()
+	return
+}
+
+// restoreEvents restores the given recovered events as part of the given
+// transaction (see RestoreEvents).
+// Returns what was restored, or an error if a retrieval or an insertion went
+// wrong.
+func (d *Database) restoreEvents(
+	txn *sql.Tx, feedIdentifier string, network string, events []RecoveredEvent,
+) (restored RestoredEvents, err error) {
+	now := nowMs()
+
+	stored, _, err := d.chains.selectChain(txn, feedIdentifier, network)
+	if err != nil {
+		return
+	}
+
+	sequence := stored
+	var head *RecoveredEvent
+	for i, e := range events {
+		var count int
+		if len(e.ItemURL) > 0 {
+			if count, err = d.poller.countItem(txn, feedIdentifier, e.ItemURL); err != nil {
+				return
+			}
+
+			if count == 0 {
+				if err = d.poller.insertItemForFeed(
+					txn, feedIdentifier, e.ItemURL, e.Timestamp, now,
+				); err != nil {
+					return
+				}
+
+				restored.Items++
+			}
+		}
+
+		if count, err = d.published.countEvent(txn, e.EventID); err != nil {
+			return
+		}
+
+		if count == 0 {
+			if err = d.published.insertRecoveredItem(
+				txn, feedIdentifier, network, e,
+			); err != nil {
+				return
+			}
+
+			restored.History++
+		}
+
+		if e.Sequence > sequence {
+			sequence = e.Sequence
+			head = &events[i]
+		}
+	}
+
+	if head == nil {
+		return
+	}
+
+	if err = d.chains.advanceChain(
+		txn, feedIdentifier, network, stored, head.Sequence, head.Hash,
+	); err != nil {
+		return
+	}
+
+	restored.Sequence = head.Sequence
+	return
+}
+
+// GetSession returns the session stored for a given Matrix account on a given
+// homeserver. Its fields are empty strings if no session has been stored for
+// this account.
+// Returns an error if the retrieval went wrong.
+func (d *Database) GetSession(
+	homeserver string, mxid string,
+) (StoredSession, error) {
+	if d.memorySessions != nil {
+		d.sessionsMutex.Lock()
+		session, ok := d.memorySessions[sessionKey(homeserver, mxid)]
+		d.sessionsMutex.Unlock()
+		if ok {
+			return session, nil
+		}
+	}
+
+	return d.sessions.selectSession(homeserver, mxid)
+}
+
+// SaveSession stores the session obtained by logging in with a given Matrix
+// account on a given homeserver, replacing any previously stored session for
+// this account. In dry-run mode, the session is only kept in memory.
+// Returns an error if the insertion went wrong.
+func (d *Database) SaveSession(
+	homeserver string, mxid string, session StoredSession,
+) error {
+	if d.memorySessions != nil {
+		d.sessionsMutex.Lock()
+		d.memorySessions[sessionKey(homeserver, mxid)] = session
+		d.sessionsMutex.Unlock()
+		return nil
+	}
+
+	return d.withTransaction(func(txn *sql.Tx) error {
+		if err := d.sessions.deleteSession(txn, homeserver, mxid); err != nil {
+			return err
+		}
+
+		return d.sessions.insertSession(txn, homeserver, mxid, session)
+	})
+}
+
+// sessionKey returns the key identifying the session of the given Matrix
+// account on the given homeserver in memory.
+func sessionKey(homeserver string, mxid string) string {
+	return homeserver + " " + mxid
+}
+
+// withTransaction runs the given function inside a transaction, which is
+// committed if the function returns with no error and rolled back otherwise.
+// Returns an error if the transaction couldn't be started or committed, or the
+// error returned by the function.
+func (d *Database) withTransaction(fn func(txn *sql.Tx) error) (err error) {
+	txn, err := d.db.Begin()
+	if err != nil {
+		return
+	}
+
+	if err = fn(txn); err != nil {
+		txn.Rollback()
+		return
+	}
+
+	return txn.Commit()
+}
+
+// txStmt returns the given statement bound to the given transaction, or the
+// statement itself if the transaction is nil.
+func txStmt(txn *sql.Tx, stmt *sql.Stmt) *sql.Stmt {
+	if txn != nil {
+		return txn.Stmt(stmt)
+	}
+
+	return stmt
+}
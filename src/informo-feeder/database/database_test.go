@@ -0,0 +1,239 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"fmt"
+	"testing"
+)
+
+// newTestDatabase returns a database migrated to the latest version, stored in
+// memory.
+func newTestDatabase(t *testing.T) *Database {
+	db, err := NewDatabase("sqlite3", ":memory:", true)
+	if err != nil {
+		t.Fatalf("NewDatabase: %v", err)
+	}
+
+	return db
+}
+
+// testItem returns an item with one event per given network, at the given
+// position of the network's chain.
+func testItem(url string, sequence int64, networks ...string) EnqueuedItem {
+	item := EnqueuedItem{URL: url}
+	for _, network := range networks {
+		item.Events = append(item.Events, OutboxEvent{
+			Network:   network,
+			RoomID:    "!" + network + ":example.org",
+			EventType: "network.informo.news.test",
+			TxnID:     fmt.Sprintf("%s %s", url, network),
+			Content:   "{}",
+			Sequence:  sequence,
+			Hash:      fmt.Sprintf("hash %s %d", network, sequence),
+		})
+	}
+
+	return item
+}
+
+func TestSavePollAdvancesChain(t *testing.T) {
+	tests := []struct {
+		name     string
+		item     EnqueuedItem
+		wantErr  error
+		wantHead int64
+	}{
+		{"first event", testItem("https://example.org/1", 1, "informo"), nil, 1},
+		{"next event", testItem("https://example.org/2", 2, "informo"), nil, 2},
+		{"stale head", testItem("https://example.org/3", 2, "informo"), ErrChainConflict, 2},
+		{"fork from the start", testItem("https://example.org/4", 1, "informo"), ErrChainConflict, 2},
+		{"gap", testItem("https://example.org/5", 4, "informo"), ErrChainConflict, 2},
+		{"unchained event", testItem("https://example.org/6", 0, "informo"), nil, 2},
+	}
+
+	db := newTestDatabase(t)
+	for _, test := range tests {
+		err := db.SavePoll("test", nil, []EnqueuedItem{test.item})
+		if err != test.wantErr {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.wantErr)
+		}
+
+		known, err := db.GetKnownItems("test", []string{test.item.URL})
+		if err != nil {
+			t.Fatalf("GetKnownItems: %v", err)
+		}
+
+		// The item must only be saved along with its events.
+		if known[test.item.URL] != (test.wantErr == nil) {
+			t.Errorf("%s: item saved: %t", test.name, known[test.item.URL])
+		}
+
+		head, _, err := db.GetChainHead("test", "informo")
+		if err != nil {
+			t.Fatalf("GetChainHead: %v", err)
+		}
+
+		if head != test.wantHead {
+			t.Errorf("%s: got head %d, want %d", test.name, head, test.wantHead)
+		}
+	}
+}
+
+func TestClaimPendingEvents(t *testing.T) {
+	db := newTestDatabase(t)
+	if err := db.SavePoll("test", nil, []EnqueuedItem{
+		testItem("https://example.org/1", 1, "informo", "staging"),
+		testItem("https://example.org/2", 2, "informo", "staging"),
+	}); err != nil {
+		t.Fatalf("SavePoll: %v", err)
+	}
+
+	claimed, err := db.ClaimPendingEvents(1000, 10, 2000)
+	if err != nil {
+		t.Fatalf("ClaimPendingEvents: %v", err)
+	}
+
+	if len(claimed) != 4 {
+		t.Fatalf("got %d claimed events, want 4", len(claimed))
+	}
+
+	// Another publisher mustn't get any event while the claims are valid.
+	if again, err := db.ClaimPendingEvents(1500, 10, 2500); err != nil || len(again) > 0 {
+		t.Fatalf("got %d claimed events (error: %v), want none", len(again), err)
+	}
+
+	// Releasing the first event of a chain only makes it available: the next
+	// one is still claimed.
+	if err = db.ReleaseEvent(claimed[0]); err != nil {
+		t.Fatalf("ReleaseEvent: %v", err)
+	}
+
+	again, err := db.ClaimPendingEvents(1500, 10, 2500)
+	if err != nil {
+		t.Fatalf("ClaimPendingEvents: %v", err)
+	}
+
+	if len(again) != 1 || again[0].ID != claimed[0].ID {
+		t.Fatalf("got %v, want only event %d", again, claimed[0].ID)
+	}
+
+	// A failed event holds back the rest of its chain until its next attempt,
+	// even once the claims have expired, while the other chain goes on.
+	if err = db.MarkEventFailed(again[0], 1, 5000, "failed"); err != nil {
+		t.Fatalf("MarkEventFailed: %v", err)
+	}
+
+	tests := []struct {
+		now  int64
+		want []int64
+	}{
+		{3000, []int64{claimed[1].ID, claimed[3].ID}},
+		{3500, nil},
+		{5000, []int64{claimed[0].ID, claimed[1].ID, claimed[2].ID, claimed[3].ID}},
+	}
+
+	for _, test := range tests {
+		got, err := db.ClaimPendingEvents(test.now, 10, test.now+1000)
+		if err != nil {
+			t.Fatalf("ClaimPendingEvents: %v", err)
+		}
+
+		var ids []int64
+		for _, e := range got {
+			ids = append(ids, e.ID)
+		}
+
+		if fmt.Sprint(ids) != fmt.Sprint(test.want) {
+			t.Errorf("at %d: got events %v, want %v", test.now, ids, test.want)
+		}
+	}
+}
+
+func TestAbandonedEvents(t *testing.T) {
+	db := newTestDatabase(t)
+	if err := db.SavePoll("test", nil, []EnqueuedItem{
+		testItem("https://example.org/1", 1, "informo", "staging"),
+		testItem("https://example.org/2", 2, "informo", "staging"),
+	}); err != nil {
+		t.Fatalf("SavePoll: %v", err)
+	}
+
+	claimed, err := db.ClaimPendingEvents(1000, 1, 2000)
+	if err != nil || len(claimed) != 1 {
+		t.Fatalf("ClaimPendingEvents: got %d events (error: %v), want 1", len(claimed), err)
+	}
+
+	if err = db.MarkEventAbandoned(claimed[0], 30, "failed"); err != nil {
+		t.Fatalf("MarkEventAbandoned: %v", err)
+	}
+
+	// The abandoned event stays in the outbox and holds back the rest of its
+	// chain, while the other chain goes on.
+	checkCounts := func(step string, wantPending int, wantAbandoned int, wantFailed int) {
+		pending, abandoned, err := db.CountOutboxEventsForFeed("test")
+		if err != nil {
+			t.Fatalf("%s: CountOutboxEventsForFeed: %v", step, err)
+		}
+
+		if pending != wantPending || abandoned != wantAbandoned {
+			t.Errorf(
+				"%s: got %d pending and %d abandoned events, want %d and %d",
+				step, pending, abandoned, wantPending, wantAbandoned,
+			)
+		}
+
+		failed, err := db.GetHistory(HistoryFilter{Outcome: OutcomeFailed})
+		if err != nil {
+			t.Fatalf("%s: GetHistory: %v", step, err)
+		}
+
+		if len(failed) != wantFailed {
+			t.Errorf("%s: got %d failed events in the history, want %d", step, len(failed), wantFailed)
+		}
+	}
+
+	checkCounts("abandoned", 2, 2, 1)
+
+	again, err := db.ClaimPendingEvents(3000, 10, 4000)
+	if err != nil {
+		t.Fatalf("ClaimPendingEvents: %v", err)
+	}
+
+	for _, e := range again {
+		if e.Network == claimed[0].Network {
+			t.Errorf("got event %d held back by the abandoned event", e.ID)
+		}
+	}
+
+	// Republishing the feed's events makes the chain go on from the abandoned
+	// event, as if it had never been tried.
+	count, err := db.RepublishEvents("test")
+	if err != nil || count != 1 {
+		t.Fatalf("RepublishEvents: got %d events (error: %v), want 1", count, err)
+	}
+
+	checkCounts("republished", 4, 0, 0)
+
+	again, err = db.ClaimPendingEvents(5000, 1, 6000)
+	if err != nil {
+		t.Fatalf("ClaimPendingEvents: %v", err)
+	}
+
+	if len(again) != 1 || again[0].ID != claimed[0].ID || again[0].Attempts != 0 {
+		t.Errorf("got %+v, want event %d without any failed attempt", again, claimed[0].ID)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// dialect describes the SQL syntax specific to a database driver.
+type dialect struct {
+	// serialPrimaryKey is the definition of an auto-incremented integer
+	// primary key column.
+	serialPrimaryKey string
+	// tableExistsSQL is the query counting the tables with a given name.
+	tableExistsSQL string
+	// lockSchemaVersionSQL is the statement preventing other connections from
+	// migrating the database until the end of the current transaction, if the
+	// database needs one.
+	lockSchemaVersionSQL string
+	// maxOpenConns is the maximum number of connections to open to the
+	// database, 0 meaning no limit.
+	maxOpenConns int
+	// exists returns whether the database described by a data source name
+	// exists, for the drivers which create the database when opening it. If
+	// nil, the database is assumed to exist.
+	exists func(dsn string) (bool, error)
+}
+
+// dialects maps each supported driver to its dialect.
+var dialects = map[string]dialect{
+	"sqlite3": {
+		serialPrimaryKey: "INTEGER PRIMARY KEY AUTOINCREMENT",
+		tableExistsSQL:   "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = $1",
+		// SQLite doesn't handle concurrent writes, and both the pollers and
+		// the publisher write to the database.
+		maxOpenConns: 1,
+		exists:       sqliteFileExists,
+	},
+	"postgres": {
+		serialPrimaryKey:     "BIGSERIAL PRIMARY KEY",
+		tableExistsSQL:       "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = $1",
+		lockSchemaVersionSQL: "LOCK TABLE schema_version IN EXCLUSIVE MODE",
+	},
+}
+
+// dialectForDriver returns the dialect of the given driver.
+// Returns an error if the driver isn't supported.
+func dialectForDriver(driver string) (d dialect, err error) {
+	d, ok := dialects[driver]
+	if !ok {
+		err = fmt.Errorf("Unsupported database driver %s", driver)
+	}
+
+	return
+}
+
+// sqliteFileExists returns whether the file of the SQLite database described by
+// the given data source name (either a path or a "file:" URI) exists. An
+// in-memory database never exists before it's opened.
+// Returns an error if the file's existence couldn't be checked.
+func sqliteFileExists(dsn string) (bool, error) {
+	path := strings.TrimPrefix(dsn, "file:")
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+
+	if len(path) == 0 || path == ":memory:" {
+		return false, nil
+	}
+
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
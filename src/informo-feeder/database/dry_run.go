@@ -0,0 +1,229 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// selectSQLiteTablesSQL lists the tables of a SQLite database, except its
+// internal ones.
+const selectSQLiteTablesSQL = `
+	SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'
+	ORDER BY name
+`
+
+// NewDryRunDatabase returns a new instance of the Database structure for the
+// dry runs, which never changes nor creates the database described by the
+// given driver and data source name. The sessions obtained by logging in are
+// only kept in memory. If the database's schema is at the latest version, the
+// database is used as is. Otherwise, its content is copied into an in-memory
+// SQLite database, which schema is then upgraded to the latest version: a
+// database which doesn't exist is considered empty, and the pending migrations
+// are only applied to the copy.
+// Returns an error if the driver isn't supported, if the database couldn't be
+// opened or copied, or if its schema is newer than the latest known version.
+func NewDryRunDatabase(driver string, dsn string) (d *Database, err error) {
+	version, pending, err := PendingMigrations(driver, dsn)
+	if err != nil {
+		return
+	}
+
+	var db *sql.DB
+	if len(pending) == 0 {
+		if db, _, err = open(driver, dsn); err != nil {
+			return
+		}
+	} else if db, err = openInMemory(driver, dsn, version); err != nil {
+		return
+	}
+
+	if d, err = newDatabase(db); err != nil {
+		return
+	}
+
+	d.memorySessions = make(map[string]StoredSession)
+	return
+}
+
+// openInMemory opens an in-memory SQLite database, copies into it the content
+// of the database described by the given driver and data source name, which
+// schema is at the given version, if it exists, and upgrades its schema to the
+// latest version.
+// Returns an error if the database couldn't be copied or migrated.
+func openInMemory(driver string, dsn string, version int) (*sql.DB, error) {
+	memory, d, err := open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+
+	exists := true
+	if source, _ := dialectForDriver(driver); source.exists != nil {
+		if exists, err = source.exists(dsn); err != nil {
+			return nil, err
+		}
+	}
+
+	// A database which schema isn't versioned yet has the tables created by
+	// the first migration, or some of them.
+	copied := version
+	if exists && copied == 0 {
+		copied = 1
+	}
+
+	if err = applyMigrations(memory, d, 0, copied); err != nil {
+		return nil, err
+	}
+
+	if exists {
+		if err = copyDatabase(driver, dsn, memory); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = applyMigrations(memory, d, copied, len(migrations)); err != nil {
+		return nil, err
+	}
+
+	return memory, nil
+}
+
+// applyMigrations runs the statements of the migrations from the given version
+// (excluded) to the other given version (included) on the given database,
+// without recording them in the schema_version table.
+// Returns an error if a statement failed.
+func applyMigrations(db *sql.DB, d dialect, from int, to int) error {
+	for i := from; i < to; i++ {
+		for _, statement := range migrations[i].up(d) {
+			if _, err := db.Exec(statement); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// copyDatabase copies the rows of each table of the given SQLite database from
+// the database described by the given driver and data source name, which
+// schema must be at the same version, if the table exists in it.
+// Returns an error if the database couldn't be opened or a table couldn't be
+// copied.
+func copyDatabase(driver string, dsn string, memory *sql.DB) error {
+	source, d, err := open(driver, dsn)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	rows, err := memory.Query(selectSQLiteTablesSQL)
+	if err != nil {
+		return err
+	}
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err = rows.Scan(&table); err != nil {
+			rows.Close()
+			return err
+		}
+
+		tables = append(tables, table)
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	txn, err := memory.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		var count int
+		if err = source.QueryRow(d.tableExistsSQL, table).Scan(&count); err != nil {
+			txn.Rollback()
+			return err
+		}
+
+		if count == 0 {
+			continue
+		}
+
+		if err = copyTable(source, txn, table); err != nil {
+			txn.Rollback()
+			return err
+		}
+	}
+
+	return txn.Commit()
+}
+
+// copyTable copies the rows of the given table from the given database into the
+// same table in the given transaction.
+// Returns an error if the rows couldn't be retrieved or inserted.
+func copyTable(source *sql.DB, txn *sql.Tx, table string) error {
+	rows, err := source.Query("SELECT * FROM " + table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	insert, err := txn.Prepare(fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(columns, ", "),
+		placeholders(len(columns), 1),
+	))
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	for rows.Next() {
+		if err = rows.Scan(pointers...); err != nil {
+			return err
+		}
+
+		// Some drivers return the text columns as bytes, which SQLite would
+		// store as blobs.
+		for i, value := range values {
+			if b, ok := value.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+
+		if _, err = insert.Exec(values...); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,150 @@
+// Copyright 2017 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// createTestDatabase creates a SQLite database at the given path, which schema
+// is at the given version, with an item of the acmenews feed. A schema at
+// version 0 isn't versioned.
+func createTestDatabase(t *testing.T, path string, version int) {
+	db, d, err := open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer db.Close()
+
+	if err = applyMigrations(db, d, 0, version); err != nil {
+		t.Fatalf("applyMigrations: %v", err)
+	}
+
+	if version == 0 {
+		if err = applyMigrations(db, d, 0, 1); err != nil {
+			t.Fatalf("applyMigrations: %v", err)
+		}
+	} else {
+		if _, err = db.Exec(schemaVersionSchema); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+
+		if _, err = db.Exec(
+			insertSchemaVersionSQL, version, "test", nowMs(),
+		); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+	}
+
+	if _, err = db.Exec(
+		`INSERT INTO poller_items (feed, item_url) VALUES ('acmenews', 'https://example.org/1')`,
+	); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+}
+
+func TestNewDryRunDatabase(t *testing.T) {
+	tests := []struct {
+		name      string
+		version   int
+		exists    bool
+		wantKnown bool
+	}{
+		{"missing", 0, false, false},
+		{"unversioned", 0, true, true},
+		{"outdated", 1, true, true},
+		{"up to date", LatestSchemaVersion(), true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "informo-feeder")
+			if err != nil {
+				t.Fatalf("TempDir: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "feeder.db")
+			if tt.exists {
+				createTestDatabase(t, path, tt.version)
+			}
+
+			db, err := NewDryRunDatabase("sqlite3", path)
+			if err != nil {
+				t.Fatalf("NewDryRunDatabase: %v", err)
+			}
+
+			known, err := db.GetKnownItems(
+				"acmenews", []string{"https://example.org/1"},
+			)
+			if err != nil {
+				t.Fatalf("GetKnownItems: %v", err)
+			}
+
+			if known["https://example.org/1"] != tt.wantKnown {
+				t.Errorf("item known: %t, want %t", !tt.wantKnown, tt.wantKnown)
+			}
+
+			session := StoredSession{DeviceID: "DEVICE", AccessToken: "token"}
+			if err = db.SaveSession("https://example.org", "@feeder:example.org", session); err != nil {
+				t.Fatalf("SaveSession: %v", err)
+			}
+
+			stored, err := db.GetSession("https://example.org", "@feeder:example.org")
+			if err != nil || stored != session {
+				t.Errorf("GetSession: %+v (error: %v), want %+v", stored, err, session)
+			}
+
+			if !tt.exists {
+				if _, err = os.Stat(path); !os.IsNotExist(err) {
+					t.Fatalf("the database has been created (error: %v)", err)
+				}
+				return
+			}
+
+			// The database is left untouched.
+			version, _, err := PendingMigrations("sqlite3", path)
+			if err != nil || version != tt.version {
+				t.Errorf("version %d (error: %v), want %d", version, err, tt.version)
+			}
+
+			source, _, err := open("sqlite3", path)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			defer source.Close()
+
+			for table, want := range map[string]int{
+				"poller_items":    1,
+				"matrix_sessions": 0,
+			} {
+				var count int
+				if err = source.QueryRow(
+					"SELECT COUNT(*) FROM " + table,
+				).Scan(&count); err != nil {
+					t.Fatalf("QueryRow: %v", err)
+				}
+
+				if count != want {
+					t.Errorf("%d rows in %s, want %d", count, table, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,512 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Migration describes a step upgrading the database's schema to a new version.
+type Migration struct {
+	// Version is the version of the schema once the migration is applied.
+	Version int
+	// Description describes what the migration changes.
+	Description string
+	// Statements are the SQL statements of the migration for the database's
+	// driver.
+	Statements []string
+}
+
+// migration describes a step upgrading the database's schema, which statements
+// depend on the database's dialect.
+type migration struct {
+	description string
+	up          func(d dialect) []string
+}
+
+// migrations lists the steps upgrading the database's schema, in order: the
+// migration at index i upgrades the schema to the version i+1. Migrations must
+// never be modified or removed once released, since databases may have been
+// upgraded with them already; changes to the schema go into new migrations.
+var migrations = []migration{
+	{
+		// The tables as they were created before the schema was versioned.
+		// They're only created if they don't exist, so databases created
+		// back then are upgraded to this version as they are.
+		description: "Create the poller_items, outbox_events, matrix_sessions and source_chains tables",
+		up: func(d dialect) []string {
+			return []string{
+				createPollerItemsSQL,
+				fmt.Sprintf(createOutboxEventsSQL, d.serialPrimaryKey),
+				createMatrixSessionsSQL,
+				createSourceChainsSQL,
+			}
+		},
+	},
+	{
+		description: "Remove the duplicated rows from poller_items and make (feed, item_url) its primary key",
+		up: func(d dialect) []string {
+			return []string{
+				createPollerItemsV2SQL,
+				copyPollerItemsV2SQL,
+				"DROP TABLE poller_items",
+				"ALTER TABLE poller_items_v2 RENAME TO poller_items",
+			}
+		},
+	},
+	{
+		// The items already in the database are considered as first and
+		// last seen when the migration is applied, since there's no way to
+		// know better.
+		description: "Record when each item of poller_items was first and last seen in its feed",
+		up: func(d dialect) []string {
+			now := nowMs()
+			return []string{
+				addPollerItemsFirstSeenSQL,
+				addPollerItemsLastSeenSQL,
+				fmt.Sprintf(initPollerItemsSeenSQL, now, now),
+				createPollerItemsLastSeenIndexSQL,
+			}
+		},
+	},
+	{
+		// The events waiting in the outbox are added to the history, so it
+		// records their publication, but what they were generated from
+		// isn't known.
+		description: "Create the published_items table recording the publication of each event, and record when the events of outbox_events are abandoned",
+		up: func(d dialect) []string {
+			return []string{
+				fmt.Sprintf(createPublishedItemsSQL, d.serialPrimaryKey),
+				createPublishedItemsTxnIDIndexSQL,
+				createPublishedItemsEventIDIndexSQL,
+				fmt.Sprintf(copyOutboxToPublishedItemsSQL, nowMs()),
+				addOutboxEventsAbandonedAtSQL,
+			}
+		},
+	},
+}
+
+// Statements of the migration to version 1.
+
+const createPollerItemsSQL = `
+-- Store the result from the latest poll for a given feed. One row equals to one
+-- item.
+CREATE TABLE IF NOT EXISTS poller_items (
+	-- The identifier of the feed the item comes from.
+	feed TEXT NOT NULL,
+	-- The URL of the item.
+	item_url TEXT NOT NULL
+);
+`
+
+// createOutboxEventsSQL is formatted with the definition of the dialect's
+// auto-incremented primary key.
+const createOutboxEventsSQL = `
+-- Store the events that have been prepared and signed but not yet published
+-- to Matrix. One row equals to one event.
+CREATE TABLE IF NOT EXISTS outbox_events (
+	-- The position of the event in the queue.
+	id %s,
+	-- The identifier of the feed the event was generated from.
+	feed TEXT NOT NULL,
+	-- The URL of the item the event was generated from.
+	item_url TEXT NOT NULL,
+	-- The name of the network profile the event is published into.
+	network TEXT NOT NULL,
+	-- The ID of the room to send the event into.
+	room_id TEXT NOT NULL,
+	-- The type of the event.
+	event_type TEXT NOT NULL,
+	-- The transaction ID to use when sending the event. It is computed once
+	-- when the event is enqueued so that retries are idempotent.
+	txn_id TEXT NOT NULL,
+	-- The signed JSON content of the event.
+	content TEXT NOT NULL,
+	-- The number of failed attempts to send the event.
+	attempts INTEGER NOT NULL DEFAULT 0,
+	-- The timestamp (in milliseconds) before which no new attempt should be
+	-- made to send the event.
+	next_attempt BIGINT NOT NULL DEFAULT 0,
+	-- The error returned by the last failed attempt, if any.
+	last_error TEXT NOT NULL DEFAULT '',
+	-- The timestamp (in milliseconds) until which the event is claimed by the
+	-- publisher sending it, so the other feeders sharing the database don't
+	-- send it too. 0 if the event isn't claimed.
+	claimed_until BIGINT NOT NULL DEFAULT 0
+);
+`
+
+const createMatrixSessionsSQL = `
+-- Store the access tokens obtained by logging in to Matrix homeservers. One row
+-- equals to one account.
+CREATE TABLE IF NOT EXISTS matrix_sessions (
+	-- The URL of the homeserver the account belongs to.
+	homeserver TEXT NOT NULL,
+	-- The Matrix ID of the account.
+	mxid TEXT NOT NULL,
+	-- The ID of the device the access token was obtained for.
+	device_id TEXT NOT NULL,
+	-- The access token.
+	access_token TEXT NOT NULL,
+	-- The hash of the access token from the configuration file when the
+	-- session was obtained, so a new access token in the configuration file
+	-- takes precedence over the session.
+	config_token_hash TEXT NOT NULL DEFAULT ''
+);
+`
+
+const createSourceChainsSQL = `
+-- Store the head of the chain of the events published for each source into
+-- each network, i.e. the sequence number and the hash of the last event
+-- enqueued for publication. One row equals to one chain.
+CREATE TABLE IF NOT EXISTS source_chains (
+	-- The identifier of the source.
+	feed TEXT NOT NULL,
+	-- The name of the network profile the events are published into.
+	network TEXT NOT NULL,
+	-- The sequence number of the last event.
+	sequence BIGINT NOT NULL,
+	-- The hash of the signed content of the last event.
+	hash TEXT NOT NULL,
+	PRIMARY KEY (feed, network)
+);
+`
+
+// Statements of the migration to version 2. The table is copied rather than
+// altered since SQLite can't add a primary key to an existing table.
+
+const createPollerItemsV2SQL = `
+-- Store the items retrieved from the feeds. One row equals to one item.
+CREATE TABLE poller_items_v2 (
+	-- The identifier of the feed the item comes from.
+	feed TEXT NOT NULL,
+	-- The URL of the item.
+	item_url TEXT NOT NULL,
+	PRIMARY KEY (feed, item_url)
+);
+`
+
+const copyPollerItemsV2SQL = `
+INSERT INTO poller_items_v2 (feed, item_url)
+SELECT DISTINCT feed, item_url FROM poller_items
+`
+
+// Statements of the migration to version 3.
+
+const addPollerItemsFirstSeenSQL = `
+-- The time (in milliseconds) the item was first retrieved from its feed.
+ALTER TABLE poller_items ADD COLUMN first_seen BIGINT NOT NULL DEFAULT 0
+`
+
+const addPollerItemsLastSeenSQL = `
+-- The time (in milliseconds) of the last poll the item was part of the feed in.
+ALTER TABLE poller_items ADD COLUMN last_seen BIGINT NOT NULL DEFAULT 0
+`
+
+const initPollerItemsSeenSQL = `
+UPDATE poller_items SET first_seen = %d, last_seen = %d
+`
+
+const createPollerItemsLastSeenIndexSQL = `
+CREATE INDEX poller_items_last_seen ON poller_items (feed, last_seen)
+`
+
+// Statements of the migration to version 4.
+
+const createPublishedItemsSQL = `
+-- Store the history of the events generated from the feeds' items, from the
+-- moment they're added to the outbox. One row equals to one event.
+CREATE TABLE published_items (
+	-- The position of the event in the history.
+	id %s,
+	-- The identifier of the feed the event was generated from.
+	feed TEXT NOT NULL,
+	-- The URL of the item the event was generated from.
+	item_url TEXT NOT NULL,
+	-- The headline of the item.
+	headline TEXT NOT NULL DEFAULT '',
+	-- The name of the network profile the event is published into.
+	network TEXT NOT NULL,
+	-- The ID of the room the event is sent into.
+	room_id TEXT NOT NULL,
+	-- The type of the event.
+	event_type TEXT NOT NULL,
+	-- The transaction ID used when sending the event.
+	txn_id TEXT NOT NULL,
+	-- The ID of the event, once it's published.
+	event_id TEXT NOT NULL DEFAULT '',
+	-- The ID of the key the event was signed with.
+	key_id TEXT NOT NULL DEFAULT '',
+	-- The signature of the event's content.
+	signature TEXT NOT NULL DEFAULT '',
+	-- The hash of the event's signed content.
+	content_hash TEXT NOT NULL DEFAULT '',
+	-- The position of the event in the chain of its source in its network.
+	sequence BIGINT NOT NULL DEFAULT 0,
+	-- The time (in milliseconds) the event was added to the outbox.
+	enqueued_at BIGINT NOT NULL,
+	-- The time (in milliseconds) the event was published, if it was.
+	published_at BIGINT NOT NULL DEFAULT 0,
+	-- The number of failed attempts to send the event.
+	attempts INTEGER NOT NULL DEFAULT 0,
+	-- The error returned by the last failed attempt, if any.
+	last_error TEXT NOT NULL DEFAULT '',
+	-- Either "pending", "retrying", "published" or "failed".
+	outcome TEXT NOT NULL
+);
+`
+
+const createPublishedItemsTxnIDIndexSQL = `
+CREATE INDEX published_items_txn_id ON published_items (txn_id)
+`
+
+const createPublishedItemsEventIDIndexSQL = `
+CREATE INDEX published_items_event_id ON published_items (event_id)
+`
+
+const copyOutboxToPublishedItemsSQL = `
+INSERT INTO published_items (
+	feed, item_url, network, room_id, event_type, txn_id, enqueued_at,
+	attempts, last_error, outcome
+)
+SELECT feed, item_url, network, room_id, event_type, txn_id, %d, attempts,
+	last_error, CASE WHEN attempts > 0 THEN 'retrying' ELSE 'pending' END
+FROM outbox_events ORDER BY id
+`
+
+const addOutboxEventsAbandonedAtSQL = `
+-- The timestamp (in milliseconds) the publisher gave up on the event after too
+-- many failed attempts to send it, 0 if it didn't. An abandoned event stays in
+-- the outbox, holding back the next events of its chain, until the operator
+-- republishes it.
+ALTER TABLE outbox_events ADD COLUMN abandoned_at BIGINT NOT NULL DEFAULT 0
+`
+
+const schemaVersionSchema = `
+-- Store the migrations applied to the database's schema. One row equals to one
+-- migration.
+CREATE TABLE IF NOT EXISTS schema_version (
+	-- The version of the schema once the migration was applied.
+	version INTEGER NOT NULL PRIMARY KEY,
+	-- The description of the migration.
+	description TEXT NOT NULL,
+	-- The time (in milliseconds) the migration was applied at.
+	applied_at BIGINT NOT NULL
+);
+`
+
+const selectSchemaVersionSQL = `
+	SELECT COALESCE(MAX(version), 0) FROM schema_version
+`
+
+const insertSchemaVersionSQL = `
+	INSERT INTO schema_version (version, description, applied_at)
+	VALUES ($1, $2, $3)
+`
+
+// LatestSchemaVersion returns the version of the schema once all the known
+// migrations are applied.
+func LatestSchemaVersion() int {
+	return len(migrations)
+}
+
+// PendingMigrations returns the version of the schema of the database
+// described by the given driver and data source name, and the migrations that
+// would be applied to it, without changing the database.
+// Returns an error if the database couldn't be opened or its version
+// retrieved, or if its schema is newer than the latest known version.
+func PendingMigrations(
+	driver string, dsn string,
+) (version int, pending []Migration, err error) {
+	d, err := dialectForDriver(driver)
+	if err != nil {
+		return
+	}
+
+	// Don't create the database only to tell it needs every migration.
+	if d.exists != nil {
+		var exists bool
+		if exists, err = d.exists(dsn); err != nil || !exists {
+			pending, _ = pendingMigrations(d, 0)
+			return
+		}
+	}
+
+	db, d, err := open(driver, dsn)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	var count int
+	if err = db.QueryRow(d.tableExistsSQL, "schema_version").Scan(&count); err != nil {
+		return
+	}
+
+	// A database which schema isn't versioned yet is at version 0.
+	if count > 0 {
+		if err = db.QueryRow(selectSchemaVersionSQL).Scan(&version); err != nil {
+			return
+		}
+	}
+
+	pending, err = pendingMigrations(d, version)
+	return
+}
+
+// Migrate applies the pending migrations to the database described by the
+// given driver and data source name, and returns them.
+// Returns an error if the database couldn't be opened or migrated.
+func Migrate(driver string, dsn string) (applied []Migration, err error) {
+	db, d, err := open(driver, dsn)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	return migrate(db, d)
+}
+
+// openUpToDate opens the database described by the given driver and data
+// source name, without creating it or changing its schema, and returns it
+// along with its dialect.
+// Returns an error if the database couldn't be opened, or if it doesn't exist
+// or its schema isn't at the latest version.
+func openUpToDate(driver string, dsn string) (db *sql.DB, d dialect, err error) {
+	version, pending, err := PendingMigrations(driver, dsn)
+	if err != nil {
+		return
+	}
+
+	if len(pending) > 0 {
+		err = fmt.Errorf(
+			"The database's schema (version %d) isn't at the latest version (%d), please run \"informo-feeder db migrate\" first",
+			version, len(migrations),
+		)
+		return
+	}
+
+	return open(driver, dsn)
+}
+
+// open opens the database described by the given driver and data source name,
+// and returns it along with its dialect.
+// Returns an error if the driver isn't supported or if the database couldn't
+// be opened.
+func open(driver string, dsn string) (db *sql.DB, d dialect, err error) {
+	if d, err = dialectForDriver(driver); err != nil {
+		return
+	}
+
+	if db, err = sql.Open(driver, dsn); err != nil {
+		return
+	}
+
+	db.SetMaxOpenConns(d.maxOpenConns)
+	return
+}
+
+// migrate applies the pending migrations to the given database in a single
+// transaction, so the schema is either fully upgraded or left untouched, and
+// returns them.
+// Returns an error if the migrations couldn't be applied, or if the database's
+// schema is newer than the latest known version.
+func migrate(db *sql.DB, d dialect) (applied []Migration, err error) {
+	if _, err = db.Exec(schemaVersionSchema); err != nil {
+		return
+	}
+
+	txn, err := db.Begin()
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			txn.Rollback()
+			applied = nil
+		}
+	}()
+
+	// Make sure another feeder sharing the database doesn't apply the same
+	// migrations at the same time.
+	if len(d.lockSchemaVersionSQL) > 0 {
+		if _, err = txn.Exec(d.lockSchemaVersionSQL); err != nil {
+			return
+		}
+	}
+
+	var version int
+	if err = txn.QueryRow(selectSchemaVersionSQL).Scan(&version); err != nil {
+		return
+	}
+
+	if applied, err = pendingMigrations(d, version); err != nil {
+		return
+	}
+
+	for _, m := range applied {
+		for _, statement := range m.Statements {
+			if _, err = txn.Exec(statement); err != nil {
+				err = fmt.Errorf(
+					"Couldn't apply the migration to version %d: %v",
+					m.Version, err,
+				)
+				return
+			}
+		}
+
+		if _, err = txn.Exec(
+			insertSchemaVersionSQL, m.Version, m.Description, nowMs(),
+		); err != nil {
+			return
+		}
+	}
+
+	err = txn.Commit()
+	return
+}
+
+// pendingMigrations returns the migrations to apply to a database which schema
+// is at the given version, with the statements for the given dialect.
+// Returns an error if the version is newer than the latest known version, i.e.
+// if the database has been upgraded by a newer version of the feeder.
+func pendingMigrations(d dialect, version int) (pending []Migration, err error) {
+	if version > len(migrations) {
+		err = fmt.Errorf(
+			"The database's schema (version %d) is newer than the latest version this feeder knows about (%d), please upgrade the feeder",
+			version, len(migrations),
+		)
+		return
+	}
+
+	for i := version; i < len(migrations); i++ {
+		pending = append(pending, Migration{
+			Version:     i + 1,
+			Description: migrations[i].description,
+			Statements:  migrations[i].up(d),
+		})
+	}
+
+	return
+}
+
+// nowMs returns the current time as a timestamp in milliseconds.
+func nowMs() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
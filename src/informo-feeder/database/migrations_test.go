@@ -0,0 +1,228 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openTestDatabase opens a new database stored in memory, without migrating
+// it.
+func openTestDatabase(t *testing.T) (*sql.DB, dialect) {
+	db, d, err := open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	return db, d
+}
+
+func TestMigrateNewDatabase(t *testing.T) {
+	db, d := openTestDatabase(t)
+
+	applied, err := migrate(db, d)
+	if err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	if len(applied) != LatestSchemaVersion() {
+		t.Fatalf("applied %d migrations, want %d", len(applied), LatestSchemaVersion())
+	}
+
+	for i, m := range applied {
+		if m.Version != i+1 {
+			t.Errorf("migration %d has version %d", i, m.Version)
+		}
+	}
+
+	// Migrating an up to date database does nothing.
+	if applied, err = migrate(db, d); err != nil || len(applied) > 0 {
+		t.Errorf("applied %d migrations again (error: %v)", len(applied), err)
+	}
+
+	// The statements can be prepared against the migrated schema.
+	if _, err = newDatabase(db); err != nil {
+		t.Errorf("newDatabase: %v", err)
+	}
+}
+
+func TestMigrateUnversionedDatabase(t *testing.T) {
+	db, d := openTestDatabase(t)
+
+	// The schema of the databases created before the schema was versioned,
+	// with duplicated items.
+	for _, statement := range []string{
+		createPollerItemsSQL,
+		`INSERT INTO poller_items (feed, item_url) VALUES
+			('acmenews', 'https://example.org/1'),
+			('acmenews', 'https://example.org/1'),
+			('acmenews', 'https://example.org/2')`,
+		createSourceChainsSQL,
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+	}
+
+	if _, err := migrate(db, d); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"SELECT COUNT(*) FROM poller_items", 2},
+		{"SELECT COUNT(*) FROM poller_items WHERE first_seen > 0 AND last_seen = first_seen", 2},
+		{"SELECT COALESCE(MAX(version), 0) FROM schema_version", LatestSchemaVersion()},
+	}
+
+	for _, test := range tests {
+		var got int
+		if err := db.QueryRow(test.query).Scan(&got); err != nil {
+			t.Fatalf("%s: %v", test.query, err)
+		}
+
+		if got != test.want {
+			t.Errorf("%s: got %d, want %d", test.query, got, test.want)
+		}
+	}
+
+	// The duplicates are gone, so the items can't be duplicated anymore.
+	if _, err := db.Exec(
+		"INSERT INTO poller_items (feed, item_url) VALUES ('acmenews', 'https://example.org/1')",
+	); err == nil {
+		t.Error("could insert a duplicated item")
+	}
+}
+
+func TestMigrateBackfillsHistory(t *testing.T) {
+	db, d := openTestDatabase(t)
+
+	// Stop right before the migration creating the history, with events in
+	// the outbox.
+	for _, m := range migrations[:3] {
+		for _, statement := range m.up(d) {
+			if _, err := db.Exec(statement); err != nil {
+				t.Fatalf("Exec: %v", err)
+			}
+		}
+	}
+
+	if _, err := db.Exec(schemaVersionSchema); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	if _, err := db.Exec(insertSchemaVersionSQL, 3, "test", 0); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	if _, err := db.Exec(`INSERT INTO outbox_events (
+		feed, item_url, network, room_id, event_type, txn_id, content, attempts
+	) VALUES
+		('acmenews', 'https://example.org/1', 'informo', '!room', 'type', 'txn1', '{}', 0),
+		('acmenews', 'https://example.org/2', 'informo', '!room', 'type', 'txn2', '{}', 2)`,
+	); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	applied, err := migrate(db, d)
+	if err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	if len(applied) != LatestSchemaVersion()-3 || applied[0].Version != 4 {
+		t.Fatalf("applied %v, want the migrations from version 4", applied)
+	}
+
+	tests := []struct {
+		txnID   string
+		outcome string
+	}{
+		{"txn1", OutcomePending},
+		{"txn2", OutcomeRetrying},
+	}
+
+	for _, test := range tests {
+		var outcome string
+		if err = db.QueryRow(
+			"SELECT outcome FROM published_items WHERE txn_id = $1", test.txnID,
+		).Scan(&outcome); err != nil {
+			t.Fatalf("%s: %v", test.txnID, err)
+		}
+
+		if outcome != test.outcome {
+			t.Errorf("%s: got outcome %s, want %s", test.txnID, outcome, test.outcome)
+		}
+	}
+}
+
+func TestMigrateNewerDatabase(t *testing.T) {
+	db, d := openTestDatabase(t)
+
+	if _, err := migrate(db, d); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	if _, err := db.Exec(
+		insertSchemaVersionSQL, LatestSchemaVersion()+1, "from the future", 0,
+	); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	if applied, err := migrate(db, d); err == nil {
+		t.Errorf("migrated a newer database (applied %v)", applied)
+	}
+}
+
+func TestNewDatabaseWithoutMigrating(t *testing.T) {
+	dir, err := ioutil.TempDir("", "informo-feeder")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "feeder.db")
+
+	version, pending, err := PendingMigrations("sqlite3", path)
+	if err != nil || version != 0 || len(pending) != LatestSchemaVersion() {
+		t.Errorf("got version %d and %d pending migrations (error: %v)", version, len(pending), err)
+	}
+
+	if _, err = NewDatabase("sqlite3", path, false); err == nil {
+		t.Error("opened a database which doesn't exist without migrating it")
+	}
+
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("the database has been created (error: %v)", err)
+	}
+
+	if _, err = Migrate("sqlite3", path); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+
+	if _, err = NewDatabase("sqlite3", path, false); err != nil {
+		t.Errorf("NewDatabase: %v", err)
+	}
+
+	if _, err = NewDatabase("sqlite3", "file:"+path+"?cache=shared", false); err != nil {
+		t.Errorf("NewDatabase with a URI: %v", err)
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"database/sql"
+)
+
+// Events which are due and not claimed aren't selected if an older event of
+// the same feed and network profile is waiting for a new attempt, claimed or
+// abandoned, so the events of a chain are always published in order.
+const selectPendingEventsSQL = `
+	SELECT id, feed, item_url, network, room_id, event_type, txn_id, content, attempts
+	FROM outbox_events o
+	WHERE next_attempt <= $1 AND claimed_until <= $1 AND abandoned_at = 0
+	AND NOT EXISTS (
+		SELECT 1 FROM outbox_events e
+		WHERE e.feed = o.feed AND e.network = o.network AND e.id < o.id
+		AND (e.next_attempt > $1 OR e.claimed_until > $1 OR e.abandoned_at > 0)
+	) ORDER BY id ASC LIMIT $2
+`
+
+// Same as selectPendingEventsSQL, but only selects the events of a given feed.
+const selectPendingFeedEventsSQL = `
+	SELECT id, feed, item_url, network, room_id, event_type, txn_id, content, attempts
+	FROM outbox_events o
+	WHERE next_attempt <= $1 AND claimed_until <= $1 AND abandoned_at = 0
+	AND feed = $2 AND NOT EXISTS (
+		SELECT 1 FROM outbox_events e
+		WHERE e.feed = o.feed AND e.network = o.network AND e.id < o.id
+		AND (e.next_attempt > $1 OR e.claimed_until > $1 OR e.abandoned_at > 0)
+	) ORDER BY id ASC LIMIT $3
+`
+
+// Only claims the event if no other publisher holds a claim on it.
+const claimEventSQL = `
+	UPDATE outbox_events SET claimed_until = $1 WHERE id = $2 AND claimed_until <= $3
+`
+
+// Only releases the event if the claim is still the one being released.
+const releaseEventSQL = `
+	UPDATE outbox_events SET claimed_until = 0 WHERE id = $1 AND claimed_until = $2
+`
+
+// Only counts the events which can still be published, i.e. the ones which
+// aren't abandoned and aren't held back by an abandoned event of their chain.
+const countFeedEventsSQL = `
+	SELECT COUNT(*) FROM outbox_events o
+	WHERE feed = $1 AND abandoned_at = 0 AND NOT EXISTS (
+		SELECT 1 FROM outbox_events e
+		WHERE e.feed = o.feed AND e.network = o.network AND e.id < o.id
+		AND e.abandoned_at > 0
+	)
+`
+
+// Counts the abandoned events along with the events held back by them.
+const countFeedAbandonedEventsSQL = `
+	SELECT COUNT(*) FROM outbox_events o
+	WHERE feed = $1 AND (abandoned_at > 0 OR EXISTS (
+		SELECT 1 FROM outbox_events e
+		WHERE e.feed = o.feed AND e.network = o.network AND e.id < o.id
+		AND e.abandoned_at > 0
+	))
+`
+
+const insertEventSQL = `
+	INSERT INTO outbox_events (feed, item_url, network, room_id, event_type, txn_id, content)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+`
+
+const updateEventAttemptSQL = `
+	UPDATE outbox_events
+	SET attempts = $1, next_attempt = $2, last_error = $3, claimed_until = 0
+	WHERE id = $4
+`
+
+const abandonEventSQL = `
+	UPDATE outbox_events
+	SET attempts = $1, last_error = $2, abandoned_at = $3, claimed_until = 0
+	WHERE id = $4
+`
+
+const republishFeedEventsSQL = `
+	UPDATE outbox_events SET attempts = 0, next_attempt = 0, abandoned_at = 0
+	WHERE feed = $1 AND abandoned_at > 0
+`
+
+const deleteEventSQL = `
+	DELETE FROM outbox_events WHERE id = $1
+`
+
+type outboxStatements struct {
+	selectPendingEventsStmt      *sql.Stmt
+	selectPendingFeedEventsStmt  *sql.Stmt
+	claimEventStmt               *sql.Stmt
+	releaseEventStmt             *sql.Stmt
+	countFeedEventsStmt          *sql.Stmt
+	countFeedAbandonedEventsStmt *sql.Stmt
+	insertEventStmt              *sql.Stmt
+	updateEventAttemptStmt       *sql.Stmt
+	abandonEventStmt             *sql.Stmt
+	republishFeedEventsStmt      *sql.Stmt
+	deleteEventStmt              *sql.Stmt
+}
+
+func (o *outboxStatements) prepare(db *sql.DB) (err error) {
+	if o.selectPendingEventsStmt, err = db.Prepare(selectPendingEventsSQL); err != nil {
+		return
+	}
+	if o.selectPendingFeedEventsStmt, err = db.Prepare(selectPendingFeedEventsSQL); err != nil {
+		return
+	}
+	if o.claimEventStmt, err = db.Prepare(claimEventSQL); err != nil {
+		return
+	}
+	if o.releaseEventStmt, err = db.Prepare(releaseEventSQL); err != nil {
+		return
+	}
+	if o.countFeedEventsStmt, err = db.Prepare(countFeedEventsSQL); err != nil {
+		return
+	}
+	if o.countFeedAbandonedEventsStmt, err = db.Prepare(countFeedAbandonedEventsSQL); err != nil {
+		return
+	}
+	if o.insertEventStmt, err = db.Prepare(insertEventSQL); err != nil {
+		return
+	}
+	if o.updateEventAttemptStmt, err = db.Prepare(updateEventAttemptSQL); err != nil {
+		return
+	}
+	if o.abandonEventStmt, err = db.Prepare(abandonEventSQL); err != nil {
+		return
+	}
+	if o.republishFeedEventsStmt, err = db.Prepare(republishFeedEventsSQL); err != nil {
+		return
+	}
+	if o.deleteEventStmt, err = db.Prepare(deleteEventSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (o *outboxStatements) selectPendingEvents(
+	now int64, limit int,
+) ([]OutboxEvent, error) {
+	rows, err := o.selectPendingEventsStmt.Query(now, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanPendingEvents(rows)
+}
+
+func (o *outboxStatements) selectPendingFeedEvents(
+	now int64, feed string, limit int,
+) ([]OutboxEvent, error) {
+	rows, err := o.selectPendingFeedEventsStmt.Query(now, feed, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanPendingEvents(rows)
+}
+
+// scanPendingEvents returns the events from the rows returned by one of the
+// queries selecting the pending events, then closes the rows.
+func scanPendingEvents(rows *sql.Rows) (events []OutboxEvent, err error) {
+	defer rows.Close()
+
+	events = make([]OutboxEvent, 0)
+	for rows.Next() {
+		var e OutboxEvent
+		if err = rows.Scan(
+			&e.ID, &e.Feed, &e.ItemURL, &e.Network, &e.RoomID, &e.EventType,
+			&e.TxnID, &e.Content, &e.Attempts,
+		); err != nil {
+			return
+		}
+
+		events = append(events, e)
+	}
+
+	err = rows.Err()
+	return
+}
+
+func (o *outboxStatements) claimEvent(
+	id int64, now int64, until int64,
+) (claimed bool, err error) {
+	res, err := o.claimEventStmt.Exec(until, id, now)
+	if err != nil {
+		return
+	}
+
+	count, err := res.RowsAffected()
+	claimed = count > 0
+	return
+}
+
+func (o *outboxStatements) releaseEvent(id int64, claimedUntil int64) (err error) {
+	_, err = o.releaseEventStmt.Exec(id, claimedUntil)
+
+	return
+}
+
+func (o *outboxStatements) countFeedEvents(feed string) (count int, err error) {
+	err = o.countFeedEventsStmt.QueryRow(feed).Scan(&count)
+	return
+}
+
+func (o *outboxStatements) countFeedAbandonedEvents(feed string) (count int, err error) {
+	err = o.countFeedAbandonedEventsStmt.QueryRow(feed).Scan(&count)
+	return
+}
+
+func (o *outboxStatements) insertEvent(txn *sql.Tx, e OutboxEvent) (err error) {
+	_, err = txStmt(txn, o.insertEventStmt).Exec(
+		e.Feed, e.ItemURL, e.Network, e.RoomID, e.EventType, e.TxnID, e.Content,
+	)
+
+	return
+}
+
+func (o *outboxStatements) updateEventAttempt(
+	txn *sql.Tx, id int64, attempts int, nextAttempt int64, lastError string,
+) (err error) {
+	_, err = txStmt(txn, o.updateEventAttemptStmt).Exec(
+		attempts, nextAttempt, lastError, id,
+	)
+
+	return
+}
+
+func (o *outboxStatements) abandonEvent(
+	txn *sql.Tx, id int64, attempts int, lastError string, abandonedAt int64,
+) (err error) {
+	_, err = txStmt(txn, o.abandonEventStmt).Exec(
+		attempts, lastError, abandonedAt, id,
+	)
+
+	return
+}
+
+func (o *outboxStatements) republishFeedEvents(
+	txn *sql.Tx, feed string,
+) (count int64, err error) {
+	res, err := txStmt(txn, o.republishFeedEventsStmt).Exec(feed)
+	if err != nil {
+		return
+	}
+
+	return res.RowsAffected()
+}
+
+func (o *outboxStatements) deleteEvent(txn *sql.Tx, id int64) (err error) {
+	_, err = txStmt(txn, o.deleteEventStmt).Exec(id)
+
+	return
+}
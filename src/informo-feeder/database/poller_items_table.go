@@ -17,77 +17,178 @@ package database
 
 import (
 	"database/sql"
+	"fmt"
+	"strings"
 )
 
-const pollerSchema = `
--- Store the result from the latest poll for a given feed. One row equals to one
--- item.
-CREATE TABLE IF NOT EXISTS poller_items (
-	-- The identifier of the feed the item comes from.
-	feed TEXT NOT NULL,
-	-- The URL of the item.
-	item_url TEXT NOT NULL
-);
+// itemsBatchSize is the maximum number of URLs given to a single query looking
+// up or updating items, which stays well below the number of parameters a
+// SQLite query can have.
+const itemsBatchSize = 100
+
+// selectKnownItemsSQL is formatted with the placeholders of the URLs to look
+// up, starting at $2.
+const selectKnownItemsSQL = `
+	SELECT item_url FROM poller_items WHERE feed = $1 AND item_url IN (%s)
 `
 
-const selectItemsURLsForFeedSQL = `
-	SELECT item_url FROM poller_items WHERE feed = $1
+// updateItemsLastSeenSQL is formatted with the placeholders of the URLs of the
+// items to update, starting at $3. The SQLite3 driver binds the parameters in
+// the order they appear in, so they must be numbered in that order.
+const updateItemsLastSeenSQL = `
+	UPDATE poller_items SET last_seen = $1 WHERE feed = $2 AND item_url IN (%s)
 `
 
 const insertItemForFeedSQL = `
-	INSERT INTO poller_items (feed, item_url) VALUES ($1, $2)
+	INSERT INTO poller_items (feed, item_url, first_seen, last_seen)
+	VALUES ($1, $2, $3, $4)
+`
+
+const countItemSQL = `
+	SELECT COUNT(*) FROM poller_items WHERE feed = $1 AND item_url = $2
 `
 
 const deleteItemsForFeedSQL = `
 	DELETE FROM poller_items WHERE feed = $1
 `
 
+const selectItemsFeedsSQL = `
+	SELECT DISTINCT feed FROM poller_items ORDER BY feed
+`
+
+const countItemsForFeedSQL = `
+	SELECT COUNT(*) FROM poller_items WHERE feed = $1
+`
+
+// The items seen during the latest poll of their feed are never pruned, so an
+// item still in the feed is never retrieved again as a new item, however long
+// the feeder hasn't polled the feed for.
+
+const selectPrunableItemsSQL = `
+	SELECT item_url FROM poller_items
+	WHERE feed = $1 AND last_seen < $2
+	AND last_seen < (SELECT MAX(last_seen) FROM poller_items WHERE feed = $1)
+	ORDER BY last_seen, item_url
+`
+
+const deletePrunableItemsSQL = `
+	DELETE FROM poller_items
+	WHERE feed = $1 AND last_seen < $2
+	AND last_seen < (SELECT MAX(last_seen) FROM poller_items WHERE feed = $1)
+`
+
 type pollerStatements struct {
-	selectItemsURLsForFeedStmt *sql.Stmt
-	insertItemForFeedStmt      *sql.Stmt
-	deleteItemsForFeedStmt     *sql.Stmt
+	db                      *sql.DB
+	insertItemForFeedStmt   *sql.Stmt
+	countItemStmt           *sql.Stmt
+	deleteItemsForFeedStmt  *sql.Stmt
+	selectItemsFeedsStmt    *sql.Stmt
+	countItemsForFeedStmt   *sql.Stmt
+	selectPrunableItemsStmt *sql.Stmt
+	deletePrunableItemsStmt *sql.Stmt
 }
 
 func (p *pollerStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(pollerSchema)
-	if err != nil {
+	// The queries looking up or updating a list of items depend on the
+	// number of URLs, so they can't be prepared.
+	p.db = db
+	if p.insertItemForFeedStmt, err = db.Prepare(insertItemForFeedSQL); err != nil {
 		return
 	}
-	if p.selectItemsURLsForFeedStmt, err = db.Prepare(selectItemsURLsForFeedSQL); err != nil {
+	if p.countItemStmt, err = db.Prepare(countItemSQL); err != nil {
 		return
 	}
-	if p.insertItemForFeedStmt, err = db.Prepare(insertItemForFeedSQL); err != nil {
+	if p.deleteItemsForFeedStmt, err = db.Prepare(deleteItemsForFeedSQL); err != nil {
 		return
 	}
-	if p.deleteItemsForFeedStmt, err = db.Prepare(deleteItemsForFeedSQL); err != nil {
+	if p.selectItemsFeedsStmt, err = db.Prepare(selectItemsFeedsSQL); err != nil {
+		return
+	}
+	if p.countItemsForFeedStmt, err = db.Prepare(countItemsForFeedSQL); err != nil {
+		return
+	}
+	if p.selectPrunableItemsStmt, err = db.Prepare(selectPrunableItemsSQL); err != nil {
 		return
 	}
+	if p.deletePrunableItemsStmt, err = db.Prepare(deletePrunableItemsSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (p *pollerStatements) selectKnownItems(
+	feed string, itemURLs []string,
+) (known map[string]bool, err error) {
+	known = make(map[string]bool)
+
+	err = inBatches(itemURLs, func(batch []string) error {
+		return p.selectKnownItemsBatch(feed, batch, known)
+	})
+
 	return
 }
 
-func (p *pollerStatements) selectItemsURLsForFeed(feed string) (urls map[string]bool, err error) {
-	urls = make(map[string]bool, 0)
+func (p *pollerStatements) selectKnownItemsBatch(
+	feed string, itemURLs []string, known map[string]bool,
+) (err error) {
+	args := []interface{}{feed}
+	for _, u := range itemURLs {
+		args = append(args, u)
+	}
 
-	rows, err := p.selectItemsURLsForFeedStmt.Query(feed)
+	rows, err := p.db.Query(
+		fmt.Sprintf(selectKnownItemsSQL, placeholders(len(itemURLs), 2)),
+		args...,
+	)
 	if err != nil {
 		return
 	}
+	defer rows.Close()
 
-	var u string
 	for rows.Next() {
+		var u string
 		if err = rows.Scan(&u); err != nil {
 			return
 		}
 
 		// Value does not matter, we only check for existence
-		urls[u] = true
+		known[u] = true
 	}
 
+	return rows.Err()
+}
+
+func (p *pollerStatements) updateItemsLastSeen(
+	txn *sql.Tx, feed string, itemURLs []string, lastSeen int64,
+) error {
+	return inBatches(itemURLs, func(batch []string) error {
+		args := []interface{}{lastSeen, feed}
+		for _, u := range batch {
+			args = append(args, u)
+		}
+
+		_, err := txn.Exec(
+			fmt.Sprintf(updateItemsLastSeenSQL, placeholders(len(batch), 3)),
+			args...,
+		)
+		return err
+	})
+}
+
+func (p *pollerStatements) insertItemForFeed(
+	txn *sql.Tx, feed string, itemURL string, firstSeen int64, lastSeen int64,
+) (err error) {
+	_, err = txStmt(txn, p.insertItemForFeedStmt).Exec(
+		feed, itemURL, firstSeen, lastSeen,
+	)
+
 	return
 }
 
-func (p *pollerStatements) insertItemForFeed(feed string, itemURL string) (err error) {
-	_, err = p.insertItemForFeedStmt.Exec(feed, itemURL)
+func (p *pollerStatements) countItem(
+	txn *sql.Tx, feed string, itemURL string,
+) (count int, err error) {
+	err = txStmt(txn, p.countItemStmt).QueryRow(feed, itemURL).Scan(&count)
 
 	return
 }
@@ -97,3 +198,92 @@ func (p *pollerStatements) deleteItemsForFeed(feed string) (err error) {
 
 	return
 }
+
+func (p *pollerStatements) selectItemsFeeds(
+	txn *sql.Tx,
+) (feeds []string, err error) {
+	rows, err := txStmt(txn, p.selectItemsFeedsStmt).Query()
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var feed string
+		if err = rows.Scan(&feed); err != nil {
+			return
+		}
+
+		feeds = append(feeds, feed)
+	}
+
+	err = rows.Err()
+	return
+}
+
+func (p *pollerStatements) countItemsForFeed(
+	txn *sql.Tx, feed string,
+) (count int, err error) {
+	err = txStmt(txn, p.countItemsForFeedStmt).QueryRow(feed).Scan(&count)
+
+	return
+}
+
+func (p *pollerStatements) selectPrunableItems(
+	txn *sql.Tx, feed string, before int64,
+) (urls []string, err error) {
+	rows, err := txStmt(txn, p.selectPrunableItemsStmt).Query(feed, before)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u string
+		if err = rows.Scan(&u); err != nil {
+			return
+		}
+
+		urls = append(urls, u)
+	}
+
+	err = rows.Err()
+	return
+}
+
+func (p *pollerStatements) deletePrunableItems(
+	txn *sql.Tx, feed string, before int64,
+) (err error) {
+	_, err = txStmt(txn, p.deletePrunableItemsStmt).Exec(feed, before)
+
+	return
+}
+
+// inBatches calls the given function with consecutive slices of the given URLs,
+// each containing at most itemsBatchSize URLs.
+// Returns the first error returned by the function.
+func inBatches(urls []string, fn func(batch []string) error) error {
+	for start := 0; start < len(urls); start += itemsBatchSize {
+		end := start + itemsBatchSize
+		if end > len(urls) {
+			end = len(urls)
+		}
+
+		if err := fn(urls[start:end]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// placeholders returns a comma-separated list of n numbered placeholders,
+// starting at $first.
+func placeholders(n int, first int) string {
+	list := make([]string, n)
+	for i := range list {
+		list[i] = fmt.Sprintf("$%d", first+i)
+	}
+
+	return strings.Join(list, ", ")
+}
@@ -0,0 +1,239 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+const insertPublishedItemSQL = `
+	INSERT INTO published_items (
+		feed, item_url, headline, network, room_id, event_type, txn_id, key_id,
+		signature, content_hash, sequence, enqueued_at, outcome
+	) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+`
+
+// Recovered events are sent already, and their transaction ID isn't known.
+const insertRecoveredItemSQL = `
+	INSERT INTO published_items (
+		feed, item_url, headline, network, room_id, event_type, txn_id,
+		event_id, key_id, signature, content_hash, sequence, enqueued_at,
+		published_at, outcome
+	) VALUES ($1, $2, $3, $4, $5, $6, '', $7, $8, $9, $10, $11, $12, $12, $13)
+`
+
+const countEventSQL = `
+	SELECT COUNT(*) FROM published_items WHERE event_id = $1
+`
+
+// The events are identified by their transaction ID, which is derived from
+// their signed content. Only the events which aren't published yet are
+// updated, in case an identical event was published before.
+
+const updatePublishedItemSentSQL = `
+	UPDATE published_items SET event_id = $1, published_at = $2, outcome = $3
+	WHERE txn_id = $4 AND published_at = 0
+`
+
+const updatePublishedItemAttemptSQL = `
+	UPDATE published_items SET attempts = $1, last_error = $2, outcome = $3
+	WHERE txn_id = $4 AND published_at = 0
+`
+
+// Marks the abandoned events of a feed from the outbox as retried, before
+// they're republished.
+const updateAbandonedItemsSQL = `
+	UPDATE published_items SET outcome = $1
+	WHERE published_at = 0 AND txn_id IN (
+		SELECT txn_id FROM outbox_events WHERE feed = $2 AND abandoned_at > 0
+	)
+`
+
+// selectPublishedItemsSQL is formatted with the conditions of the query and
+// its limit.
+const selectPublishedItemsSQL = `
+	SELECT id, feed, item_url, headline, network, room_id, event_type, txn_id,
+		event_id, key_id, signature, content_hash, sequence, enqueued_at,
+		published_at, attempts, last_error, outcome
+	FROM published_items %s ORDER BY id DESC %s
+`
+
+type publishedItemsStatements struct {
+	db                             *sql.DB
+	insertPublishedItemStmt        *sql.Stmt
+	updatePublishedItemSentStmt    *sql.Stmt
+	updatePublishedItemAttemptStmt *sql.Stmt
+	updateAbandonedItemsStmt       *sql.Stmt
+	insertRecoveredItemStmt        *sql.Stmt
+	countEventStmt                 *sql.Stmt
+}
+
+func (p *publishedItemsStatements) prepare(db *sql.DB) (err error) {
+	// The query looking up the history depends on the filters, so it can't be
+	// prepared.
+	p.db = db
+	if p.insertPublishedItemStmt, err = db.Prepare(insertPublishedItemSQL); err != nil {
+		return
+	}
+	if p.updatePublishedItemSentStmt, err = db.Prepare(updatePublishedItemSentSQL); err != nil {
+		return
+	}
+	if p.updatePublishedItemAttemptStmt, err = db.Prepare(updatePublishedItemAttemptSQL); err != nil {
+		return
+	}
+	if p.updateAbandonedItemsStmt, err = db.Prepare(updateAbandonedItemsSQL); err != nil {
+		return
+	}
+	if p.insertRecoveredItemStmt, err = db.Prepare(insertRecoveredItemSQL); err != nil {
+		return
+	}
+	if p.countEventStmt, err = db.Prepare(countEventSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (p *publishedItemsStatements) insertPublishedItem(
+	txn *sql.Tx, e OutboxEvent, enqueuedAt int64,
+) (err error) {
+	_, err = txStmt(txn, p.insertPublishedItemStmt).Exec(
+		e.Feed, e.ItemURL, e.Headline, e.Network, e.RoomID, e.EventType, e.TxnID,
+		e.KeyID, e.Signature, e.Hash, e.Sequence, enqueuedAt, OutcomePending,
+	)
+
+	return
+}
+
+func (p *publishedItemsStatements) updatePublishedItemSent(
+	txn *sql.Tx, txnID string, eventID string, publishedAt int64,
+) (err error) {
+	_, err = txStmt(txn, p.updatePublishedItemSentStmt).Exec(
+		eventID, publishedAt, OutcomePublished, txnID,
+	)
+
+	return
+}
+
+func (p *publishedItemsStatements) updatePublishedItemAttempt(
+	txn *sql.Tx, txnID string, attempts int, lastError string, outcome string,
+) (err error) {
+	_, err = txStmt(txn, p.updatePublishedItemAttemptStmt).Exec(
+		attempts, lastError, outcome, txnID,
+	)
+
+	return
+}
+
+func (p *publishedItemsStatements) updateAbandonedItems(
+	txn *sql.Tx, feed string,
+) (err error) {
+	_, err = txStmt(txn, p.updateAbandonedItemsStmt).Exec(OutcomeRetrying, feed)
+
+	return
+}
+
+func (p *publishedItemsStatements) insertRecoveredItem(
+	txn *sql.Tx, feed string, network string, e RecoveredEvent,
+) (err error) {
+	_, err = txStmt(txn, p.insertRecoveredItemStmt).Exec(
+		feed, e.ItemURL, e.Headline, network, e.RoomID, e.EventType, e.EventID,
+		e.KeyID, e.Signature, e.Hash, e.Sequence, e.Timestamp, OutcomePublished,
+	)
+
+	return
+}
+
+func (p *publishedItemsStatements) countEvent(
+	txn *sql.Tx, eventID string,
+) (count int, err error) {
+	err = txStmt(txn, p.countEventStmt).QueryRow(eventID).Scan(&count)
+
+	return
+}
+
+func (p *publishedItemsStatements) selectPublishedItems(
+	filter HistoryFilter,
+) (items []PublishedItem, err error) {
+	// The SQLite3 driver binds the parameters in the order they appear in, so
+	// the conditions are numbered in that order.
+	var conditions []string
+	var args []interface{}
+	addCondition := func(format string, values ...interface{}) {
+		conditions = append(conditions, fmt.Sprintf(
+			format, placeholders(len(values), len(args)+1),
+		))
+		args = append(args, values...)
+	}
+
+	if len(filter.Feeds) > 0 {
+		feeds := make([]interface{}, len(filter.Feeds))
+		for i, feed := range filter.Feeds {
+			feeds[i] = feed
+		}
+
+		addCondition("feed IN (%s)", feeds...)
+	}
+	if len(filter.Network) > 0 {
+		addCondition("network = %s", filter.Network)
+	}
+	if len(filter.ItemURL) > 0 {
+		addCondition("item_url = %s", filter.ItemURL)
+	}
+	if len(filter.Outcome) > 0 {
+		addCondition("outcome = %s", filter.Outcome)
+	}
+	if filter.Since > 0 {
+		addCondition("enqueued_at >= %s", filter.Since)
+	}
+	if filter.Until > 0 {
+		addCondition("enqueued_at < %s", filter.Until)
+	}
+
+	var where, limit string
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	if filter.Limit > 0 {
+		limit = fmt.Sprintf("LIMIT %d", filter.Limit)
+	}
+
+	rows, err := p.db.Query(
+		fmt.Sprintf(selectPublishedItemsSQL, where, limit), args...,
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i PublishedItem
+		if err = rows.Scan(
+			&i.ID, &i.Feed, &i.ItemURL, &i.Headline, &i.Network, &i.RoomID,
+			&i.EventType, &i.TxnID, &i.EventID, &i.KeyID, &i.Signature,
+			&i.ContentHash, &i.Sequence, &i.EnqueuedAt, &i.PublishedAt,
+			&i.Attempts, &i.LastError, &i.Outcome,
+		); err != nil {
+			return
+		}
+
+		items = append(items, i)
+	}
+
+	err = rows.Err()
+	return
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"database/sql"
+)
+
+const selectSessionSQL = `
+	SELECT device_id, access_token, config_token_hash FROM matrix_sessions
+	WHERE homeserver = $1 AND mxid = $2
+`
+
+const insertSessionSQL = `
+	INSERT INTO matrix_sessions (
+		homeserver, mxid, device_id, access_token, config_token_hash
+	) VALUES ($1, $2, $3, $4, $5)
+`
+
+const deleteSessionSQL = `
+	DELETE FROM matrix_sessions WHERE homeserver = $1 AND mxid = $2
+`
+
+type sessionsStatements struct {
+	selectSessionStmt *sql.Stmt
+	insertSessionStmt *sql.Stmt
+	deleteSessionStmt *sql.Stmt
+}
+
+func (s *sessionsStatements) prepare(db *sql.DB) (err error) {
+	if s.selectSessionStmt, err = db.Prepare(selectSessionSQL); err != nil {
+		return
+	}
+	if s.insertSessionStmt, err = db.Prepare(insertSessionSQL); err != nil {
+		return
+	}
+	if s.deleteSessionStmt, err = db.Prepare(deleteSessionSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *sessionsStatements) selectSession(
+	homeserver string, mxid string,
+) (session StoredSession, err error) {
+	err = s.selectSessionStmt.QueryRow(homeserver, mxid).Scan(
+		&session.DeviceID, &session.AccessToken, &session.ConfigTokenHash,
+	)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+
+	return
+}
+
+func (s *sessionsStatements) insertSession(
+	txn *sql.Tx, homeserver string, mxid string, session StoredSession,
+) (err error) {
+	_, err = txStmt(txn, s.insertSessionStmt).Exec(
+		homeserver, mxid, session.DeviceID, session.AccessToken,
+		session.ConfigTokenHash,
+	)
+
+	return
+}
+
+func (s *sessionsStatements) deleteSession(
+	txn *sql.Tx, homeserver string, mxid string,
+) (err error) {
+	_, err = txStmt(txn, s.deleteSessionStmt).Exec(homeserver, mxid)
+
+	return
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"database/sql"
+)
+
+const selectChainSQL = `
+	SELECT sequence, hash FROM source_chains WHERE feed = $1 AND network = $2
+`
+
+// Moves the head of a chain only if it's still where it was when the events
+// were chained to it, so the feeders sharing the database can't fork the
+// chain.
+const updateChainSQL = `
+	UPDATE source_chains SET sequence = $1, hash = $2
+	WHERE feed = $3 AND network = $4 AND sequence = $5
+`
+
+const insertChainSQL = `
+	INSERT INTO source_chains (feed, network, sequence, hash)
+	SELECT $1, $2, $3, $4 WHERE NOT EXISTS (
+		SELECT 1 FROM source_chains WHERE feed = $1 AND network = $2
+	)
+`
+
+type sourceChainsStatements struct {
+	selectChainStmt *sql.Stmt
+	updateChainStmt *sql.Stmt
+	insertChainStmt *sql.Stmt
+}
+
+func (s *sourceChainsStatements) prepare(db *sql.DB) (err error) {
+	if s.selectChainStmt, err = db.Prepare(selectChainSQL); err != nil {
+		return
+	}
+	if s.updateChainStmt, err = db.Prepare(updateChainSQL); err != nil {
+		return
+	}
+	if s.insertChainStmt, err = db.Prepare(insertChainSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *sourceChainsStatements) selectChain(
+	txn *sql.Tx, feed string, network string,
+) (sequence int64, hash string, err error) {
+	err = txStmt(txn, s.selectChainStmt).QueryRow(feed, network).Scan(
+		&sequence, &hash,
+	)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+
+	return
+}
+
+// advanceChain moves the head of a chain from the given previous sequence
+// number to the given sequence number and hash. Returns ErrChainConflict if
+// the head isn't at the previous sequence number anymore.
+func (s *sourceChainsStatements) advanceChain(
+	txn *sql.Tx, feed string, network string, prevSequence int64,
+	sequence int64, hash string,
+) error {
+	res, err := txStmt(txn, s.updateChainStmt).Exec(
+		sequence, hash, feed, network, prevSequence,
+	)
+	if err != nil {
+		return err
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil || count > 0 {
+		return err
+	}
+
+	// A chain which doesn't have any event yet may not have a head.
+	if prevSequence == 0 {
+		if res, err = txStmt(txn, s.insertChainStmt).Exec(
+			feed, network, sequence, hash,
+		); err != nil {
+			return err
+		}
+
+		if count, err = res.RowsAffected(); err != nil || count > 0 {
+			return err
+		}
+	}
+
+	return ErrChainConflict
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"informo-feeder/config"
+	"informo-feeder/database"
+
+	"github.com/codegangsta/cli"
+)
+
+var dbCommand = cli.Command{
+	Name:  "db",
+	Usage: "Manage the feeder's database",
+	Subcommands: []cli.Command{
+		{
+			Name:  "migrate",
+			Usage: "Upgrade the database's schema to the latest version (which the other commands also do before using the database)",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Only print out the migrations that would be applied, with their SQL statements",
+				},
+			},
+			Action: withConfig(migrateDB),
+		},
+		{
+			Name:  "prune",
+			Usage: "Remove the items which haven't been seen in their feed for longer than the retention period (which the feeder also does periodically), then print out a report",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "older-than",
+					Usage: "Retention period, in days (default: the database's retention_days setting)",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Only report the items that would be removed",
+				},
+				cli.BoolFlag{
+					Name:  "list",
+					Usage: "Also print out the URL of each removed item",
+				},
+			},
+			Action: withConfig(pruneDB),
+		},
+		historyCommand,
+		republishCommand,
+		rebuildCommand,
+	},
+}
+
+// migrateDB applies the pending migrations to the database, or, in dry-run
+// mode, prints them out without applying them.
+func migrateDB(ctx *cli.Context, cfg *config.Config) error {
+	if ctx.Bool("dry-run") {
+		version, pending, err := database.PendingMigrations(
+			cfg.Database.Driver, cfg.Database.DSN,
+		)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf(
+			"Current version: %d, latest version: %d\n",
+			version, database.LatestSchemaVersion(),
+		)
+
+		for _, m := range pending {
+			fmt.Printf("\nVersion %d: %s\n", m.Version, m.Description)
+			for _, statement := range m.Statements {
+				fmt.Printf("\n%s\n", strings.TrimSpace(statement))
+			}
+		}
+
+		return nil
+	}
+
+	applied, err := database.Migrate(cfg.Database.Driver, cfg.Database.DSN)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range applied {
+		fmt.Printf("Applied version %d: %s\n", m.Version, m.Description)
+	}
+
+	fmt.Printf(
+		"The database is up to date (version %d)\n",
+		database.LatestSchemaVersion(),
+	)
+
+	return nil
+}
+
+// pruneDB removes the items which haven't been seen in their feed for longer
+// than the retention period given in the command line, or, if none is given,
+// in the configuration file, or, in dry-run mode, only reports them. Prints out
+// the number of removed and kept items for each feed, and the URL of each
+// removed item if asked to.
+func pruneDB(ctx *cli.Context, cfg *config.Config) error {
+	retention := cfg.Database.Retention()
+	if ctx.IsSet("older-than") {
+		if ctx.Int("older-than") <= 0 {
+			return usageError(ctx, "The retention period must be a positive number of days")
+		}
+
+		retention = time.Duration(ctx.Int("older-than")) * 24 * time.Hour
+	}
+
+	if retention == 0 {
+		return usageError(
+			ctx, "No retention period is configured, please set the database's retention_days setting or use --older-than",
+		)
+	}
+
+	dryRun := ctx.Bool("dry-run")
+
+	var db *database.Database
+	var err error
+	if dryRun {
+		db, err = database.NewDryRunDatabase(cfg.Database.Driver, cfg.Database.DSN)
+	} else {
+		db, err = database.NewDatabase(cfg.Database.Driver, cfg.Database.DSN, true)
+	}
+	if err != nil {
+		return err
+	}
+
+	pruned, err := db.PruneItems(retention, dryRun)
+	if err != nil {
+		return err
+	}
+
+	var removed int
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FEED\tREMOVED\tKEPT")
+	for _, items := range pruned {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", items.Feed, len(items.URLs), items.Kept)
+		removed += len(items.URLs)
+	}
+
+	if err = w.Flush(); err != nil {
+		return err
+	}
+
+	if ctx.Bool("list") {
+		for _, items := range pruned {
+			for _, u := range items.URLs {
+				fmt.Printf("%s %s\n", items.Feed, u)
+			}
+		}
+	}
+
+	if dryRun {
+		fmt.Printf("%d item(s) would be removed\n", removed)
+	} else {
+		fmt.Printf("%d item(s) removed\n", removed)
+	}
+
+	return nil
+}
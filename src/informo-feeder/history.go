@@ -0,0 +1,353 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"informo-feeder/config"
+	"informo-feeder/database"
+
+	"github.com/codegangsta/cli"
+)
+
+const (
+	historyFormatTable = "table"
+	historyFormatCSV   = "csv"
+	historyFormatJSON  = "json"
+
+	// historyDateLayout is the layout of the dates accepted by the --since and
+	// --until options, besides RFC 3339.
+	historyDateLayout = "2006-01-02"
+)
+
+// historyCommand lists the events generated from the feeds' items and the
+// outcome of their publication, as recorded in the database.
+var historyCommand = cli.Command{
+	Name:  "history",
+	Usage: "List the events generated from the feeds' items and the outcome of their publication, the most recent first",
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "feed",
+			Usage: "Only list the events generated from this feed (can be repeated)",
+		},
+		cli.StringFlag{
+			Name:  "network",
+			Usage: "Only list the events published into this network profile",
+		},
+		cli.StringFlag{
+			Name:  "item",
+			Usage: "Only list the events generated from the item with this URL",
+		},
+		cli.StringFlag{
+			Name:  "outcome",
+			Usage: "Only list the events with this outcome (pending, retrying, published or failed)",
+		},
+		cli.StringFlag{
+			Name:  "since",
+			Usage: "Only list the events enqueued at or after this date (YYYY-MM-DD in UTC, or RFC 3339)",
+		},
+		cli.StringFlag{
+			Name:  "until",
+			Usage: "Only list the events enqueued before this date (YYYY-MM-DD in UTC, or RFC 3339)",
+		},
+		cli.IntFlag{
+			Name:  "limit",
+			Usage: "Maximum number of events to list (default: all)",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Value: historyFormatTable,
+			Usage: "Output format: table, csv or json (one JSON object per line)",
+		},
+		cli.StringFlag{
+			Name:  "output",
+			Usage: "Write the events to this file instead of printing them out",
+		},
+	},
+	Action: withConfig(history),
+}
+
+// republishCommand makes the publisher try again to publish the events it gave
+// up on.
+var republishCommand = cli.Command{
+	Name:      "republish",
+	Usage:     "Try again to publish the events the feeder gave up on for the given feeds (default: all feeds), along with the events held back by them",
+	ArgsUsage: "[identifier...]",
+	Action:    withConfig(republish),
+}
+
+// historyEntry is an event of the history as it is exported, with its times
+// formatted as RFC 3339 dates.
+type historyEntry struct {
+	ID          int64  `json:"id"`
+	Feed        string `json:"feed"`
+	ItemURL     string `json:"item_url"`
+	Headline    string `json:"headline"`
+	Network     string `json:"network"`
+	RoomID      string `json:"room_id"`
+	EventType   string `json:"event_type"`
+	TxnID       string `json:"txn_id"`
+	EventID     string `json:"event_id,omitempty"`
+	KeyID       string `json:"key_id,omitempty"`
+	Signature   string `json:"signature,omitempty"`
+	ContentHash string `json:"content_hash,omitempty"`
+	Sequence    int64  `json:"sequence,omitempty"`
+	EnqueuedAt  string `json:"enqueued_at"`
+	PublishedAt string `json:"published_at,omitempty"`
+	Attempts    int    `json:"attempts"`
+	LastError   string `json:"last_error,omitempty"`
+	Outcome     string `json:"outcome"`
+}
+
+// historyCSVHeader is the first line of the history exported as CSV, in the
+// order of historyEntry.csvRecord.
+var historyCSVHeader = []string{
+	"id", "feed", "item_url", "headline", "network", "room_id", "event_type",
+	"txn_id", "event_id", "key_id", "signature", "content_hash", "sequence",
+	"enqueued_at", "published_at", "attempts", "last_error", "outcome",
+}
+
+// newHistoryEntry converts an event of the history into the form it is
+// exported in.
+func newHistoryEntry(i database.PublishedItem) historyEntry {
+	return historyEntry{
+		ID:          i.ID,
+		Feed:        i.Feed,
+		ItemURL:     i.ItemURL,
+		Headline:    i.Headline,
+		Network:     i.Network,
+		RoomID:      i.RoomID,
+		EventType:   i.EventType,
+		TxnID:       i.TxnID,
+		EventID:     i.EventID,
+		KeyID:       i.KeyID,
+		Signature:   i.Signature,
+		ContentHash: i.ContentHash,
+		Sequence:    i.Sequence,
+		EnqueuedAt:  formatMs(i.EnqueuedAt),
+		PublishedAt: formatMs(i.PublishedAt),
+		Attempts:    i.Attempts,
+		LastError:   i.LastError,
+		Outcome:     i.Outcome,
+	}
+}
+
+// csvRecord returns the fields of the entry as a CSV record.
+func (e historyEntry) csvRecord() []string {
+	return []string{
+		strconv.FormatInt(e.ID, 10), e.Feed, e.ItemURL, e.Headline, e.Network,
+		e.RoomID, e.EventType, e.TxnID, e.EventID, e.KeyID, e.Signature,
+		e.ContentHash, strconv.FormatInt(e.Sequence, 10), e.EnqueuedAt,
+		e.PublishedAt, strconv.Itoa(e.Attempts), e.LastError, e.Outcome,
+	}
+}
+
+// history lists the events of the history matching the filters given in the
+// command line, in the given format, either to the standard output or to the
+// given file.
+func history(ctx *cli.Context, cfg *config.Config) (err error) {
+	filter := database.HistoryFilter{
+		Feeds:   ctx.StringSlice("feed"),
+		Network: ctx.String("network"),
+		ItemURL: ctx.String("item"),
+		Outcome: ctx.String("outcome"),
+		Limit:   ctx.Int("limit"),
+	}
+
+	switch filter.Outcome {
+	case "", database.OutcomePending, database.OutcomeRetrying,
+		database.OutcomePublished, database.OutcomeFailed:
+	default:
+		return usageError(ctx, fmt.Sprintf(
+			"Unknown outcome '%s', must be one of %s, %s, %s or %s",
+			filter.Outcome, database.OutcomePending, database.OutcomeRetrying,
+			database.OutcomePublished, database.OutcomeFailed,
+		))
+	}
+
+	if filter.Since, err = parseHistoryDate(ctx.String("since")); err != nil {
+		return usageError(ctx, err.Error())
+	}
+
+	if filter.Until, err = parseHistoryDate(ctx.String("until")); err != nil {
+		return usageError(ctx, err.Error())
+	}
+
+	format := ctx.String("format")
+	switch format {
+	case historyFormatTable, historyFormatCSV, historyFormatJSON:
+	default:
+		return usageError(ctx, fmt.Sprintf(
+			"Unknown format '%s', must be one of %s, %s or %s", format,
+			historyFormatTable, historyFormatCSV, historyFormatJSON,
+		))
+	}
+
+	db, err := database.NewDatabase(cfg.Database.Driver, cfg.Database.DSN, false)
+	if err != nil {
+		return
+	}
+
+	items, err := db.GetHistory(filter)
+	if err != nil {
+		return
+	}
+
+	output := os.Stdout
+	if path := ctx.String("output"); len(path) > 0 {
+		if output, err = os.Create(path); err != nil {
+			return
+		}
+		defer output.Close()
+	}
+
+	switch format {
+	case historyFormatCSV:
+		return writeHistoryCSV(output, items)
+	case historyFormatJSON:
+		return writeHistoryJSON(output, items)
+	default:
+		return writeHistoryTable(output, items)
+	}
+}
+
+// republish resets the abandoned events of the feeds given in the command line
+// (or of all feeds if none is given), so the publisher tries again to publish
+// them, then prints out the number of republished events for each feed. A
+// running feeder picks them up the next time it looks at the outbox.
+func republish(ctx *cli.Context, cfg *config.Config) error {
+	feeds, err := selectFeeds(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	db, err := database.NewDatabase(cfg.Database.Driver, cfg.Database.DSN, true)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FEED\tREPUBLISHED")
+	for _, feed := range feeds {
+		count, err := db.RepublishEvents(feed.Identifier)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "%s\t%d\n", feed.Identifier, count)
+		total += count
+	}
+
+	if err = w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("%d event(s) republished\n", total)
+
+	return nil
+}
+
+// writeHistoryTable writes the given events of the history out as a table
+// meant to be read by humans.
+// Returns an error if writing failed.
+func writeHistoryTable(output io.Writer, items []database.PublishedItem) error {
+	w := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ENQUEUED\tPUBLISHED\tFEED\tNETWORK\tOUTCOME\tEVENT ID\tHEADLINE")
+	for _, i := range items {
+		published, eventID := "-", "-"
+		if i.PublishedAt > 0 {
+			published, eventID = formatMs(i.PublishedAt), i.EventID
+		}
+
+		fmt.Fprintf(
+			w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", formatMs(i.EnqueuedAt),
+			published, i.Feed, i.Network, i.Outcome, eventID, i.Headline,
+		)
+	}
+
+	return w.Flush()
+}
+
+// writeHistoryCSV writes the given events of the history out as CSV, with a
+// header line.
+// Returns an error if writing failed.
+func writeHistoryCSV(output io.Writer, items []database.PublishedItem) error {
+	w := csv.NewWriter(output)
+	if err := w.Write(historyCSVHeader); err != nil {
+		return err
+	}
+
+	for _, i := range items {
+		if err := w.Write(newHistoryEntry(i).csvRecord()); err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+// writeHistoryJSON writes the given events of the history out as JSON lines.
+// Returns an error if writing failed.
+func writeHistoryJSON(output io.Writer, items []database.PublishedItem) error {
+	encoder := json.NewEncoder(output)
+	for _, i := range items {
+		if err := encoder.Encode(newHistoryEntry(i)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseHistoryDate parses a date given to the --since or --until options, and
+// returns it as a timestamp in milliseconds, or 0 if the date is empty.
+// Returns an error if the date is neither a YYYY-MM-DD date nor a RFC 3339 one.
+func parseHistoryDate(date string) (int64, error) {
+	if len(date) == 0 {
+		return 0, nil
+	}
+
+	t, err := time.Parse(historyDateLayout, date)
+	if err != nil {
+		if t, err = time.Parse(time.RFC3339, date); err != nil {
+			return 0, fmt.Errorf(
+				"Invalid date '%s', must be either YYYY-MM-DD or RFC 3339", date,
+			)
+		}
+	}
+
+	return t.UnixNano() / int64(time.Millisecond), nil
+}
+
+// formatMs formats a timestamp in milliseconds as a RFC 3339 date in UTC, or
+// returns an empty string if the timestamp is 0.
+func formatMs(ms int64) string {
+	if ms == 0 {
+		return ""
+	}
+
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+}
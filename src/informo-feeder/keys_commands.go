@@ -0,0 +1,497 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"informo-feeder/config"
+	"informo-feeder/database"
+	"informo-feeder/matrix"
+	"informo-feeder/sources"
+
+	"github.com/codegangsta/cli"
+	"github.com/sirupsen/logrus"
+)
+
+var keysCommand = cli.Command{
+	Name:  "keys",
+	Usage: "Manage the sources' keys",
+	Subcommands: []cli.Command{
+		{
+			Name:      "list",
+			Usage:     "List the keys of the given sources (default: all sources), or the errors encountered while loading them",
+			ArgsUsage: "[identifier...]",
+			Action:    withKeys(listKeys),
+		},
+		{
+			Name:      "generate",
+			Usage:     "Generate the first key of a source",
+			ArgsUsage: "<identifier>",
+			Action:    withKeys(generateKey),
+		},
+		{
+			Name:      "show",
+			Usage:     "Print out the public key of a source and its fingerprint (default: the active key)",
+			ArgsUsage: "<identifier>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "key",
+					Usage: "ID of the key to show (default: the active key)",
+				},
+			},
+			Action: withKeys(showKey),
+		},
+		{
+			Name:      "export",
+			Usage:     "Print out or write to a file the PEM file of a source's key, or its public key (default: the active key)",
+			ArgsUsage: "<identifier>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "key",
+					Usage: "ID of the key to export (default: the active key)",
+				},
+				cli.BoolFlag{
+					Name:  "public",
+					Usage: "Only export the public key",
+				},
+				cli.StringFlag{
+					Name:  "output",
+					Usage: "Write the key to this file instead of printing it out",
+				},
+			},
+			Action: withKeys(exportKey),
+		},
+		{
+			Name:      "import",
+			Usage:     "Validate the key stored in a PEM file and add it to the keys of a source",
+			ArgsUsage: "<identifier> <path>",
+			Action:    withKeys(importKey),
+		},
+		{
+			Name:      "delete",
+			Usage:     "Delete a key of a source",
+			ArgsUsage: "<identifier> <key ID>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "Delete the key even if it's the one currently used to sign the source's news",
+				},
+			},
+			Action: withKeys(deleteKey),
+		},
+		{
+			Name:      "rotate",
+			Usage:     "Generate a new key for a source and a key transition statement signed with its current key",
+			ArgsUsage: "<identifier>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "valid-from",
+					Usage: "Time (RFC 3339) from which the new key is used to sign news (default: now)",
+				},
+				cli.DurationFlag{
+					Name:  "overlap",
+					Value: 7 * 24 * time.Hour,
+					Usage: "Time during which the current key stays valid after the new key starts being used",
+				},
+				cli.StringFlag{
+					Name:  "output",
+					Usage: "Write the key transition statement to this file instead of printing it out",
+				},
+				cli.BoolFlag{
+					Name:  "send",
+					Usage: "Send the key transition statement into the rooms of the network profiles the source publishes into",
+				},
+			},
+			Action: withKeys(rotateKey),
+		},
+		{
+			Name:      "encrypt",
+			Usage:     "Encrypt the keys stored in plain text with the passphrase (default: the keys of all sources)",
+			ArgsUsage: "[identifier...]",
+			Action:    withKeys(encryptKeys),
+		},
+	},
+}
+
+// withKeys returns an action loading the configuration file given in the
+// command line, then running the given function with it if the keys are
+// stored in the keys directory, since they can only be managed where they're
+// stored.
+func withKeys(
+	action func(ctx *cli.Context, cfg *config.Config) error,
+) cli.ActionFunc {
+	return withConfig(func(ctx *cli.Context, cfg *config.Config) error {
+		if len(cfg.Keys.Agent) > 0 {
+			return cli.NewExitError(
+				"The keys are held by the signing agent, please run this command on the agent's host with a configuration that doesn't use the agent",
+				exitUsage,
+			)
+		}
+
+		return action(ctx, cfg)
+	})
+}
+
+// rotateKey generates a new key for the source which identifier is given,
+// limits the validity of its current key, and builds the key transition
+// statement signed with the current key. The statement is either written to a
+// file, printed out, or sent into the rooms of the network profiles the source
+// publishes into.
+func rotateKey(ctx *cli.Context, cfg *config.Config) error {
+	if ctx.NArg() != 1 {
+		return usageError(ctx, "Expected the identifier of a source")
+	}
+
+	identifier := ctx.Args().First()
+	feed, ok := cfg.Feed(identifier)
+	if !ok {
+		return unknownFeed(identifier)
+	}
+
+	validFrom := time.Now()
+	if validFromFlag := ctx.String("valid-from"); len(validFromFlag) > 0 {
+		var err error
+		if validFrom, err = time.Parse(time.RFC3339, validFromFlag); err != nil {
+			return usageError(ctx, err.Error())
+		}
+	}
+
+	// A negative overlap would leave a time during which no key is valid.
+	overlap := ctx.Duration("overlap")
+	if overlap < 0 {
+		return usageError(ctx, "The overlap can't be negative")
+	}
+
+	// The validity of the current key ends once the overlap has passed after
+	// the new key's starts, so it would otherwise end before it starts.
+	if active := cfg.Keys.ActiveKey(identifier); active != nil &&
+		!validFrom.After(active.ValidFrom) {
+		return usageError(ctx, fmt.Sprintf(
+			"The new key's validity must start after the current key's (%s)",
+			active.ValidFrom.Format(time.RFC3339),
+		))
+	}
+
+	oldKey, newKey, err := cfg.GenerateRotationKey(identifier, validFrom, overlap)
+	if err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"identifier": identifier,
+		"oldKeyID":   oldKey.ID,
+		"validUntil": oldKey.ValidUntil.Format(time.RFC3339),
+		"newKeyID":   newKey.ID,
+		"validFrom":  newKey.ValidFrom.Format(time.RFC3339),
+		"path":       newKey.Path,
+	}).Info("Key rotated")
+
+	transition, err := sources.NewKeyTransition(identifier, oldKey, newKey)
+	if err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(transition, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	output := ctx.String("output")
+	send := ctx.Bool("send")
+	if len(output) > 0 {
+		if err = ioutil.WriteFile(output, append(content, '\n'), 0644); err != nil {
+			return err
+		}
+
+		logrus.WithField("path", output).Info("Key transition statement written")
+	} else if !send {
+		fmt.Println(string(content))
+	}
+
+	if !send {
+		return nil
+	}
+
+	db, err := database.NewDatabase(cfg.Database.Driver, cfg.Database.DSN, true)
+	if err != nil {
+		return err
+	}
+
+	pool, err := matrix.NewPool(cfg, db)
+	if err != nil {
+		return err
+	}
+
+	if err = pool.ResolveRooms(); err != nil {
+		return err
+	}
+
+	for _, name := range feed.NetworkNames() {
+		eventID, err := sources.SendKeyTransition(
+			pool.Session(identifier, name), cfg.Networks[name].RoomID, transition,
+		)
+		if err != nil {
+			return err
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"identifier": identifier,
+			"network":    name,
+			"eventID":    eventID,
+		}).Info("Key transition statement sent")
+	}
+
+	return nil
+}
+
+// encryptKeys encrypts the keys of the given sources (or of all the sources)
+// that are stored in plain text, with the passphrase.
+func encryptKeys(ctx *cli.Context, cfg *config.Config) error {
+	count, err := cfg.EncryptKeys(ctx.Args())
+	if err != nil {
+		return err
+	}
+
+	logrus.WithField("keys", count).Info("Keys encrypted")
+	return nil
+}
+
+// listKeys prints out the keys of the given sources (or of all the sources),
+// along with their validity period and whether they're encrypted, or the error
+// encountered while loading them.
+func listKeys(ctx *cli.Context, cfg *config.Config) error {
+	identifiers := []string(ctx.Args())
+	if len(identifiers) == 0 {
+		for _, feed := range cfg.Feeds {
+			identifiers = append(identifiers, feed.Identifier)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, identifier := range identifiers {
+		if _, ok := cfg.Feed(identifier); !ok {
+			return unknownFeed(identifier)
+		}
+
+		if err, ok := cfg.Keys.LoadErrors[identifier]; ok {
+			fmt.Fprintf(w, "%s\terror: %v\n", identifier, err)
+			continue
+		}
+
+		active := cfg.Keys.ActiveKey(identifier)
+		for _, key := range cfg.Keys.Sources[identifier] {
+			status := ""
+			if key == active {
+				status = "active"
+			}
+
+			storage := "plain"
+			if key.Encrypted {
+				storage = "encrypted"
+			}
+
+			fmt.Fprintf(
+				w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", identifier, key.ID,
+				formatValidity(key.ValidFrom), formatValidity(key.ValidUntil),
+				status, storage, key.Path,
+			)
+		}
+	}
+
+	return w.Flush()
+}
+
+// generateKey generates the first key of the source which identifier is given.
+func generateKey(ctx *cli.Context, cfg *config.Config) error {
+	if ctx.NArg() != 1 {
+		return usageError(ctx, "Expected the identifier of a source")
+	}
+
+	identifier := ctx.Args().First()
+	if _, ok := cfg.Feed(identifier); !ok {
+		return unknownFeed(identifier)
+	}
+
+	key, err := cfg.Keys.Generate(identifier)
+	if err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"identifier": identifier,
+		"keyID":      key.ID,
+		"path":       key.Path,
+	}).Info("Key generated")
+
+	return nil
+}
+
+// showKey prints out the ID, the public key and the fingerprint of a key of
+// the source which identifier is given.
+func showKey(ctx *cli.Context, cfg *config.Config) error {
+	if ctx.NArg() != 1 {
+		return usageError(ctx, "Expected the identifier of a source")
+	}
+
+	key, err := sourceKey(cfg, ctx.Args().First(), ctx.String("key"))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Key ID:      %s\n", key.ID)
+	fmt.Printf("Public key:  %s\n", base64.StdEncoding.EncodeToString(key.PublicKey))
+	fmt.Printf("Fingerprint: %s\n", config.Fingerprint(key.PublicKey))
+	fmt.Printf("Valid from:  %s\n", formatValidity(key.ValidFrom))
+	fmt.Printf("Valid until: %s\n", formatValidity(key.ValidUntil))
+
+	return nil
+}
+
+// exportKey prints out or writes to a file the PEM file a key of the source
+// which identifier is given is stored in, as is (i.e. encrypted if it is), or
+// its public key as a PEM block.
+func exportKey(ctx *cli.Context, cfg *config.Config) error {
+	if ctx.NArg() != 1 {
+		return usageError(ctx, "Expected the identifier of a source")
+	}
+
+	key, err := sourceKey(cfg, ctx.Args().First(), ctx.String("key"))
+	if err != nil {
+		return err
+	}
+
+	var content []byte
+	var mode os.FileMode = 0600
+	if ctx.Bool("public") {
+		content = config.PublicKeyPEM(key)
+		mode = 0644
+	} else if content, err = ioutil.ReadFile(key.Path); err != nil {
+		return err
+	}
+
+	output := ctx.String("output")
+	if len(output) == 0 {
+		fmt.Print(string(content))
+		return nil
+	}
+
+	if err = ioutil.WriteFile(output, content, mode); err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"keyID": key.ID,
+		"path":  output,
+	}).Info("Key exported")
+
+	return nil
+}
+
+// importKey adds the key stored in the given PEM file to the keys of the source
+// which identifier is given.
+func importKey(ctx *cli.Context, cfg *config.Config) error {
+	if ctx.NArg() != 2 {
+		return usageError(ctx, "Expected the identifier of a source and the path of a PEM file")
+	}
+
+	identifier := ctx.Args().First()
+	if _, ok := cfg.Feed(identifier); !ok {
+		return unknownFeed(identifier)
+	}
+
+	key, err := cfg.Keys.Import(identifier, ctx.Args().Get(1))
+	if err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"identifier": identifier,
+		"keyID":      key.ID,
+		"path":       key.Path,
+	}).Info("Key imported")
+
+	return nil
+}
+
+// deleteKey deletes a key of the source which identifier is given.
+func deleteKey(ctx *cli.Context, cfg *config.Config) error {
+	if ctx.NArg() != 2 {
+		return usageError(ctx, "Expected the identifier of a source and a key ID")
+	}
+
+	identifier, keyID := ctx.Args().First(), ctx.Args().Get(1)
+	if _, ok := cfg.Feed(identifier); !ok {
+		return unknownFeed(identifier)
+	}
+
+	if err := cfg.Keys.Delete(identifier, keyID, ctx.Bool("force")); err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"identifier": identifier,
+		"keyID":      keyID,
+	}).Info("Key deleted")
+
+	return nil
+}
+
+// sourceKey returns the key of the source which identifier is given with the
+// given ID, or its active key if the ID is empty.
+// Returns an error if the feed doesn't exist, if its keys couldn't be loaded,
+// or if the key can't be found.
+func sourceKey(
+	cfg *config.Config, identifier string, keyID string,
+) (*config.SourceKey, error) {
+	if _, ok := cfg.Feed(identifier); !ok {
+		return nil, unknownFeed(identifier)
+	}
+
+	if err, ok := cfg.Keys.LoadErrors[identifier]; ok {
+		return nil, err
+	}
+
+	var key *config.SourceKey
+	if len(keyID) > 0 {
+		key = cfg.Keys.Key(identifier, keyID)
+	} else {
+		key = cfg.Keys.ActiveKey(identifier)
+	}
+
+	if key == nil {
+		return nil, errors.New("Source " + identifier + " has no such key")
+	}
+
+	return key, nil
+}
+
+// formatValidity formats one of the bounds of a key's validity period, which
+// is unbounded if the time is zero.
+func formatValidity(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+
+	return t.Format(time.RFC3339)
+}
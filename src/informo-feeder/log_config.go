@@ -28,8 +28,8 @@ func (f utcFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 	return f.Formatter.Format(entry)
 }
 
-func logConfig() error {
-	if *debug || *feedTest {
+func logConfig(debug bool) error {
+	if debug {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
@@ -16,50 +16,698 @@
 package main
 
 import (
-	"flag"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
 
+	"informo-feeder/appservice"
 	"informo-feeder/config"
 	"informo-feeder/database"
+	"informo-feeder/matrix"
 	"informo-feeder/poller"
+	"informo-feeder/publisher"
+	"informo-feeder/signing"
+	"informo-feeder/sources"
 
-	"github.com/matrix-org/gomatrix"
-
+	"github.com/codegangsta/cli"
 	"github.com/sirupsen/logrus"
 )
 
-var (
-	configFile = flag.String("config", "config.yaml", "Configuration file")
-	debug      = flag.Bool("debug", false, "Print debugging messages")
-	feedTest   = flag.Bool("feed-test", false, "Test feed parsing and event generation without sending any actual Matrix event")
+// The exit codes of the feeder's commands, so operators can script them.
+const (
+	// exitFailure is the exit code of a command that failed, or that found
+	// problems in what it checked.
+	exitFailure = 1
+	// exitUsage is the exit code of a command called with invalid arguments.
+	exitUsage = 2
+	// exitConfig is the exit code of a command that couldn't load the
+	// configuration file, or found problems in it.
+	exitConfig = 3
 )
 
+// recordFlag makes the pollers save the raw body of each fetched feed, so it can
+// be replayed later.
+var recordFlag = cli.StringFlag{
+	Name:  "record",
+	Usage: "Save the raw body of each fetched feed into this directory",
+}
+
+var commands = []cli.Command{
+	{
+		Name:   "run",
+		Usage:  "Run the pollers and the publisher (default command)",
+		Flags:  []cli.Flag{recordFlag},
+		Action: withConfig(runFeeder),
+	},
+	pollOnceCommand,
+	{
+		Name:      "test-feed",
+		Usage:     "Poll the given feeds (default: all feeds) once and write out the signed events for their new items as JSON lines, without making any call to Matrix or changing the database",
+		ArgsUsage: "[identifier...]",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "output",
+				Usage: "Write the events to this file instead of printing them out",
+			},
+			cli.StringFlag{
+				Name:  "url",
+				Usage: "Read the feed from this URL instead of the one from the configuration file (file://<path> for a local file, - for the standard input), only if one feed is polled",
+			},
+			recordFlag,
+		},
+		Action: withConfig(testFeed),
+	},
+	{
+		Name:      "generate-registration",
+		Usage:     "Generate the application service's registration file (default path: appservice.yaml)",
+		ArgsUsage: "[path]",
+		Action:    withConfig(generateRegistration),
+	},
+	{
+		Name:      "register-source",
+		Usage:     "Build the signed registration of a source and send it into the network's room, or write it to a file for the network's administrators",
+		ArgsUsage: "<identifier>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "network",
+				Usage: "Network profile to register the source on (default: the first one the source publishes into)",
+			},
+			cli.BoolFlag{
+				Name:  "state",
+				Usage: "Send the registration as a state event instead of a proposal (requires the appropriate power level)",
+			},
+			cli.StringFlag{
+				Name:  "output",
+				Usage: "Write the registration to this file instead of sending it",
+			},
+		},
+		Action: withConfig(registerSource),
+	},
+	keysCommand,
+	dbCommand,
+	{
+		Name:      "verify",
+		Usage:     "Check the signatures of the events published into a network's room against the sources' keys (default: all sources)",
+		ArgsUsage: "[identifier...]",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "network",
+				Usage: "Network profile to verify the events of (default: the first one each source publishes into)",
+			},
+			cli.IntFlag{
+				Name:  "limit",
+				Usage: "Maximum number of events to verify per source (default: all)",
+			},
+			cli.BoolFlag{
+				Name:  "all",
+				Usage: "Also print out the valid events",
+			},
+		},
+		Action: withConfig(verify),
+	},
+	{
+		Name:  "config",
+		Usage: "Manage the configuration file",
+		Subcommands: []cli.Command{
+			{
+				Name:   "check",
+				Usage:  "Load the configuration file and check that each source has a usable key",
+				Action: withConfig(checkConfig),
+			},
+		},
+	},
+}
+
 func main() {
-	flag.Parse()
+	app := cli.NewApp()
+	app.Name = "informo-feeder"
+	app.Usage = "Publish news from RSS/Atom feeds into the Informo network"
+	app.HideVersion = true
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "config",
+			Value: "config.yaml",
+			Usage: "Configuration file",
+		},
+		cli.BoolFlag{
+			Name:  "debug",
+			Usage: "Print debugging messages",
+		},
+		// Kept for compatibility with the previous versions of the feeder.
+		cli.BoolFlag{
+			Name:   "feed-test",
+			Usage:  "Same as the test-feed command",
+			Hidden: true,
+		},
+	}
+	app.Before = func(ctx *cli.Context) error {
+		return logConfig(ctx.GlobalBool("debug"))
+	}
+	app.Action = func(ctx *cli.Context) error {
+		// Anything left once the global flags are parsed is a command the
+		// cli package didn't recognise.
+		if ctx.NArg() > 0 {
+			return usageError(ctx, "Unknown command "+ctx.Args().First())
+		}
 
-	logConfig()
+		if ctx.GlobalBool("feed-test") {
+			return withConfig(testFeed)(ctx)
+		}
 
-	cfg, err := config.Load(*configFile)
-	if err != nil {
-		logrus.Panic(err)
+		return withConfig(runFeeder)(ctx)
+	}
+	app.OnUsageError = onUsageError
+	app.Commands = commands
+	setOnUsageError(app.Commands)
+
+	// Errors with an exit code are handled by the cli package.
+	if err := app.Run(os.Args); err != nil {
+		logrus.Error(err)
+		os.Exit(exitFailure)
+	}
+}
+
+// withConfig returns an action loading the configuration file given in the
+// command line, then running the given function with it.
+func withConfig(
+	action func(ctx *cli.Context, cfg *config.Config) error,
+) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		cfg, err := config.Load(ctx.GlobalString("config"))
+		if err != nil {
+			return cli.NewExitError(
+				fmt.Sprintf("Couldn't load the configuration file: %v", err),
+				exitConfig,
+			)
+		}
+
+		return action(ctx, cfg)
+	}
+}
+
+// setOnUsageError sets the handler of the usage errors of the given commands
+// and of their subcommands.
+func setOnUsageError(cmds []cli.Command) {
+	for i := range cmds {
+		cmds[i].OnUsageError = onUsageError
+		setOnUsageError(cmds[i].Subcommands)
+	}
+}
+
+// onUsageError prints out the help of the command which flags couldn't be
+// parsed, and makes the feeder exit with the usage exit code.
+func onUsageError(ctx *cli.Context, err error, isSubcommand bool) error {
+	if len(ctx.Command.Name) > 0 {
+		cli.ShowCommandHelp(ctx, ctx.Command.Name)
+	} else {
+		cli.ShowAppHelp(ctx)
 	}
 
-	db, err := database.NewDatabase(cfg.Database.Path)
+	return cli.NewExitError(err.Error(), exitUsage)
+}
+
+// usageError prints out the help of the current command, and returns an error
+// with the given message making the feeder exit with the usage exit code.
+func usageError(ctx *cli.Context, msg string) error {
+	cli.ShowCommandHelp(ctx, ctx.Command.Name)
+	return cli.NewExitError(msg, exitUsage)
+}
+
+// unknownFeed returns an error making the feeder exit with the usage exit code
+// because the given identifier doesn't match any feed.
+func unknownFeed(identifier string) error {
+	return cli.NewExitError(fmt.Sprintf("Unknown feed %s", identifier), exitUsage)
+}
+
+// selectFeeds returns the feeds which identifiers are given in the command
+// line, or all the feeds if none is given.
+// Returns an error if an identifier doesn't match any feed.
+func selectFeeds(ctx *cli.Context, cfg *config.Config) ([]config.Feed, error) {
+	if ctx.NArg() == 0 {
+		return cfg.Feeds, nil
+	}
+
+	var feeds []config.Feed
+	for _, identifier := range ctx.Args() {
+		feed, ok := cfg.Feed(identifier)
+		if !ok {
+			return nil, unknownFeed(identifier)
+		}
+
+		feeds = append(feeds, feed)
+	}
+
+	return feeds, nil
+}
+
+// runFeeder runs the pollers and the publisher.
+func runFeeder(ctx *cli.Context, cfg *config.Config) error {
+	return run(cfg, ctx.String("record"))
+}
+
+// testFeed polls the feeds given in the command line (or all feeds if none is
+// given) once in dry-run mode, and writes the events it would send to the
+// standard output or to the file given in the command line.
+func testFeed(ctx *cli.Context, cfg *config.Config) (err error) {
+	feeds, err := selectFeeds(ctx, cfg)
 	if err != nil {
-		logrus.Panic(err)
+		return
 	}
 
-	client, err := gomatrix.NewClient(
-		cfg.Matrix.Homeserver, cfg.Matrix.MXID, cfg.Matrix.AccessToken,
-	)
+	if url := ctx.String("url"); len(url) > 0 {
+		if len(feeds) != 1 {
+			return usageError(ctx, "The --url option can only be used when polling one feed")
+		}
+
+		feeds[0].URL = url
+	}
+
+	output := os.Stdout
+	if path := ctx.String("output"); len(path) > 0 {
+		if output, err = os.Create(path); err != nil {
+			return
+		}
+		defer output.Close()
+	}
+
+	return dryRun(cfg, feeds, output, ctx.String("record"))
+}
+
+// run runs the pollers, the publisher and the pruning of the items retrieved
+// from the feeds, and, if the application service mode is enabled, the
+// application service's HTTP server. If recordDir isn't empty,
+// the raw body of each fetched feed is saved into it. Only returns if the
+// feeder couldn't start.
+func run(cfg *config.Config, recordDir string) (err error) {
+	db, pool, err := connect(cfg)
 	if err != nil {
-		logrus.Panic(err)
+		return
 	}
 
-	p := poller.NewPoller(db, client, cfg, *feedTest)
+	// Check that the feeder is authorised to publish each source before
+	// starting to poll, then keep checking periodically.
+	signer := newSigner(cfg)
+
+	authoriser := sources.NewAuthoriser(cfg, pool, signer)
+	authoriser.Check()
+	go authoriser.Start()
+
+	pub := publisher.NewPublisher(db, pool)
+	go pub.Start()
+	logrus.Info("Publisher started")
+
+	p := poller.NewPoller(db, pool, pub, authoriser, signer, cfg, nil)
+	p.Record(recordDir)
+	go p.StartPruning()
+
+	started := 0
 	for _, feed := range cfg.Feeds {
+		// The standard input can only be read once.
+		if feed.URL == poller.StdinURL {
+			logrus.WithField("identifier", feed.Identifier).Error(
+				"Not starting the poller, feeds read from the standard input can only be polled with the poll-once and test-feed commands",
+			)
+			continue
+		}
+
+		// Refuse to start polling a feed we can't sign the news of, rather
+		// than publishing news nobody can verify.
+		if _, err = signing.ActiveKey(signer, feed.Identifier); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"identifier": feed.Identifier,
+				"feedURL":    feed.URL,
+			}).Errorf("Not starting the poller, no usable key: %v", err)
+			continue
+		}
+
 		go p.StartPolling(feed)
+		started++
 		logrus.WithField("feedURL", feed.URL).Info("Poller started")
 	}
 
+	if started == 0 {
+		return cli.NewExitError(
+			"No feed could be started, please check the errors above (the sources' keys can be checked using the 'keys list' command)",
+			exitConfig,
+		)
+	}
+
 	select {}
 }
+
+// connect opens the database and the Matrix sessions, checks the sessions'
+// access tokens, resolves the rooms' aliases and joins the rooms if needed. If
+// the application service mode is enabled, starts the application service's
+// HTTP server first.
+// Returns an error if any of these steps failed.
+func connect(
+	cfg *config.Config,
+) (db *database.Database, pool *matrix.Pool, err error) {
+	if cfg.AppService.Enabled {
+		if err = cfg.AppService.CheckTokens(); err != nil {
+			return
+		}
+
+		// Start the HTTP server first, since the homeserver may need to query
+		// it while registering the virtual users.
+		go func() {
+			logrus.Panic(appservice.NewServer(cfg).ListenAndServe())
+		}()
+	}
+
+	if db, err = database.NewDatabase(cfg.Database.Driver, cfg.Database.DSN, true); err != nil {
+		return
+	}
+
+	if pool, err = matrix.NewPool(cfg, db); err != nil {
+		return
+	}
+
+	// Make sure the access tokens are valid and belong to the right accounts
+	// before doing anything.
+	if err = pool.CheckWhoAmI(); err != nil {
+		return
+	}
+
+	if err = pool.ResolveRooms(); err != nil {
+		return
+	}
+
+	err = pool.JoinRooms()
+	return
+}
+
+// dryRun polls the given feeds once without making any call to Matrix or
+// changing the database, and writes the events it would send to the given
+// writer as JSON lines. Since room aliases can't be resolved without asking the
+// homeserver, they're used in place of the rooms' IDs. If recordDir isn't
+// empty, the raw body of each fetched feed is saved into it.
+// Works on a copy of the database (see database.NewDryRunDatabase), so it can
+// be used before the database is created or migrated.
+// Returns an error if the database couldn't be opened or copied, or if a feed
+// couldn't be polled or its news signed.
+func dryRun(
+	cfg *config.Config, feeds []config.Feed, output io.Writer, recordDir string,
+) (err error) {
+	db, err := database.NewDryRunDatabase(cfg.Database.Driver, cfg.Database.DSN)
+	if err != nil {
+		return
+	}
+
+	for _, network := range cfg.Networks {
+		if len(network.RoomID) == 0 {
+			network.RoomID = network.Room
+		}
+	}
+
+	signer := newSigner(cfg)
+	p := poller.NewPoller(db, nil, nil, nil, signer, cfg, output)
+	p.Record(recordDir)
+
+	var failed bool
+	for _, feed := range feeds {
+		if _, err = signing.ActiveKey(signer, feed.Identifier); err == nil {
+			_, err = p.Poll(feed)
+		}
+
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"identifier": feed.Identifier,
+				"feedURL":    feed.URL,
+			}).Error(err)
+			failed = true
+		}
+	}
+
+	if failed {
+		return cli.NewExitError("", exitFailure)
+	}
+
+	return nil
+}
+
+// newSigner returns the signer to sign the sources' content with, i.e. either
+// the signing agent if one is configured, or the keys loaded from the keys
+// directory.
+func newSigner(cfg *config.Config) signing.Signer {
+	if len(cfg.Keys.Agent) > 0 {
+		return signing.NewAgentSigner(cfg.Keys.Agent)
+	}
+
+	return signing.NewLocalSigner(&cfg.Keys)
+}
+
+// checkConfig checks that each source has a key which can be used to sign its
+// news, either loaded from the keys directory or held by the signing agent,
+// and prints out a report. Exits with the configuration exit code if any source
+// hasn't. The rest of the configuration file has already been checked while
+// loading it.
+func checkConfig(ctx *cli.Context, cfg *config.Config) error {
+	signer := newSigner(cfg)
+
+	var failed bool
+	for _, feed := range cfg.Feeds {
+		key, err := signing.ActiveKey(signer, feed.Identifier)
+		if err != nil {
+			fmt.Printf("%s\terror: %v\n", feed.Identifier, err)
+			failed = true
+			continue
+		}
+
+		fmt.Printf("%s\tok: %s\n", feed.Identifier, key.ID)
+	}
+
+	if failed {
+		return cli.NewExitError("", exitConfig)
+	}
+
+	fmt.Printf("Configuration file %s is valid\n", ctx.GlobalString("config"))
+	return nil
+}
+
+// generateRegistration writes the application service's registration file to
+// the given path (or appservice.yaml if none is given), and prints out the AS
+// and HS tokens if they had to be generated.
+func generateRegistration(ctx *cli.Context, cfg *config.Config) error {
+	if ctx.NArg() > 1 {
+		return usageError(ctx, "Too many arguments")
+	}
+
+	path := "appservice.yaml"
+	if ctx.NArg() > 0 {
+		path = ctx.Args().First()
+	}
+
+	missingTokens := cfg.AppService.CheckTokens() != nil
+
+	if err := appservice.WriteRegistration(&cfg.AppService, path); err != nil {
+		return err
+	}
+
+	logrus.WithField("path", path).Info("Registration file generated")
+
+	if missingTokens {
+		msg := "\n\n"
+		msg = msg + "The following tokens have been generated and written into the"
+		msg = msg + " registration file. Please add them to the application service"
+		msg = msg + " settings in your configuration file:\n"
+		msg = msg + "as_token: %s\n"
+		msg = msg + "hs_token: %s\n"
+		msg = msg + "\n\n"
+
+		fmt.Printf(msg, cfg.AppService.ASToken, cfg.AppService.HSToken)
+	}
+
+	return nil
+}
+
+// registerSource builds the signed registration payload of the source which
+// identifier is given, and either writes it to a file or sends it into the room
+// of one of the network profiles the source publishes into (the first one if
+// none is specified), as a proposal or, with -state, as a state event.
+func registerSource(ctx *cli.Context, cfg *config.Config) error {
+	if ctx.NArg() != 1 {
+		return usageError(ctx, "Expected the identifier of a source")
+	}
+
+	identifier := ctx.Args().First()
+	feed, ok := cfg.Feed(identifier)
+	if !ok {
+		return unknownFeed(identifier)
+	}
+
+	networkName := ctx.String("network")
+	if len(networkName) == 0 {
+		networkName = feed.NetworkNames()[0]
+	}
+
+	db, err := database.NewDatabase(cfg.Database.Driver, cfg.Database.DSN, true)
+	if err != nil {
+		return err
+	}
+
+	pool, err := matrix.NewPool(cfg, db)
+	if err != nil {
+		return err
+	}
+
+	session := pool.Session(identifier, networkName)
+	if session == nil {
+		return cli.NewExitError(fmt.Sprintf(
+			"Feed %s doesn't publish into network profile %s",
+			identifier, networkName,
+		), exitUsage)
+	}
+
+	network := cfg.Networks[networkName]
+	reg, err := sources.NewRegistration(
+		cfg, newSigner(cfg), session, network, identifier,
+	)
+	if err != nil {
+		return err
+	}
+
+	if output := ctx.String("output"); len(output) > 0 {
+		content, err := json.MarshalIndent(reg, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		if err = ioutil.WriteFile(output, append(content, '\n'), 0644); err != nil {
+			return err
+		}
+
+		logrus.WithField("path", output).Info("Source registration written")
+		return nil
+	}
+
+	if err = pool.ResolveRooms(); err != nil {
+		return err
+	}
+
+	eventID, err := sources.Send(session, network, reg, ctx.Bool("state"))
+	if err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"identifier": identifier,
+		"network":    networkName,
+		"eventID":    eventID,
+	}).Info("Source registration sent")
+
+	return nil
+}
+
+// verify checks the signatures of the news events published into the room of
+// a network profile (the first one each source publishes into if none is
+// specified) for the given sources (or all of them), against the sources'
+// public keys, along with the chain the events form, and prints out a report.
+// Exits with a non-zero status if any event isn't properly signed or if the
+// chain is incomplete or out of order.
+func verify(ctx *cli.Context, cfg *config.Config) error {
+	limit := ctx.Int("limit")
+
+	identifiers := []string(ctx.Args())
+	if len(identifiers) == 0 {
+		for _, feed := range cfg.Feeds {
+			identifiers = append(identifiers, feed.Identifier)
+		}
+	}
+
+	db, err := database.NewDatabase(cfg.Database.Driver, cfg.Database.DSN, true)
+	if err != nil {
+		return err
+	}
+
+	pool, err := matrix.NewPool(cfg, db)
+	if err != nil {
+		return err
+	}
+
+	if err = pool.ResolveRooms(); err != nil {
+		return err
+	}
+
+	signer := newSigner(cfg)
+
+	var failed bool
+	for _, identifier := range identifiers {
+		feed, ok := cfg.Feed(identifier)
+		if !ok {
+			return unknownFeed(identifier)
+		}
+
+		name := ctx.String("network")
+		if len(name) == 0 {
+			name = feed.NetworkNames()[0]
+		}
+
+		session := pool.Session(identifier, name)
+		if session == nil {
+			return cli.NewExitError(fmt.Sprintf(
+				"Feed %s doesn't publish into network profile %s", identifier, name,
+			), exitUsage)
+		}
+
+		keys, err := signer.Keys(identifier)
+		if err != nil {
+			return err
+		}
+
+		network := cfg.Networks[name]
+		verifications, err := sources.Verify(
+			session, network.RoomID, network.EventType(identifier), identifier,
+			keys, limit,
+		)
+		if err != nil {
+			return err
+		}
+
+		counts := make(map[string]int)
+		for _, v := range verifications {
+			counts[v.Status]++
+			if v.Status == sources.StatusValid && !ctx.Bool("all") {
+				continue
+			}
+
+			fmt.Printf(
+				"%s\t%s\t%s\t%s\t%s\n",
+				v.Status, v.EventID, v.Sender,
+				time.Unix(0, v.Timestamp*int64(time.Millisecond)).UTC().Format(time.RFC3339),
+				v.Link,
+			)
+		}
+
+		// The whole history has been checked unless the limit was reached.
+		complete := limit == 0 || len(verifications) < limit
+		problems := sources.CheckChain(verifications, complete)
+		for _, problem := range problems {
+			fmt.Printf(
+				"chain %s\t%s\t%d\t%s\n",
+				problem.Kind, problem.EventID, problem.Sequence, problem.Details,
+			)
+		}
+
+		fmt.Printf(
+			"%s on %s: %d events, %d valid, %d missing, %d invalid, %d foreign, %d replayed, %d chain problems\n",
+			identifier, name, len(verifications), counts[sources.StatusValid],
+			counts[sources.StatusMissing], counts[sources.StatusInvalid],
+			counts[sources.StatusForeign], counts[sources.StatusReplayed],
+			len(problems),
+		)
+
+		if counts[sources.StatusValid] != len(verifications) || len(problems) > 0 {
+			failed = true
+		}
+	}
+
+	if failed {
+		return cli.NewExitError("", exitFailure)
+	}
+
+	return nil
+}
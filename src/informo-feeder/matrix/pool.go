@@ -0,0 +1,214 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package matrix
+
+import (
+	"fmt"
+
+	"informo-feeder/config"
+	"informo-feeder/database"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Pool holds the sessions needed to publish every feed into every network
+// profile it publishes into, with the Matrix account it is published with.
+type Pool struct {
+	cfg *config.Config
+	// sessions maps a key identifying an account on a homeserver (as
+	// returned by sessionKey) to the session for this account.
+	sessions map[string]*Session
+}
+
+type respDirectoryRoom struct {
+	RoomID string `json:"room_id"`
+}
+
+// NewPool instantiates a new Pool, and creates a session for each account
+// needed to publish the configured feeds into the network profiles they
+// publish into.
+// Returns an error if one of the sessions couldn't be created.
+func NewPool(cfg *config.Config, db *database.Database) (*Pool, error) {
+	p := &Pool{
+		cfg:      cfg,
+		sessions: make(map[string]*Session),
+	}
+
+	for _, feed := range cfg.Feeds {
+		for _, name := range feed.NetworkNames() {
+			mxCfg, err := p.matrixConfig(feed.Identifier, name)
+			if err != nil {
+				return nil, err
+			}
+
+			key := sessionKey(mxCfg)
+			if _, ok := p.sessions[key]; ok {
+				continue
+			}
+
+			if p.sessions[key], err = NewSession(mxCfg, db); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// Session returns the session to use to publish the news from a given feed
+// into a given network profile. Returns nil if there's no such session, i.e.
+// if the feed doesn't publish into this network profile.
+func (p *Pool) Session(feedIdentifier string, networkName string) *Session {
+	mxCfg, err := p.matrixConfig(feedIdentifier, networkName)
+	if err != nil {
+		return nil
+	}
+
+	return p.sessions[sessionKey(mxCfg)]
+}
+
+// CheckWhoAmI checks the access token of every session in the pool.
+// Returns an error if the check failed for one of the sessions.
+func (p *Pool) CheckWhoAmI() error {
+	for _, session := range p.sessions {
+		if err := session.CheckWhoAmI(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ResolveRooms fills the room ID of every network profile which room has been
+// specified as an alias, by asking the homeserver of the network profile.
+// Returns an error if an alias couldn't be resolved.
+func (p *Pool) ResolveRooms() error {
+	for name, network := range p.cfg.Networks {
+		if len(network.RoomID) > 0 {
+			continue
+		}
+
+		session := p.sessionForNetwork(name)
+		if session == nil {
+			// No feed publishes into this network profile.
+			continue
+		}
+
+		var resp respDirectoryRoom
+		client := session.Client()
+		if _, err := client.MakeRequest(
+			"GET",
+			client.BuildURL("directory", "room", network.Room),
+			nil, &resp,
+		); err != nil {
+			return fmt.Errorf(
+				"Couldn't resolve room alias %s for network profile %s: %v",
+				network.Room, name, err,
+			)
+		}
+
+		network.RoomID = resp.RoomID
+
+		logrus.WithFields(logrus.Fields{
+			"network": name,
+			"alias":   network.Room,
+			"roomID":  network.RoomID,
+		}).Info("Resolved room alias")
+	}
+
+	return nil
+}
+
+// JoinRooms makes each virtual user of the application service join the rooms
+// of the network profiles it publishes into, since, unlike the accounts from
+// the Matrix settings, they can't have been joined to them beforehand. Does
+// nothing for sessions that aren't application service sessions.
+// Returns an error if a virtual user couldn't join a room.
+func (p *Pool) JoinRooms() error {
+	for _, feed := range p.cfg.Feeds {
+		for _, name := range feed.NetworkNames() {
+			session := p.Session(feed.Identifier, name)
+			if session == nil || !session.cfg.AppService {
+				continue
+			}
+
+			roomID := p.cfg.Networks[name].RoomID
+			if _, err := session.Client().JoinRoom(roomID, "", nil); err != nil {
+				return fmt.Errorf(
+					"%s couldn't join room %s: %v", session.cfg.MXID, roomID, err,
+				)
+			}
+
+			logrus.WithFields(logrus.Fields{
+				"mxid":   session.cfg.MXID,
+				"roomID": roomID,
+			}).Info("Joined room")
+		}
+	}
+
+	return nil
+}
+
+// sessionForNetwork returns any session used to publish into a given network
+// profile, or nil if no feed publishes into it.
+func (p *Pool) sessionForNetwork(networkName string) *Session {
+	for _, feed := range p.cfg.Feeds {
+		for _, name := range feed.NetworkNames() {
+			if name == networkName {
+				return p.Session(feed.Identifier, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// matrixConfig returns the Matrix settings to use to publish the news from a
+// given feed into a given network profile, i.e. the settings of the account
+// the feed is published with, or the settings of the network profile's own
+// account if it uses its own homeserver.
+// Returns an error if the feed, the network profile or its account doesn't
+// exist.
+func (p *Pool) matrixConfig(
+	feedIdentifier string, networkName string,
+) (mxCfg config.MatrixConfig, err error) {
+	if mxCfg, err = p.cfg.AccountFor(feedIdentifier); err != nil {
+		return
+	}
+
+	network, ok := p.cfg.Networks[networkName]
+	if !ok {
+		err = fmt.Errorf("Unknown network profile %s", networkName)
+		return
+	}
+
+	if len(network.Account) > 0 {
+		if mxCfg, ok = p.cfg.Accounts[network.Account]; !ok {
+			err = fmt.Errorf(
+				"Network profile %s references unknown account %s",
+				networkName, network.Account,
+			)
+		}
+	}
+
+	return
+}
+
+// sessionKey returns a key identifying the account described by the given
+// Matrix settings.
+func sessionKey(mxCfg config.MatrixConfig) string {
+	return mxCfg.Homeserver + " " + mxCfg.MXID
+}
@@ -0,0 +1,364 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package matrix
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+
+	"informo-feeder/config"
+	"informo-feeder/database"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/sirupsen/logrus"
+)
+
+// deviceDisplayName is the display name given to the devices created when
+// logging in.
+const deviceDisplayName = "Informo feeder"
+
+var (
+	// ErrCannotRenewToken is returned if the access token has been rejected by
+	// the homeserver but no password has been provided to obtain a new one.
+	ErrCannotRenewToken = errors.New("The access token has been rejected by the homeserver and no password was provided to log in again")
+)
+
+// Session describes an authenticated session on a Matrix homeserver. It holds
+// the Matrix client to use to send requests to the homeserver, and takes care
+// of logging in again with the account's password if the access token gets
+// revoked.
+type Session struct {
+	// client is replaced with a new one when logging in again, instead of
+	// being updated, so a client is never modified once it has been handed out
+	// by Client.
+	client      *gomatrix.Client
+	clientMutex sync.RWMutex
+	cfg         config.MatrixConfig
+	db          *database.Database
+	// mutex prevents several goroutines from logging in again at the same time.
+	mutex sync.Mutex
+	// deviceID is the ID of the device to log in with if none is given in the
+	// configuration file, i.e. the one obtained by the previous login, so
+	// logging in again doesn't create a new device each time.
+	deviceID string
+}
+
+type respWhoAmI struct {
+	UserID string `json:"user_id"`
+}
+
+type reqRegisterAppService struct {
+	Type     string `json:"type"`
+	Username string `json:"username"`
+}
+
+// NewSession instantiates a new Session from the given Matrix settings. If the
+// settings describe a virtual user of the application service, the session
+// sends its requests on behalf of this user. Otherwise, uses the access token
+// stored in the database for this account if there's one (since it can only
+// have been obtained by logging in after the one from the configuration file
+// got rejected), unless the access token from the settings changed since, then
+// the one from the settings. If there's none, logs in with the account's
+// password.
+// Returns an error if the Matrix client couldn't be created or if logging in
+// failed.
+func NewSession(cfg config.MatrixConfig, db *database.Database) (*Session, error) {
+	if cfg.AppService {
+		return newAppServiceSession(cfg, db)
+	}
+
+	stored, err := db.GetSession(cfg.Homeserver, cfg.MXID)
+	if err != nil {
+		return nil, err
+	}
+
+	// A new access token in the configuration file has been set by the
+	// operator after the stored one was obtained, and replaces it.
+	accessToken := stored.AccessToken
+	if len(accessToken) == 0 ||
+		(len(cfg.AccessToken) > 0 && tokenHash(cfg.AccessToken) != stored.ConfigTokenHash) {
+		accessToken = cfg.AccessToken
+	}
+
+	client, err := gomatrix.NewClient(cfg.Homeserver, cfg.MXID, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		client:   client,
+		cfg:      cfg,
+		db:       db,
+		deviceID: stored.DeviceID,
+	}
+
+	if len(accessToken) == 0 {
+		if err = s.login(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Client returns the Matrix client to send requests to the homeserver with.
+// Since logging in again replaces the client, it must be retrieved again before
+// retrying a request after the access token has been renewed.
+func (s *Session) Client() *gomatrix.Client {
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+
+	return s.client
+}
+
+// AccessToken returns the access token the session's client currently sends
+// its requests with.
+func (s *Session) AccessToken() string {
+	return s.Client().AccessToken
+}
+
+// CheckWhoAmI asks the homeserver which account the current access token
+// belongs to, and checks that it matches with the Matrix ID from the
+// configuration file. If the access token is rejected by the homeserver, logs
+// in again (if possible) before checking.
+// Returns an error if the request failed or if the account doesn't match.
+func (s *Session) CheckWhoAmI() (err error) {
+	var resp respWhoAmI
+	for {
+		client := s.Client()
+		accessToken := client.AccessToken
+		_, err = client.MakeRequest(
+			"GET", client.BuildURL("account", "whoami"), nil, &resp,
+		)
+		if err == nil {
+			break
+		}
+
+		if !IsUnknownTokenError(err) {
+			return
+		}
+
+		if err = s.RenewAccessToken(accessToken); err != nil {
+			return
+		}
+	}
+
+	if resp.UserID != s.cfg.MXID {
+		return fmt.Errorf(
+			"The access token belongs to %s instead of %s", resp.UserID, s.cfg.MXID,
+		)
+	}
+
+	logrus.WithField("mxid", resp.UserID).Info("Access token checked")
+
+	return
+}
+
+// RenewAccessToken logs in again with the account's password in order to
+// replace the given access token, which has been rejected by the homeserver. If
+// the access token has already been replaced (e.g. by another goroutine that
+// got the same error), does nothing.
+// Returns ErrCannotRenewToken if no password was provided in the configuration
+// file (which is always the case for virtual users of the application service),
+// or an error if logging in failed.
+func (s *Session) RenewAccessToken(rejectedToken string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.AccessToken() != rejectedToken {
+		return nil
+	}
+
+	if s.cfg.AppService || len(s.cfg.Password) == 0 {
+		return ErrCannotRenewToken
+	}
+
+	logrus.WithField("mxid", s.cfg.MXID).Warn("Access token rejected, logging in again")
+
+	return s.login()
+}
+
+// RenewIfUnknownToken checks if the given error is a M_UNKNOWN_TOKEN error sent
+// by the homeserver in reply to a request made with the given access token, in
+// which case it tries to renew the access token. It returns true if a new
+// access token has been obtained, meaning the request can be retried. Logs any
+// error encountered while renewing the access token.
+func (s *Session) RenewIfUnknownToken(err error, accessToken string) bool {
+	if !IsUnknownTokenError(err) {
+		return false
+	}
+
+	if err = s.RenewAccessToken(accessToken); err != nil {
+		logrus.WithField("mxid", s.cfg.MXID).Error(err)
+		return false
+	}
+
+	return true
+}
+
+// newAppServiceSession instantiates a new Session for a virtual user of the
+// application service, which sends its requests with the application service's
+// token on behalf of this user. Registers the user on the homeserver if it
+// doesn't exist yet.
+// Returns an error if the Matrix client couldn't be created or if registering
+// the user failed.
+func newAppServiceSession(
+	cfg config.MatrixConfig, db *database.Database,
+) (*Session, error) {
+	client, err := gomatrix.NewClient(cfg.Homeserver, cfg.MXID, cfg.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		client: client,
+		cfg:    cfg,
+		db:     db,
+	}
+
+	if err = s.registerAppServiceUser(); err != nil {
+		return nil, err
+	}
+
+	client.AppServiceUserID = cfg.MXID
+
+	return s, nil
+}
+
+// registerAppServiceUser registers the session's virtual user on the
+// homeserver, using the application service's token. Does nothing if the user
+// is already registered.
+// Returns an error if the registration failed.
+func (s *Session) registerAppServiceUser() error {
+	localpart, err := gomatrix.ExtractUserLocalpart(s.cfg.MXID)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.MakeRequest("POST", s.client.BuildURL("register"), reqRegisterAppService{
+		Type:     "m.login.application_service",
+		Username: localpart,
+	}, nil)
+	if err != nil {
+		if isErrCode(err, "M_USER_IN_USE") {
+			return nil
+		}
+
+		return err
+	}
+
+	logrus.WithField("mxid", s.cfg.MXID).Info("Registered application service user")
+
+	return nil
+}
+
+// login logs in with the account's user and password, then stores the access
+// token obtained into the database and replaces the session's Matrix client with
+// one using it.
+// Returns an error if the login failed or if the access token couldn't be
+// stored.
+func (s *Session) login() error {
+	// Log in with a new client, so the previous access token doesn't get sent
+	// along with the login request, and the current client isn't modified while
+	// other goroutines may be using it.
+	client, err := gomatrix.NewClient(s.cfg.Homeserver, "", "")
+	if err != nil {
+		return err
+	}
+
+	user := s.cfg.User
+	if len(user) == 0 {
+		user = s.cfg.MXID
+	}
+
+	deviceID := s.cfg.DeviceID
+	if len(deviceID) == 0 {
+		deviceID = s.deviceID
+	}
+
+	resp, err := client.Login(&gomatrix.ReqLogin{
+		Type:                     "m.login.password",
+		User:                     user,
+		Password:                 s.cfg.Password,
+		DeviceID:                 deviceID,
+		InitialDeviceDisplayName: deviceDisplayName,
+	})
+	if err != nil {
+		return err
+	}
+
+	var configTokenHash string
+	if len(s.cfg.AccessToken) > 0 {
+		configTokenHash = tokenHash(s.cfg.AccessToken)
+	}
+
+	if err = s.db.SaveSession(s.cfg.Homeserver, s.cfg.MXID, database.StoredSession{
+		DeviceID:        resp.DeviceID,
+		AccessToken:     resp.AccessToken,
+		ConfigTokenHash: configTokenHash,
+	}); err != nil {
+		return err
+	}
+
+	s.deviceID = resp.DeviceID
+	client.SetCredentials(s.cfg.MXID, resp.AccessToken)
+
+	s.clientMutex.Lock()
+	s.client = client
+	s.clientMutex.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"mxid":     resp.UserID,
+		"deviceID": resp.DeviceID,
+	}).Info("Logged in")
+
+	return nil
+}
+
+// tokenHash returns the hash of the given access token, which is stored instead
+// of the access token itself.
+func tokenHash(accessToken string) string {
+	h := sha256.Sum256([]byte(accessToken))
+	return base64.RawStdEncoding.EncodeToString(h[:])
+}
+
+// IsUnknownTokenError checks if the given error is a M_UNKNOWN_TOKEN error
+// sent by the Matrix server, i.e. if the access token used to send the request
+// has been revoked or has expired.
+func IsUnknownTokenError(err error) bool {
+	return isErrCode(err, "M_UNKNOWN_TOKEN")
+}
+
+// IsNotFoundError checks if the given error is a M_NOT_FOUND error sent by the
+// Matrix server, e.g. if a state event doesn't exist.
+func IsNotFoundError(err error) bool {
+	return isErrCode(err, "M_NOT_FOUND")
+}
+
+// isErrCode checks if the given error is an error sent by the Matrix server
+// with the given error code.
+func isErrCode(err error, errCode string) bool {
+	httpErr, ok := err.(gomatrix.HTTPError)
+	if !ok {
+		return false
+	}
+
+	respErr, ok := httpErr.WrappedError.(gomatrix.RespError)
+	return ok && respErr.ErrCode == errCode
+}
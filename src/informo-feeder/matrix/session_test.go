@@ -0,0 +1,123 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package matrix
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"informo-feeder/config"
+	"informo-feeder/database"
+)
+
+// testHomeserver is a homeserver only implementing the login and whoami
+// endpoints, which only accepts the access token obtained by the last login.
+type testHomeserver struct {
+	mxid   string
+	logins int
+	token  string
+	mutex  sync.Mutex
+}
+
+func (h *testHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.URL.Path {
+	case "/_matrix/client/r0/login":
+		h.logins++
+		h.token = fmt.Sprintf("token%d", h.logins)
+		fmt.Fprintf(
+			w, `{"user_id":%q,"access_token":%q,"device_id":"DEVICE"}`,
+			h.mxid, h.token,
+		)
+	case "/_matrix/client/r0/account/whoami":
+		if len(h.token) == 0 || r.URL.Query().Get("access_token") != h.token {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"errcode":"M_UNKNOWN_TOKEN","error":"Unknown token"}`)
+			return
+		}
+
+		fmt.Fprintf(w, `{"user_id":%q}`, h.mxid)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errcode":"M_UNRECOGNIZED","error":"Unrecognized request"}`)
+	}
+}
+
+func TestConcurrentRenewal(t *testing.T) {
+	hs := &testHomeserver{mxid: "@feeder:example.org"}
+	server := httptest.NewServer(hs)
+	defer server.Close()
+
+	db, err := database.NewDatabase("sqlite3", ":memory:", true)
+	if err != nil {
+		t.Fatalf("NewDatabase: %v", err)
+	}
+
+	// The access token from the configuration file has been revoked, so every
+	// goroutine gets it rejected, but only one of them must log in again.
+	session, err := NewSession(config.MatrixConfig{
+		Homeserver:  server.URL,
+		AccessToken: "revoked",
+		MXID:        hs.mxid,
+		Password:    "secret",
+	}, db)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- session.CheckWhoAmI()
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("CheckWhoAmI: %v", err)
+		}
+	}
+
+	if hs.logins != 1 {
+		t.Errorf("got %d logins, want 1", hs.logins)
+	}
+
+	if token := session.AccessToken(); token != hs.token {
+		t.Errorf("got access token %q, want %q", token, hs.token)
+	}
+
+	stored, err := db.GetSession(server.URL, hs.mxid)
+	if err != nil {
+		t.Fatalf("GetSession: %v", err)
+	}
+
+	if stored.AccessToken != hs.token {
+		t.Errorf("got stored access token %q, want %q", stored.AccessToken, hs.token)
+	}
+}
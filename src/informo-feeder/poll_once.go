@@ -0,0 +1,162 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"informo-feeder/config"
+	"informo-feeder/poller"
+	"informo-feeder/publisher"
+	"informo-feeder/signing"
+	"informo-feeder/sources"
+
+	"github.com/codegangsta/cli"
+	"github.com/sirupsen/logrus"
+)
+
+// pollOnceCommand polls the feeds once and publishes their new items, for
+// deployments which can't run the feeder as a daemon.
+var pollOnceCommand = cli.Command{
+	Name:      "poll-once",
+	Usage:     "Poll the given feeds (default: all feeds) once, publish their new items, wait for the outbox to drain, then print out a summary",
+	ArgsUsage: "[identifier...]",
+	Flags: []cli.Flag{
+		cli.DurationFlag{
+			Name:  "timeout",
+			Value: 5 * time.Minute,
+			Usage: "Maximum time to wait for the outbox to drain",
+		},
+		recordFlag,
+	},
+	Action: withConfig(pollOnce),
+}
+
+// feedSummary describes what happened to a feed during a one-shot poll.
+type feedSummary struct {
+	feed   config.Feed
+	result poller.PollResult
+	// pending is the number of events generated from the feed which are left
+	// in the outbox.
+	pending int
+	// abandoned is the number of events generated from the feed which the
+	// publisher gave up on, along with the events of their chains held back by
+	// them, until they're republished.
+	abandoned int
+	err       error
+}
+
+// failed returns true if the feed couldn't be polled, or if some of its new
+// items couldn't be published.
+func (s feedSummary) failed() bool {
+	return s.err != nil || s.result.Failed > 0 || s.pending > 0 || s.abandoned > 0
+}
+
+// pollOnce polls the feeds given in the command line (or all feeds if none is
+// given) once, adds the events for their new items to the outbox, then sends
+// the events until the outbox is empty or the timeout expires. Prints out a
+// summary for each feed, and exits with the failure exit code if any feed
+// couldn't be polled or has events left or abandoned in the outbox.
+func pollOnce(ctx *cli.Context, cfg *config.Config) (err error) {
+	feeds, err := selectFeeds(ctx, cfg)
+	if err != nil {
+		return
+	}
+
+	db, pool, err := connect(cfg)
+	if err != nil {
+		return
+	}
+
+	signer := newSigner(cfg)
+
+	authoriser := sources.NewAuthoriser(cfg, pool, signer)
+	authoriser.Check()
+
+	pub := publisher.NewPublisher(db, pool)
+	p := poller.NewPoller(db, pool, pub, authoriser, signer, cfg, nil)
+	p.Record(ctx.String("record"))
+
+	summaries := make([]feedSummary, len(feeds))
+	for i, feed := range feeds {
+		summaries[i].feed = feed
+
+		// Don't publish news nobody can verify.
+		if _, err = signing.ActiveKey(signer, feed.Identifier); err == nil {
+			summaries[i].result, err = p.Poll(feed)
+		}
+
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"identifier": feed.Identifier,
+				"feedURL":    feed.URL,
+			}).Error(err)
+			summaries[i].err = err
+		}
+	}
+
+	identifiers := make([]string, len(feeds))
+	for i, feed := range feeds {
+		identifiers[i] = feed.Identifier
+	}
+
+	left, err := pub.Drain(identifiers, ctx.Duration("timeout"))
+	if err != nil {
+		return
+	}
+
+	if left > 0 {
+		logrus.WithField("events", left).Warn("Timed out before the outbox was drained")
+	}
+
+	var failed bool
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FEED\tNEW\tENQUEUED\tSKIPPED\tFAILED\tPENDING\tABANDONED\tSTATUS")
+	for _, s := range summaries {
+		s.pending, s.abandoned, err = db.CountOutboxEventsForFeed(s.feed.Identifier)
+		if err != nil {
+			return
+		}
+
+		status := "ok"
+		if s.err != nil {
+			status = "error: " + s.err.Error()
+		} else if s.failed() {
+			status = "failed"
+		}
+
+		fmt.Fprintf(
+			w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n", s.feed.Identifier,
+			s.result.NewItems, s.result.Enqueued, s.result.Skipped,
+			s.result.Failed, s.pending, s.abandoned, status,
+		)
+
+		failed = failed || s.failed()
+	}
+
+	if err = w.Flush(); err != nil {
+		return
+	}
+
+	if failed {
+		return cli.NewExitError("", exitFailure)
+	}
+
+	return nil
+}
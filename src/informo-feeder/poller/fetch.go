@@ -0,0 +1,117 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package poller
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"informo-feeder/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// StdinURL is the URL of a feed read from the standard input.
+	StdinURL = "-"
+	// fileURLPrefix is the prefix of the URL of a feed read from a local file.
+	fileURLPrefix = "file://"
+)
+
+// ErrStdinAlreadyRead is returned when fetching a feed from the standard input
+// after it has already been read, since there's nothing left to read from it.
+var ErrStdinAlreadyRead = errors.New("The standard input has already been read")
+
+// stdinOnce makes sure the standard input is only read once, even if several
+// feeds are read from it.
+var stdinOnce sync.Once
+
+// fetch retrieves the raw body of the given feed, either from the standard
+// input if its URL is "-", from a local file if its URL starts with "file://",
+// or from its server. If a record directory is set, also saves the body into
+// it.
+// Returns an error if the body couldn't be read or saved. Returns a *StatusError
+// if the feed's server didn't reply with a 200 OK status code.
+func (p *Poller) fetch(feed config.Feed) (body []byte, err error) {
+	switch {
+	case feed.URL == StdinURL:
+		err = ErrStdinAlreadyRead
+		stdinOnce.Do(func() {
+			body, err = ioutil.ReadAll(os.Stdin)
+		})
+	case strings.HasPrefix(feed.URL, fileURLPrefix):
+		body, err = ioutil.ReadFile(strings.TrimPrefix(feed.URL, fileURLPrefix))
+	default:
+		body, err = httpGet(feed.URL)
+	}
+
+	if err != nil || len(p.recordDir) == 0 {
+		return
+	}
+
+	err = p.record(feed, body)
+	return
+}
+
+// httpGet retrieves the body of the document at the given URL.
+// Returns an error if the request failed or if the body couldn't be read.
+// Returns a *StatusError if the server didn't reply with a 200 OK status code.
+func httpGet(url string) (body []byte, err error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = &StatusError{resp.StatusCode}
+		return
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// record saves the raw body of a feed into the record directory, in a file
+// named after the feed's identifier and the current time, which can later be
+// replayed by using its path as the feed's URL (prefixed with "file://").
+// Returns an error if the file couldn't be written.
+func (p *Poller) record(feed config.Feed, body []byte) (err error) {
+	if err = os.MkdirAll(p.recordDir, 0755); err != nil {
+		return
+	}
+
+	path := filepath.Join(p.recordDir, fmt.Sprintf(
+		"%s-%s.xml", feed.Identifier,
+		time.Now().UTC().Format("20060102T150405.000000000Z"),
+	))
+	if err = ioutil.WriteFile(path, body, 0644); err != nil {
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"feedURL": feed.URL,
+		"path":    path,
+	}).Debug("Feed recorded")
+
+	return
+}
@@ -16,82 +16,203 @@
 package poller
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"time"
 
 	"informo-feeder/common"
 	"informo-feeder/config"
+	"informo-feeder/database"
+	"informo-feeder/signing"
 
-	"github.com/matrix-org/gomatrix"
-	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/mmcdole/gofeed"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/crypto/ed25519"
 )
 
-func (p *Poller) sendMatrixEventFromItem(
-	feed config.Feed, itemContent string, feedItem *gofeed.Item,
+// enqueueEventFromItem generates the Matrix event for a feed item and signs it
+// for each of the given network profiles (since the signed content is bound to
+// the event's type and room, and chained to the previous event published into
+// the network), then adds the item along with one event per network profile to
+// the given batch. In dry-run mode, also writes the events out.
+// Returns an error if generating, signing or writing out the event failed.
+func (p *Poller) enqueueEventFromItem(
+	feed config.Feed, networks []string, itemContent string,
+	feedItem *gofeed.Item, batch *pollBatch,
 ) (err error) {
-	var extract string
-	var extractMaxLength = 80
-
 	content, err := p.getEventContent(feedItem, itemContent)
 	if err != nil {
 		return
 	}
 
-	if err = p.signEvent(&content, feed.Identifier); err != nil {
-		return
-	}
-
-	firstIter := true
+	// Generate one event for each network profile.
+	var events []database.OutboxEvent
+	for _, name := range networks {
+		network := p.cfg.Networks[name]
+		eventType := network.EventType(feed.Identifier)
 
-	var r *gomatrix.RespSendEvent
-	for err != nil || firstIter {
-		if !firstIter {
-			is429 := isTooManyRequestsError(err)
-			if !is429 {
+		// Work on a copy of the content so each event has its own signature.
+		eventContent := content
+		if p.cfg.Signing.Chained() {
+			// Chain the event to the last one enqueued for this source into
+			// this network.
+			var sequence int64
+			sequence, eventContent.PrevHash, err = p.chainHead(batch, feed.Identifier, name)
+			if err != nil {
 				return
 			}
-			// Wait if the error was "429 Too Many Requests"
-			time.Sleep(500 * time.Millisecond)
+
+			eventContent.Sequence = sequence + 1
 		}
 
-		if !p.testMode {
-			r, err = p.mxClient.SendMessageEvent(
-				common.InformoRoomID,
-				common.InformoNewsEventTypePrefix+feed.Identifier,
-				content,
-			)
-		} else {
-			if len(content.Content) > extractMaxLength {
-				extract = content.Content[:extractMaxLength]
-			} else {
-				extract = content.Content
-			}
+		err = p.signEvent(&eventContent, feed.Identifier, eventType, network.RoomID)
+		if err != nil {
+			return
+		}
+
+		var event database.OutboxEvent
+		event, err = newOutboxEvent(network.RoomID, eventType, eventContent)
+		if err != nil {
+			return
+		}
+
+		if event.Hash, err = signing.ContentHash([]byte(event.Content)); err != nil {
+			return
+		}
+
+		event.Network = name
+		event.Sequence = eventContent.Sequence
+		event.Headline = eventContent.Headline
+		event.KeyID = eventContent.KeyID
+		event.Signature = contentSignature(eventContent, feed.Identifier)
+		events = append(events, event)
+	}
+
+	if p.dryRun != nil {
+		if err = p.writeDryRunEvents(feed, events); err != nil {
+			return
+		}
+	}
 
-			logrus.WithFields(logrus.Fields{
-				"feedURL":    feed.URL,
-				"identifier": feed.Identifier,
-				"content":    extract,
-			}).Debug("Feed test mode enabled, not sending any actual event")
+	batch.items = append(batch.items, database.EnqueuedItem{
+		URL:    feedItem.Link,
+		Events: events,
+	})
+
+	for _, event := range events {
+		batch.chains[event.Network] = chainLink{
+			sequence: event.Sequence,
+			hash:     event.Hash,
 		}
+	}
+
+	return
+}
+
+// newOutboxEvent serialises the content of an event and computes a transaction
+// ID for it, in order to create an event that can be stored in the outbox. The
+// transaction ID is derived from the room ID, the event type and the signed
+// content so that it stays the same across all attempts to send the event,
+// which makes retries idempotent.
+// Returns an error if the content couldn't be serialised.
+func newOutboxEvent(
+	roomID string, eventType string, content common.NewsContent,
+) (event database.OutboxEvent, err error) {
+	jsonBytes, err := json.Marshal(content)
+	if err != nil {
+		return
+	}
+
+	h := sha256.New()
+	h.Write([]byte(roomID))
+	h.Write([]byte{0})
+	h.Write([]byte(eventType))
+	h.Write([]byte{0})
+	h.Write(jsonBytes)
+
+	event = database.OutboxEvent{
+		RoomID:    roomID,
+		EventType: eventType,
+		TxnID:     "informo." + base64.RawURLEncoding.EncodeToString(h.Sum(nil)),
+		Content:   string(jsonBytes),
+	}
+
+	return
+}
 
-		firstIter = false
+// contentSignature returns the signature of the given signed content, in the
+// Matrix format if the content has one, since it covers the legacy signature,
+// or in the legacy format otherwise.
+func contentSignature(content common.NewsContent, identifier string) string {
+	if signature, ok := content.Signatures[identifier][content.KeyID]; ok {
+		return signature
 	}
 
-	if !p.testMode {
-		logrus.WithFields(logrus.Fields{
-			"feedURL":    feed.URL,
-			"identifier": feed.Identifier,
-			"eventID":    r.EventID,
-		}).Info("Event published")
+	return content.Signature
+}
+
+// dryRunEvent is the JSON line written out for each event in dry-run mode.
+type dryRunEvent struct {
+	Feed     string          `json:"feed"`
+	Network  string          `json:"network"`
+	RoomID   string          `json:"room_id"`
+	Type     string          `json:"type"`
+	TxnID    string          `json:"txn_id"`
+	Sequence int64           `json:"sequence,omitempty"`
+	Hash     string          `json:"hash"`
+	Content  json.RawMessage `json:"content"`
+}
+
+// writeDryRunEvents writes the given events out as JSON lines, with their full
+// signed content.
+// Returns an error if an event couldn't be written out.
+func (p *Poller) writeDryRunEvents(
+	feed config.Feed, events []database.OutboxEvent,
+) error {
+	encoder := json.NewEncoder(p.dryRun)
+	for _, event := range events {
+		if err := encoder.Encode(dryRunEvent{
+			Feed:     feed.Identifier,
+			Network:  event.Network,
+			RoomID:   event.RoomID,
+			Type:     event.EventType,
+			TxnID:    event.TxnID,
+			Sequence: event.Sequence,
+			Hash:     event.Hash,
+			Content:  json.RawMessage(event.Content),
+		}); err != nil {
+			return err
+		}
 	}
 
+	logrus.WithFields(logrus.Fields{
+		"feedURL":    feed.URL,
+		"identifier": feed.Identifier,
+		"events":     len(events),
+	}).Debug("Dry-run mode enabled, events written out instead of being sent")
+
 	return nil
 }
 
+// chainHead returns the sequence number and the hash of the last event of the
+// given source's chain in the given network profile, taking into account the
+// events of the given batch, which aren't saved yet, and, in dry-run mode, the
+// events written out during this run.
+// Returns an error if the chain's head couldn't be retrieved from the database.
+func (p *Poller) chainHead(
+	batch *pollBatch, identifier string, network string,
+) (sequence int64, hash string, err error) {
+	if link, ok := batch.chains[network]; ok {
+		return link.sequence, link.hash, nil
+	}
+
+	if link, ok := p.dryRunChains[chainKey{identifier, network}]; ok {
+		return link.sequence, link.hash, nil
+	}
+
+	return p.db.GetChainHead(identifier, network)
+}
+
 func (p *Poller) getEventContent(
 	item *gofeed.Item, itemContent string,
 ) (content common.NewsContent, err error) {
@@ -114,18 +235,48 @@ func (p *Poller) getEventContent(
 	return
 }
 
-func (p *Poller) signEvent(content *common.NewsContent, eventType string) (err error) {
-	jsonBytes, err := json.Marshal(content)
+// signEvent signs the content of an event with the source's active key, and
+// sets the key's ID and the signature in the content, in the legacy format,
+// the Matrix format or both depending on the configuration. If both formats
+// are used, the legacy signature is computed first, so that it's covered by the
+// Matrix signature. From the version 2 of the signature scheme, the content is
+// bound to the source, the given event type and room ID, the current time and
+// a nonce before being signed.
+// Returns an error if the source has no valid key, if the nonce couldn't be
+// generated or if the content couldn't be serialised or signed.
+func (p *Poller) signEvent(
+	content *common.NewsContent, identifier string, eventType string,
+	roomID string,
+) (err error) {
+	key, err := signing.ActiveKey(p.signer, identifier)
 	if err != nil {
 		return
 	}
 
-	canonical, err := gomatrixserverlib.CanonicalJSON(jsonBytes)
-	if err != nil {
-		return
+	content.KeyID = key.ID
+
+	if p.cfg.Signing.Version >= config.SignatureVersionBound {
+		if content.Nonce, err = signing.Nonce(); err != nil {
+			return
+		}
+
+		content.Source = identifier
+		content.EventType = eventType
+		content.RoomID = roomID
+		content.SignedAt = time.Now().Unix()
+		content.SignatureVersion = p.cfg.Signing.Version
+	}
+
+	if p.cfg.Signing.Legacy() {
+		content.Signature, err = signing.SignContent(p.signer, identifier, key.ID, content)
+		if err != nil {
+			return
+		}
+	}
+
+	if p.cfg.Signing.Matrix() {
+		err = signing.SignContentJSON(p.signer, identifier, key.ID, content)
 	}
 
-	priv := p.cfg.Keys.PrivateKeys[eventType]
-	content.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, canonical))
 	return
 }
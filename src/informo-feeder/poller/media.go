@@ -16,52 +16,51 @@
 package poller
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"mime"
 	"regexp"
 	"strings"
 	"time"
 
+	"informo-feeder/common"
+	"informo-feeder/matrix"
+
 	"github.com/matrix-org/gomatrix"
 	"github.com/sirupsen/logrus"
 )
 
 var imgRegexp = `<img[^>]+["|']((//|http(s?)://)[^"'>]+)["|']`
 
-func (p *Poller) replaceMedias(content *string) error {
+func (p *Poller) replaceMedias(session *matrix.Session, content *string) error {
 	urls := p.getMediaLinks(*content)
-	return p.replaceWithMatrixLink(content, urls)
+	return p.replaceWithMatrixLink(session, content, urls)
 }
 
-func (p *Poller) replaceWithMatrixLink(content *string, urls []string) (err error) {
+func (p *Poller) replaceWithMatrixLink(
+	session *matrix.Session, content *string, urls []string,
+) (err error) {
 	if len(urls) > 0 {
 		// map[originalURL]matrixURL
 		replacements := make(map[string]string)
 
-		var resp *gomatrix.RespMediaUpload
 		for _, url := range urls {
-			firstIter := true
-			for err != nil || firstIter {
-				if !firstIter {
-					is429 := isTooManyRequestsError(err)
-					if !is429 {
-						return
-					}
-
-					// Wait if the error was "429 Too Many Requests"
-					time.Sleep(500 * time.Millisecond)
-				}
-
-				resp, err = p.mxClient.UploadLink(url)
-
-				firstIter = false
+			var mxURL string
+			if p.dryRun != nil {
+				// Don't upload anything in dry-run mode, but still replace
+				// the link so the content looks like the one that would be
+				// sent.
+				mxURL = dryRunMediaURL(url)
+			} else if mxURL, err = p.uploadMedia(session, url); err != nil {
+				return
 			}
 
 			logrus.WithFields(logrus.Fields{
 				"originalURL": url,
-				"mxURL":       resp.ContentURI,
+				"mxURL":       mxURL,
 			}).Debug("Replacing media link in content")
 
-			replacements[url] = resp.ContentURI
+			replacements[url] = mxURL
 		}
 
 		for origURL, mxURL := range replacements {
@@ -72,6 +71,48 @@ func (p *Poller) replaceWithMatrixLink(content *string, urls []string) (err erro
 	return
 }
 
+// uploadMedia asks the homeserver of the given session to download the media
+// at the given URL, retrying if the request gets rate-limited, and returns the
+// mxc:// URL of the media.
+// Returns an error if the upload failed.
+func (p *Poller) uploadMedia(
+	session *matrix.Session, url string,
+) (mxURL string, err error) {
+	var resp *gomatrix.RespMediaUpload
+	firstIter := true
+	for err != nil || firstIter {
+		if !firstIter {
+			is429 := common.IsTooManyRequestsError(err)
+			if !is429 {
+				return
+			}
+
+			// Wait if the error was "429 Too Many Requests"
+			time.Sleep(500 * time.Millisecond)
+		}
+
+		client := session.Client()
+		accessToken := client.AccessToken
+		resp, err = client.UploadLink(url)
+		if session.RenewIfUnknownToken(err, accessToken) {
+			// Force a new attempt with the new access token.
+			continue
+		}
+
+		firstIter = false
+	}
+
+	return resp.ContentURI, nil
+}
+
+// dryRunMediaURL returns the mxc:// URL standing for the media at the given URL
+// in dry-run mode. It's derived from the media's URL so that it stays the same
+// across runs.
+func dryRunMediaURL(url string) string {
+	h := sha256.Sum256([]byte(url))
+	return "mxc://dry-run/" + base64.RawURLEncoding.EncodeToString(h[:18])
+}
+
 func (p *Poller) getMediaLinks(content string) (medias []string) {
 	medias = make([]string, 0)
 
@@ -16,145 +16,331 @@
 package poller
 
 import (
+	"bytes"
 	"errors"
-	"net/http"
+	"fmt"
+	"io"
 	"regexp"
 	"time"
 
 	"informo-feeder/config"
 	"informo-feeder/database"
+	"informo-feeder/matrix"
+	"informo-feeder/publisher"
+	"informo-feeder/signing"
+	"informo-feeder/sources"
 
-	"github.com/matrix-org/gomatrix"
 	"github.com/mmcdole/gofeed"
 	"github.com/sirupsen/logrus"
 )
 
 var (
-	errNoHTML  = errors.New("Could not find any HTML content")
-	htmlRegexp = regexp.MustCompile("</[^ ]+>")
+	errNoHTML        = errors.New("Could not find any HTML content")
+	errNotAuthorised = errors.New("Not authorised to publish the source into any network")
+	htmlRegexp       = regexp.MustCompile("</[^ ]+>")
 )
 
 // Poller describes the overall poller in charge of polling feeds, parsing them
 // and sending new events to Matrix.
 type Poller struct {
-	db       *database.Database
-	mxClient *gomatrix.Client
-	parser   *gofeed.Parser
-	cfg      *config.Config
-	testMode bool
+	db         *database.Database
+	pool       *matrix.Pool
+	publisher  *publisher.Publisher
+	authoriser *sources.Authoriser
+	signer     signing.Signer
+	parser     *gofeed.Parser
+	cfg        *config.Config
+	// dryRun is where the events are written instead of being sent in dry-run
+	// mode, nil otherwise.
+	dryRun io.Writer
+	// dryRunChains holds the head of the chain of each source in each network
+	// profile in dry-run mode, since nothing is saved in the database.
+	dryRunChains map[chainKey]chainLink
+	// recordDir is the directory to save the raw body of each fetched feed
+	// into, if any.
+	recordDir string
 }
 
-// NewPoller instantiates a new Poller.
+// chainKey identifies the chain of a source in a network profile.
+type chainKey struct {
+	feed    string
+	network string
+}
+
+// chainLink describes the last event of a chain.
+type chainLink struct {
+	sequence int64
+	hash     string
+}
+
+// pollBatch holds the items prepared during a poll, which are saved and which
+// events are added to the outbox in a single transaction at the end of the
+// poll, the URLs of the items of the feed which were retrieved in a previous
+// poll, and the head of the chain of the feed in each network profile once
+// these events are added.
+type pollBatch struct {
+	items  []database.EnqueuedItem
+	known  []string
+	chains map[string]chainLink
+}
+
+// StatusError is returned when polling a feed if the server didn't reply with a
+// 200 OK status code.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("The feed's server replied with status %d", e.StatusCode)
+}
+
+// PollResult describes what happened to the new items of a feed during a poll.
+type PollResult struct {
+	// NewItems is the number of items that weren't retrieved in a previous
+	// poll.
+	NewItems int
+	// Enqueued is the number of new items which events have been added to the
+	// outbox (or written out in dry-run mode).
+	Enqueued int
+	// Skipped is the number of new items which couldn't be published because
+	// they don't have any HTML content or because the feeder isn't authorised
+	// to publish the source.
+	Skipped int
+	// Failed is the number of new items which couldn't be prepared or added to
+	// the outbox. They'll be processed again during the next poll.
+	Failed int
+}
+
+// NewPoller instantiates a new Poller. If dryRun isn't nil, the poller runs in
+// dry-run mode: it doesn't make any call to Matrix or change the database, and
+// writes the events it would send to dryRun as JSON lines, in which case the
+// pool, the publisher and the authoriser aren't used and can be nil.
 func NewPoller(
 	db *database.Database,
-	mxClient *gomatrix.Client,
+	pool *matrix.Pool,
+	pub *publisher.Publisher,
+	authoriser *sources.Authoriser,
+	signer signing.Signer,
 	cfg *config.Config,
-	testMode bool,
+	dryRun io.Writer,
 ) *Poller {
 	return &Poller{
-		db:       db,
-		mxClient: mxClient,
-		parser:   gofeed.NewParser(),
-		cfg:      cfg,
-		testMode: testMode,
+		db:           db,
+		pool:         pool,
+		publisher:    pub,
+		authoriser:   authoriser,
+		signer:       signer,
+		parser:       gofeed.NewParser(),
+		cfg:          cfg,
+		dryRun:       dryRun,
+		dryRunChains: make(map[chainKey]chainLink),
 	}
 }
 
+// Record makes the poller save the raw body of each feed it fetches into the
+// given directory, so it can be replayed later.
+func (p *Poller) Record(dir string) {
+	p.recordDir = dir
+}
+
 // StartPolling starts an infinite loop that will:
-//     - load the results of the previous poll from the database
-//     - poll and parse the given feed
-//     - send to Matrix each item that wasn't retrieved in the previous poll
-//     - erase the results of the previous poll
-//     - save the result from the current iteration to the database
+//     - poll the given feed and add the events for its new items to the outbox
+//       (see Poll)
 //     - wait for a given time (specified in the configuration file)
 // If a fatal error is encountered, it panics rather than returning an error.
+// If the feed's server didn't reply with a 200 OK status code, or if another
+// feeder sharing the database saved some of the feed's items meanwhile, the
+// feed is skipped until the next iteration (see isRetryable).
 func (p *Poller) StartPolling(feed config.Feed) {
-	var err error
-	var lastPollResults map[string]bool
-	var itemIsKnown bool
-
 	for {
-		// Load the last poll's results.
-		lastPollResults, err = p.db.GetItemsURLsForFeed(feed.Identifier)
-		if err != nil {
-			logrus.Panic(err)
+		if _, err := p.Poll(feed); err != nil {
+			if !isRetryable(err) {
+				logrus.Panic(err)
+			}
+
+			logrus.WithField("feedURL", feed.URL).Warn(err)
 		}
 
-		logrus.WithFields(logrus.Fields{
-			"feed":  feed.Identifier,
-			"items": len(lastPollResults),
-		}).Debug("Loaded last poll's results")
+		// Wait before jumping to the next iteration.
+		time.Sleep(time.Duration(feed.PollInterval) * time.Second)
+	}
+}
 
-		logrus.WithField("feedURL", feed.URL).Info("Polling")
+// isRetryable returns whether the given error returned by Poll can be solved by
+// polling the feed again, i.e. whether it's a *StatusError or a conflict with
+// another feeder sharing the database (see database.IsConflict). In the latter
+// case, nothing from the poll has been saved, so the next poll will process
+// the feed's new items again, taking into account what the other feeder saved.
+func isRetryable(err error) bool {
+	if _, ok := err.(*StatusError); ok {
+		return true
+	}
 
-		// Retrieve the feed's XML.
-		resp, err := http.Get(feed.URL)
-		if err != nil {
-			logrus.Panic(err)
-		}
+	return database.IsConflict(err)
+}
+
+// Poll polls the given feed once:
+//     - retrieve (see fetch) and parse the feed
+//     - look up which of the feed's items were retrieved in a previous poll
+//     - prepare the matching event for each new item (or, in dry-run mode,
+//       write the event out)
+//     - save the new items in the database and add their events to the
+//       outbox in a single transaction, so the publisher can send them to
+//       Matrix
+// Failing to prepare an item (e.g. because the homeserver can't be reached to
+// upload its medias) isn't considered fatal: the item isn't saved, so it will
+// be processed again during the next poll.
+// Returns what happened to the feed's new items, or an error if the feed
+// couldn't be retrieved or parsed, or if the database couldn't be read or
+// written to. Returns a *StatusError if the server didn't reply with a 200 OK
+// status code.
+func (p *Poller) Poll(feed config.Feed) (result PollResult, err error) {
+	logrus.WithField("feedURL", feed.URL).Info("Polling")
+
+	// Retrieve the feed's XML.
+	body, err := p.fetch(feed)
+	if err != nil {
+		return
+	}
+
+	// Parse the XML retrieved from the remote server.
+	f, err := p.parser.Parse(bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"feed":  feed.Identifier,
+		"items": len(f.Items),
+	}).Debug("Fetched feed")
+
+	itemURLs := make([]string, len(f.Items))
+	for i, item := range f.Items {
+		itemURLs[i] = item.Link
+	}
 
-		// If the server didn't reply with a 200 OK status code, wait for the
-		// correct amount of time, then jump to the next iteration.
-		if resp.StatusCode != http.StatusOK {
-			time.Sleep(time.Duration(feed.PollInterval) * time.Second)
+	knownItems, err := p.db.GetKnownItems(feed.Identifier, itemURLs)
+	if err != nil {
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"feed":  feed.Identifier,
+		"items": len(knownItems),
+	}).Debug("Looked up known items")
+
+	batch := &pollBatch{chains: make(map[string]chainLink)}
+	for u := range knownItems {
+		batch.known = append(batch.known, u)
+	}
 
+	// Iterate over the posts in chronological order. We can't promise to
+	// send all events chronologically (for example, if a new item appears
+	// in the middle of the feed between two iterations, we will send it
+	// after all the others, that we retrieved from the previous iteration),
+	// but we try to.
+	for i := len(f.Items) - 1; i >= 0; i-- {
+		item := f.Items[i]
+		// Only send the event if it wasn't part of a previous poll (or
+		// doesn't appear twice in the feed).
+		if _, itemIsKnown := knownItems[item.Link]; itemIsKnown {
 			continue
 		}
 
-		// Parse the XML retrieved from the remote server.
-		f, err := p.parser.Parse(resp.Body)
-		if err != nil {
-			logrus.Panic(err)
+		result.NewItems++
+
+		// Not findind any HTML in an item isn't a fatal error, log it and
+		// jump to the next item.
+		if err = p.prepareThenEnqueue(feed, item, batch); err == errNoHTML {
+			logrus.WithFields(logrus.Fields{
+				"feed":          feed.Identifier,
+				"title":         item.Title,
+				"publishedDate": item.PublishedParsed.String(),
+			}).Warn("Could not find any HTML content")
+			result.Skipped++
+		} else if err == errNotAuthorised {
+			// The item isn't saved, so it will be published once the
+			// feeder is authorised to.
+			logrus.WithFields(logrus.Fields{
+				"feed":  feed.Identifier,
+				"title": item.Title,
+			}).Debug("Not authorised to publish the item, skipping it")
+			result.Skipped++
+		} else if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"feed":  feed.Identifier,
+				"title": item.Title,
+			}).Error(err)
+			result.Failed++
+		} else {
+			result.Enqueued++
+			knownItems[item.Link] = true
 		}
+	}
 
-		logrus.WithFields(logrus.Fields{
-			"feed":  feed.Identifier,
-			"items": len(f.Items),
-		}).Debug("Fetched feed")
-
-		// Iterate over the posts in chronological order. We can't promise to
-		// send all events chronologically (for example, if a new item appears
-		// in the middle of the feed between two iterations, we will send it
-		// after all the others, that we retrieved from the previous iteration),
-		// but we try to.
-		for i := len(f.Items) - 1; i >= 0; i-- {
-			item := f.Items[i]
-			// If the URL isn't part of the map, itemIsKnown will equal false.
-			_, itemIsKnown = lastPollResults[item.Link]
-			// Only send the event if it wasn't part of the previous iteration.
-			if !itemIsKnown {
-				// Not findind any HTML in an item isn't a fatal error, log it
-				// and jump to the next iteration (after waiting enough).
-				if err = p.prepareThenSend(feed, item); err == errNoHTML {
-					logrus.WithFields(logrus.Fields{
-						"feed":          feed.Identifier,
-						"title":         item.Title,
-						"publishedDate": item.PublishedParsed.String(),
-					}).Warn("Could not find any HTML content")
-
-					continue
-				} else if err != nil {
-					logrus.Panic(err)
-				}
-
-				// Save the new item to the database.
-				if err = p.db.SaveItem(feed.Identifier, item.Link); err != nil {
-					logrus.Panic(err)
-				}
-			}
+	return result, p.saveBatch(feed, batch)
+}
+
+// saveBatch records that the known items were seen again, saves the items
+// prepared during a poll and adds their events to the outbox, then notifies the
+// publisher about them. In dry-run mode, only
+// remembers the head of the feed's chains, since the events have already been
+// written out.
+// Returns an error if the transaction went wrong.
+func (p *Poller) saveBatch(feed config.Feed, batch *pollBatch) error {
+	if p.dryRun != nil {
+		for network, link := range batch.chains {
+			p.dryRunChains[chainKey{feed.Identifier, network}] = link
 		}
 
-		// Wait before jumping to the next iteration.
-		time.Sleep(time.Duration(feed.PollInterval) * time.Second)
+		return nil
 	}
+
+	if len(batch.items) == 0 && len(batch.known) == 0 {
+		return nil
+	}
+
+	if err := p.db.SavePoll(feed.Identifier, batch.known, batch.items); err != nil {
+		return err
+	}
+
+	if len(batch.items) == 0 {
+		return nil
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"feedURL":    feed.URL,
+		"identifier": feed.Identifier,
+		"items":      len(batch.items),
+	}).Debug("Items enqueued")
+
+	p.publisher.Notify()
+
+	return nil
 }
 
-// prepareThenSend checks if any HTML could be found in the item (if there is a
-// content, it's always HTML, if not, checks if HTML could be found in the item's
-// description), in which case it will replace media links (with mxc:// URLs)
-// in the item's HTML, then send it to Matrix.
-// Returns an error if no HTML could be found, or if replacing medias failed.
-func (p *Poller) prepareThenSend(feed config.Feed, item *gofeed.Item) error {
+// prepareThenEnqueue checks if any HTML could be found in the item (if there is
+// a content, it's always HTML, if not, checks if HTML could be found in the
+// item's description), in which case it will replace media links (with mxc://
+// URLs) in the item's HTML, then add it to the given batch.
+// Returns an error if no HTML could be found, if replacing medias failed or if
+// the item's events couldn't be generated. Returns errNotAuthorised if the
+// authorisation check is enforced and the feed can't be published into any of
+// its network profiles.
+func (p *Poller) prepareThenEnqueue(
+	feed config.Feed, item *gofeed.Item, batch *pollBatch,
+) error {
+	// Only publish the item into the network profiles the feed is authorised
+	// to publish into. Don't bother checking in dry-run mode, since nothing
+	// will be published anyway.
+	networks := feed.NetworkNames()
+	if p.dryRun == nil {
+		networks = p.authorisedNetworks(feed)
+		if len(networks) == 0 {
+			return errNotAuthorised
+		}
+	}
+
 	// Look for HTML content.
 	var content string
 	if len(item.Content) > 0 {
@@ -174,34 +360,30 @@ func (p *Poller) prepareThenSend(feed config.Feed, item *gofeed.Item) error {
 		"publishedDate": item.PublishedParsed.String(),
 	}).Info("Got a new item")
 
-	// Replace media links with mxc:// URLs.
-	if err := p.replaceMedias(&content); err != nil {
+	// Replace media links with mxc:// URLs. Medias are uploaded to the
+	// homeserver of the first network profile the feed publishes into, since
+	// mxc:// URLs can be resolved from any homeserver.
+	var session *matrix.Session
+	if p.dryRun == nil {
+		session = p.pool.Session(feed.Identifier, feed.NetworkNames()[0])
+	}
+
+	if err := p.replaceMedias(session, &content); err != nil {
 		return err
 	}
 
-	// Create and send a Matrix event for this item.
-	return p.sendMatrixEventFromItem(feed, content, item)
+	// Create a Matrix event for this item and add it to the outbox.
+	return p.enqueueEventFromItem(feed, networks, content, item, batch)
 }
 
-// isTooManyRequestsError checks if the given error is a rate limit error sent by
-// the Matrix server.
-// Logs (if debugging logging is enabled) if the error is an HTTP error sent by
-// a Matrix server, then returns the result.
-func isTooManyRequestsError(err error) bool {
-	// Checks whether the error is an HTTP error retrieved from a Matrix server.
-	httpErr, ok := err.(gomatrix.HTTPError)
-	if !ok || httpErr.Code != http.StatusTooManyRequests {
-		if ok {
-			// If it is an HTTP error sent by a Matrix server but not a 429 Too
-			// Many Requests error, log it.
-			logrus.WithFields(logrus.Fields{
-				"code":    httpErr.Code,
-				"message": httpErr.Message,
-			}).Debug("HTTP error isn't 429 Too Many Requests")
+// authorisedNetworks returns the names of the network profiles the given feed
+// publishes into and is authorised to publish into.
+func (p *Poller) authorisedNetworks(feed config.Feed) (networks []string) {
+	for _, name := range feed.NetworkNames() {
+		if p.authoriser.Authorised(feed.Identifier, name) {
+			networks = append(networks, name)
 		}
-		return false
 	}
 
-	logrus.Debug("Got 429 Too Many Requests error")
-	return true
+	return
 }
@@ -0,0 +1,230 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package poller
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"informo-feeder/config"
+	"informo-feeder/database"
+	"informo-feeder/matrix"
+	"informo-feeder/publisher"
+	"informo-feeder/signing"
+	"informo-feeder/sources"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// testFeed is formatted with the URL of the feed's only item.
+const testFeed = `<?xml version="1.0"?>
+<rss version="2.0">
+	<channel>
+		<title>ACME News</title>
+		<item>
+			<title>Hello</title>
+			<link>%s</link>
+			<pubDate>Mon, 01 Jan 2018 00:00:00 +0000</pubDate>
+			<description>&lt;p&gt;Hello world&lt;/p&gt;</description>
+		</item>
+	</channel>
+</rss>
+`
+
+// testSigner signs with a key generated from a fixed seed. If blocked isn't
+// nil, signing tells it once it started, then waits for resume to be closed,
+// so a poll can be paused after it read the database but before it saves the
+// feed's new items.
+type testSigner struct {
+	priv    ed25519.PrivateKey
+	key     signing.Key
+	blocked chan struct{}
+	resume  chan struct{}
+	once    sync.Once
+}
+
+func newTestSigner(block bool) *testSigner {
+	pub, priv, err := ed25519.GenerateKey(bytes.NewReader(bytes.Repeat([]byte{1}, 32)))
+	if err != nil {
+		panic(err)
+	}
+
+	s := &testSigner{priv: priv, key: signing.Key{ID: "key1", PublicKey: pub}}
+	if block {
+		s.blocked = make(chan struct{})
+		s.resume = make(chan struct{})
+	}
+
+	return s
+}
+
+func (s *testSigner) Keys(identifier string) ([]signing.Key, error) {
+	return []signing.Key{s.key}, nil
+}
+
+func (s *testSigner) Sign(identifier string, keyID string, message []byte) ([]byte, error) {
+	if s.blocked != nil {
+		s.once.Do(func() {
+			close(s.blocked)
+			<-s.resume
+		})
+	}
+
+	return ed25519.Sign(s.priv, message), nil
+}
+
+func (s *testSigner) SignJSON(identifier string, keyID string, message []byte) ([]byte, error) {
+	return nil, errors.New("not implemented")
+}
+
+// newTestPoller returns a poller using its own connection to the given SQLite
+// database, as a feeder running on another host would.
+func newTestPoller(
+	t *testing.T, cfg *config.Config, dsn string, signer signing.Signer,
+) *Poller {
+	db, err := database.NewDatabase("sqlite3", dsn, true)
+	if err != nil {
+		t.Fatalf("NewDatabase: %v", err)
+	}
+
+	pool, err := matrix.NewPool(cfg, db)
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+
+	return NewPoller(
+		db, pool, publisher.NewPublisher(db, pool),
+		sources.NewAuthoriser(cfg, pool, signer), signer, cfg, nil,
+	)
+}
+
+func TestConcurrentPollers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "informo-feeder-poller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		version int
+		// otherItem is the URL of the item the second poller saves, if it isn't
+		// the same as the first poller's.
+		otherItem string
+		// wantNewItems is the number of new items the first poller must find
+		// when polling again after the conflict.
+		wantNewItems int
+		wantEvents   int
+	}{
+		// Both pollers generated the item's event with the same sequence.
+		{"same item, chained", config.SignatureVersionChained, "", 0, 1},
+		// Both pollers inserted the item.
+		{"same item, unchained", config.SignatureVersionBound, "", 0, 1},
+		// The chain's head moved between the first poller reading and
+		// advancing it.
+		{"other item, chained", config.SignatureVersionChained, "https://example.org/other", 1, 2},
+	}
+
+	for i, test := range tests {
+		feedA := writeTestFeed(t, dir, fmt.Sprintf("a%d.xml", i), "https://example.org/hello")
+		feedB := feedA
+		if len(test.otherItem) > 0 {
+			feedB = writeTestFeed(t, dir, fmt.Sprintf("b%d.xml", i), test.otherItem)
+		}
+
+		cfg := &config.Config{
+			Signing: config.SigningConfig{
+				Format:  config.SignatureFormatLegacy,
+				Version: test.version,
+			},
+			Matrix: config.MatrixConfig{
+				Homeserver:  "https://matrix.example.org",
+				AccessToken: "token",
+				MXID:        "@feeder:example.org",
+			},
+			Networks: map[string]*config.Network{
+				config.DefaultNetworkName: {
+					Room:            "!room:example.org",
+					RoomID:          "!room:example.org",
+					EventTypePrefix: "network.informo.news.",
+				},
+			},
+			Authorisation: config.AuthorisationConfig{Mode: config.AuthorisationModeOff},
+			Feeds:         []config.Feed{feedA},
+		}
+
+		dsn := filepath.Join(dir, fmt.Sprintf("%d.db", i))
+		blocking := newTestSigner(true)
+		a := newTestPoller(t, cfg, dsn, blocking)
+		b := newTestPoller(t, cfg, dsn, newTestSigner(false))
+
+		// Pause the first poller once it looked up the known items and the
+		// chain's head, and let the second one save its item meanwhile.
+		done := make(chan error)
+		go func() {
+			_, err := a.Poll(feedA)
+			done <- err
+		}()
+
+		<-blocking.blocked
+		if _, err = b.Poll(feedB); err != nil {
+			t.Fatalf("%s: second poller: %v", test.name, err)
+		}
+
+		close(blocking.resume)
+		if err = <-done; err == nil || !isRetryable(err) {
+			t.Errorf("%s: first poller: got %v, want a retryable conflict", test.name, err)
+		}
+
+		// The next poll of the first poller must take into account what the
+		// second one saved.
+		result, err := a.Poll(feedA)
+		if err != nil {
+			t.Errorf("%s: first poller's next poll: %v", test.name, err)
+		} else if result.NewItems != test.wantNewItems || result.Enqueued != test.wantNewItems {
+			t.Errorf(
+				"%s: first poller's next poll: got %+v, want %d new items enqueued",
+				test.name, result, test.wantNewItems,
+			)
+		}
+
+		count, _, err := a.db.CountOutboxEventsForFeed(feedA.Identifier)
+		if err != nil {
+			t.Fatalf("%s: CountOutboxEventsForFeed: %v", test.name, err)
+		}
+
+		if count != test.wantEvents {
+			t.Errorf("%s: got %d events in the outbox, want %d", test.name, count, test.wantEvents)
+		}
+	}
+}
+
+// writeTestFeed writes a feed with an item with the given URL into a file with
+// the given name in the given directory, and returns the feed reading it.
+func writeTestFeed(t *testing.T, dir string, name string, itemURL string) config.Feed {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(fmt.Sprintf(testFeed, itemURL)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return config.Feed{URL: "file://" + path, Identifier: "acmenews"}
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package poller
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// StartPruning starts an infinite loop that will:
+//     - remove from the database the items which haven't been seen in their
+//       feed for longer than the retention period (except the ones seen
+//       during the latest poll of their feed)
+//     - wait for a given time (specified in the configuration file)
+// Returns immediately if no retention period is configured. Failing to prune
+// the items isn't fatal, they will be pruned during the next iteration.
+func (p *Poller) StartPruning() {
+	retention := p.cfg.Database.Retention()
+	if retention == 0 {
+		return
+	}
+
+	for {
+		p.prune(retention)
+
+		// Wait before jumping to the next iteration.
+		time.Sleep(time.Duration(p.cfg.Database.PruneInterval) * time.Second)
+	}
+}
+
+// prune removes from the database the items which haven't been seen in their
+// feed for longer than the given retention period, and logs how many items were
+// removed for each feed.
+func (p *Poller) prune(retention time.Duration) {
+	pruned, err := p.db.PruneItems(retention, false)
+	if err != nil {
+		logrus.Errorf("Couldn't prune the items: %v", err)
+		return
+	}
+
+	for _, items := range pruned {
+		if len(items.URLs) == 0 {
+			continue
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"identifier": items.Feed,
+			"removed":    len(items.URLs),
+			"kept":       items.Kept,
+		}).Info("Pruned items")
+	}
+}
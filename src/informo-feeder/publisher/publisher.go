@@ -0,0 +1,348 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publisher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"informo-feeder/common"
+	"informo-feeder/database"
+	"informo-feeder/matrix"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// batchSize is the maximum number of events retrieved from the outbox at
+	// once.
+	batchSize = 50
+	// idleInterval is the time to wait before looking at the outbox again if
+	// it doesn't contain any event due for publication.
+	idleInterval = 30 * time.Second
+	// rateLimitDelay is the time to wait before retrying to send an event if
+	// the homeserver replied with a "429 Too Many Requests" error.
+	rateLimitDelay = 500 * time.Millisecond
+	// minRetryDelay and maxRetryDelay bound the exponential backoff applied to
+	// an event after a failed attempt to send it.
+	minRetryDelay = 5 * time.Second
+	maxRetryDelay = time.Hour
+	// maxAttempts is the number of failed attempts to send an event after
+	// which the feeder gives up on it, i.e. about a day with the backoff
+	// above.
+	maxAttempts = 30
+	// drainInterval is the time to wait before looking at the outbox again
+	// while draining it, if it only contains events that aren't due for a new
+	// attempt yet.
+	drainInterval = time.Second
+	// claimDuration is the time the events retrieved from the outbox are
+	// claimed for, so the other feeders sharing the database don't send them.
+	claimDuration = 10 * time.Minute
+	// claimMargin is the minimum time left on the claim of an event to try to
+	// send it, so it's not sent by another feeder meanwhile.
+	claimMargin = time.Minute
+)
+
+// errRateLimited is returned when sending an event if the homeserver kept
+// replying with "429 Too Many Requests" errors until the claim on the event was
+// about to expire.
+var errRateLimited = errors.New("The homeserver kept rate limiting the event until its claim was about to expire")
+
+// Publisher describes the worker in charge of draining the outbox, i.e.
+// sending to Matrix the events the pollers have prepared and stored in the
+// database.
+type Publisher struct {
+	db     *database.Database
+	pool   *matrix.Pool
+	notify chan struct{}
+}
+
+// NewPublisher instantiates a new Publisher.
+func NewPublisher(db *database.Database, pool *matrix.Pool) *Publisher {
+	return &Publisher{
+		db:   db,
+		pool: pool,
+		// The channel is buffered so that notifying the publisher never blocks,
+		// and several notifications received while the publisher is busy only
+		// trigger one new iteration.
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// Notify wakes the publisher up so it looks for new events in the outbox
+// without waiting for the end of its current idle period.
+func (p *Publisher) Notify() {
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Start starts an infinite loop that will:
+//     - retrieve and claim the events due for publication from the outbox
+//     - send each of them to Matrix, using the transaction ID computed when
+//       the event was enqueued so that retries are idempotent
+//     - remove each successfully sent event from the outbox, or schedule a new
+//       attempt with an exponential backoff if sending it failed
+//     - wait until it's notified about a new event or for a given time if the
+//       outbox doesn't contain any event due for publication
+// It is meant to be run in its own goroutine. If a fatal error is encountered
+// (i.e. the database can't be accessed), it panics rather than returning an
+// error.
+func (p *Publisher) Start() {
+	for {
+		events, err := p.claimEvents()
+		if err != nil {
+			logrus.Panic(err)
+		}
+
+		if err = p.publishEvents(events); err != nil {
+			logrus.Panic(err)
+		}
+
+		// Only wait if there wasn't enough events to fill the batch, else there
+		// may be more events due in the outbox.
+		if len(events) < batchSize {
+			select {
+			case <-p.notify:
+			case <-time.After(idleInterval):
+			}
+		}
+	}
+}
+
+// Drain sends the events generated from the given feeds from the outbox until
+// none of them is left, retrying the ones which sending failed according to
+// their backoff, or until the given timeout expires. The events of the other
+// feeds are left to the feeders running as daemons. It's meant to be used
+// instead of Start when the feeder only polls the feeds once.
+// Returns the number of events generated from the given feeds left in the
+// outbox, not counting the abandoned ones and the ones they hold back, or an
+// error if the database can't be accessed.
+func (p *Publisher) Drain(
+	feedIdentifiers []string, timeout time.Duration,
+) (left int, err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		// Only wait if there wasn't enough events to fill the batch of any
+		// feed, else there may be more events due in the outbox.
+		wait := true
+		left = 0
+		for _, feed := range feedIdentifiers {
+			now := nowMs()
+			var events []database.OutboxEvent
+			if events, err = p.db.ClaimPendingEventsForFeed(
+				feed, now, batchSize, now+int64(claimDuration/time.Millisecond),
+			); err != nil {
+				return
+			}
+
+			if err = p.publishEvents(events); err != nil {
+				return
+			}
+
+			var pending int
+			if pending, _, err = p.db.CountOutboxEventsForFeed(feed); err != nil {
+				return
+			}
+
+			left += pending
+			wait = wait && len(events) < batchSize
+		}
+
+		if left == 0 || !time.Now().Before(deadline) {
+			return
+		}
+
+		if wait {
+			time.Sleep(drainInterval)
+		}
+	}
+}
+
+// claimEvents claims a batch of events due for publication from the outbox,
+// and returns them.
+// Returns an error if the database can't be accessed.
+func (p *Publisher) claimEvents() ([]database.OutboxEvent, error) {
+	now := nowMs()
+	return p.db.ClaimPendingEvents(
+		now, batchSize, now+int64(claimDuration/time.Millisecond),
+	)
+}
+
+// publishEvents publishes the given claimed events from the outbox in order.
+// Once sending an event failed, the next events of the same feed into the same
+// network profile are skipped, so the events of a chain are never published
+// out of order. The events which claim is about to expire are skipped too,
+// along with the next events of their chain. The claims on the skipped events
+// are released, so they can be retrieved again right away.
+// Returns an error if updating the outbox failed.
+func (p *Publisher) publishEvents(events []database.OutboxEvent) error {
+	blocked := make(map[string]bool)
+	for _, e := range events {
+		chain := e.Feed + " " + e.Network
+		if !blocked[chain] && nowMs()+int64(claimMargin/time.Millisecond) >= e.ClaimedUntil {
+			blocked[chain] = true
+		}
+
+		if blocked[chain] {
+			if err := p.db.ReleaseEvent(e); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		sent, err := p.publish(e)
+		if err != nil {
+			return err
+		}
+
+		blocked[chain] = !sent
+	}
+
+	return nil
+}
+
+// publish sends an event from the outbox to Matrix, then either removes it
+// from the outbox or records the failed attempt. After too many failed
+// attempts, gives up on the event, which stays in the outbox and holds back the
+// next events of its chain until it's republished. If the
+// homeserver rate limited the event until its claim was about to expire,
+// releases the claim without recording a failed attempt.
+// Returns whether the event has been sent, or an error if updating the outbox
+// failed.
+func (p *Publisher) publish(e database.OutboxEvent) (bool, error) {
+	eventID, err := p.sendEvent(e)
+	if err == errRateLimited {
+		logrus.WithFields(logrus.Fields{
+			"feed":    e.Feed,
+			"network": e.Network,
+			"itemURL": e.ItemURL,
+		}).Warn(err)
+
+		return false, p.db.ReleaseEvent(e)
+	}
+
+	if err != nil && e.Attempts+1 >= maxAttempts {
+		logrus.WithFields(logrus.Fields{
+			"feed":     e.Feed,
+			"network":  e.Network,
+			"itemURL":  e.ItemURL,
+			"attempts": e.Attempts + 1,
+		}).Errorf("Giving up on the event until it's republished: %v", err)
+
+		return false, p.db.MarkEventAbandoned(e, e.Attempts+1, err.Error())
+	}
+
+	if err != nil {
+		attempts := e.Attempts + 1
+		delay := retryDelay(attempts)
+
+		logrus.WithFields(logrus.Fields{
+			"feed":     e.Feed,
+			"network":  e.Network,
+			"itemURL":  e.ItemURL,
+			"attempts": attempts,
+			"retryIn":  delay.String(),
+		}).Error(err)
+
+		return false, p.db.MarkEventFailed(
+			e, attempts, nowMs()+int64(delay/time.Millisecond), err.Error(),
+		)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"feed":    e.Feed,
+		"network": e.Network,
+		"itemURL": e.ItemURL,
+		"eventID": eventID,
+	}).Info("Event published")
+
+	return true, p.db.MarkEventSent(e, eventID)
+}
+
+// sendEvent sends an event from the outbox to Matrix using its transaction ID,
+// and waits then retries as long as the homeserver replies with a "429 Too
+// Many Requests" error and the claim on the event isn't about to expire. If the
+// homeserver rejects the access token, obtains a new one and retries.
+// Returns the ID of the event, errRateLimited if the claim was about to expire
+// while the homeserver was still rate limiting the event, or an error if the
+// homeserver replied with any other error.
+func (p *Publisher) sendEvent(e database.OutboxEvent) (eventID string, err error) {
+	session := p.pool.Session(e.Feed, e.Network)
+	if session == nil {
+		err = fmt.Errorf(
+			"Feed %s doesn't publish into network profile %s", e.Feed, e.Network,
+		)
+		return
+	}
+
+	content := json.RawMessage(e.Content)
+
+	var r *gomatrix.RespSendEvent
+	for {
+		// The access token is part of the URL, so the URL needs to be built
+		// again with the new client if the access token has been renewed.
+		client := session.Client()
+		accessToken := client.AccessToken
+		urlPath := client.BuildURL("rooms", e.RoomID, "send", e.EventType, e.TxnID)
+
+		_, err = client.MakeRequest("PUT", urlPath, content, &r)
+		if err == nil {
+			return r.EventID, nil
+		}
+
+		if session.RenewIfUnknownToken(err, accessToken) {
+			continue
+		}
+
+		if !common.IsTooManyRequestsError(err) {
+			return
+		}
+
+		// Wait if the error was "429 Too Many Requests", unless the event could
+		// be sent by another feeder by then.
+		if nowMs()+int64((rateLimitDelay+claimMargin)/time.Millisecond) >= e.ClaimedUntil {
+			return "", errRateLimited
+		}
+
+		time.Sleep(rateLimitDelay)
+	}
+}
+
+// retryDelay returns the time to wait before the next attempt to send an event
+// which sending failed the given number of times.
+func retryDelay(attempts int) time.Duration {
+	delay := minRetryDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay = delay * 2
+	}
+
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+
+	return delay
+}
+
+// nowMs returns the current time as a timestamp in milliseconds.
+func nowMs() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
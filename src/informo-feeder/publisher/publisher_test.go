@@ -0,0 +1,194 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publisher
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"informo-feeder/config"
+	"informo-feeder/database"
+	"informo-feeder/matrix"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, minRetryDelay},
+		{1, minRetryDelay},
+		{2, 2 * minRetryDelay},
+		{3, 4 * minRetryDelay},
+		{10, 512 * minRetryDelay},
+		{11, maxRetryDelay},
+		{maxAttempts, maxRetryDelay},
+		// The delay mustn't overflow however many attempts failed.
+		{1000, maxRetryDelay},
+	}
+
+	for _, test := range tests {
+		if got := retryDelay(test.attempts); got != test.want {
+			t.Errorf("%d attempts: got %s, want %s", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestRetryDelayIncreases(t *testing.T) {
+	previous := retryDelay(1)
+	for attempts := 2; attempts <= maxAttempts; attempts++ {
+		delay := retryDelay(attempts)
+		if delay < previous || delay > maxRetryDelay {
+			t.Errorf("%d attempts: got %s after %s", attempts, delay, previous)
+		}
+
+		previous = delay
+	}
+}
+
+// newTestPublisher returns a publisher sending the events of the given feeds to
+// a homeserver replying to every request with the given handler, along with its
+// database, which outbox contains one event for each given item URL of each
+// feed. The server must be closed once the test is done.
+func newTestPublisher(
+	t *testing.T, handler http.HandlerFunc, feeds []string, itemURLs ...string,
+) (*Publisher, *database.Database, *httptest.Server) {
+	server := httptest.NewServer(handler)
+
+	db, err := database.NewDatabase("sqlite3", ":memory:", true)
+	if err != nil {
+		t.Fatalf("NewDatabase: %v", err)
+	}
+
+	cfg := &config.Config{
+		Matrix: config.MatrixConfig{
+			Homeserver:  server.URL,
+			AccessToken: "token",
+			MXID:        "@feeder:example.org",
+		},
+		Networks: map[string]*config.Network{
+			config.DefaultNetworkName: {Room: "!room:example.org", RoomID: "!room:example.org"},
+		},
+	}
+
+	for _, feed := range feeds {
+		cfg.Feeds = append(cfg.Feeds, config.Feed{Identifier: feed})
+
+		var items []database.EnqueuedItem
+		for _, u := range itemURLs {
+			items = append(items, database.EnqueuedItem{
+				URL: u,
+				Events: []database.OutboxEvent{{
+					Network:   config.DefaultNetworkName,
+					RoomID:    "!room:example.org",
+					EventType: "network.informo.news." + feed,
+					TxnID:     feed + " " + u,
+					Content:   "{}",
+				}},
+			})
+		}
+
+		if err = db.SavePoll(feed, nil, items); err != nil {
+			t.Fatalf("SavePoll: %v", err)
+		}
+	}
+
+	pool, err := matrix.NewPool(cfg, db)
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+
+	return NewPublisher(db, pool), db, server
+}
+
+func TestDrainOnlyPublishesGivenFeeds(t *testing.T) {
+	var mutex sync.Mutex
+	sent := make(map[string]int)
+	pub, db, server := newTestPublisher(t, func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		sent[strings.Split(r.URL.Path, "/")[7]]++
+		mutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"event_id":"$event:example.org"}`)
+	}, []string{"acmenews", "othernews"}, "https://example.org/1", "https://example.org/2")
+	defer server.Close()
+
+	left, err := pub.Drain([]string{"acmenews"}, time.Minute)
+	if err != nil || left != 0 {
+		t.Fatalf("Drain: got %d events left (error: %v), want 0", left, err)
+	}
+
+	want := map[string]int{"network.informo.news.acmenews": 2}
+	if fmt.Sprint(sent) != fmt.Sprint(want) {
+		t.Errorf("got %v events sent, want %v", sent, want)
+	}
+
+	// The other feed's events must be left in the outbox.
+	if pending, _, err := db.CountOutboxEventsForFeed("othernews"); err != nil || pending != 2 {
+		t.Errorf("got %d events of the other feed left (error: %v), want 2", pending, err)
+	}
+}
+
+func TestRateLimitedEventReleased(t *testing.T) {
+	// The homeserver rate limits every request.
+	var requests int
+	pub, db, server := newTestPublisher(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests"}`)
+	}, []string{"acmenews"}, "https://example.org/hello")
+	defer server.Close()
+
+	// Claim the event for just long enough to try to send it a few times.
+	now := nowMs()
+	events, err := db.ClaimPendingEvents(
+		now, batchSize, now+int64((claimMargin+time.Second)/time.Millisecond),
+	)
+	if err != nil || len(events) != 1 {
+		t.Fatalf("ClaimPendingEvents: got %d events, %v", len(events), err)
+	}
+
+	sent, err := pub.publish(events[0])
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	if sent {
+		t.Error("publish: got a rate limited event sent")
+	}
+
+	if requests == 0 || nowMs() >= events[0].ClaimedUntil-int64(claimMargin/time.Millisecond) {
+		t.Errorf("got %d requests, stopped after the claim's deadline", requests)
+	}
+
+	// The event must be released without recording a failed attempt, so it
+	// can be claimed again right away.
+	events, err = db.ClaimPendingEvents(nowMs(), batchSize, nowMs()+int64(claimDuration/time.Millisecond))
+	if err != nil {
+		t.Fatalf("ClaimPendingEvents: %v", err)
+	}
+
+	if len(events) != 1 || events[0].Attempts != 0 {
+		t.Errorf("got %+v, want the event released without any failed attempt", events)
+	}
+}
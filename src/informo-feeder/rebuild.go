@@ -0,0 +1,206 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"informo-feeder/config"
+	"informo-feeder/database"
+	"informo-feeder/matrix"
+	"informo-feeder/sources"
+
+	"github.com/codegangsta/cli"
+)
+
+// rebuildCommand restores the database's state from the events the feeder
+// published into the networks' rooms, e.g. after the database was lost.
+var rebuildCommand = cli.Command{
+	Name:      "rebuild",
+	Usage:     "Restore the items, the history and the sources' chains from the events published into the networks' rooms for the given feeds (default: all feeds), so the next poll doesn't publish them again",
+	ArgsUsage: "[identifier...]",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "network",
+			Usage: "Only page through the room of this network profile (default: all the network profiles each feed publishes into)",
+		},
+		cli.IntFlag{
+			Name:  "limit",
+			Usage: "Maximum number of events to page through per feed and network profile, from the most recent one (default: all)",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Only report what would be restored",
+		},
+	},
+	Action: withConfig(rebuild),
+}
+
+// rebuild pages backwards through the history of the room of each network
+// profile the given feeds (or all feeds) publish into, and restores in the
+// database the items, the history and the head of the chain of each feed from
+// the events published for it. Only the events which signature is valid
+// against the feed's keys are restored, since the others weren't published by
+// the feeder. Prints out a report of what was restored for each feed and
+// network profile, followed by the events which were skipped. In dry-run mode,
+// works on a copy of the database (see database.NewDryRunDatabase), so it can
+// be used even if the database is lost or its schema is outdated.
+func rebuild(ctx *cli.Context, cfg *config.Config) error {
+	feeds, err := selectFeeds(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	var db *database.Database
+	if ctx.Bool("dry-run") {
+		db, err = database.NewDryRunDatabase(cfg.Database.Driver, cfg.Database.DSN)
+	} else {
+		db, err = database.NewDatabase(cfg.Database.Driver, cfg.Database.DSN, true)
+	}
+	if err != nil {
+		return err
+	}
+
+	pool, err := matrix.NewPool(cfg, db)
+	if err != nil {
+		return err
+	}
+
+	if err = pool.ResolveRooms(); err != nil {
+		return err
+	}
+
+	signer := newSigner(cfg)
+
+	var skipped []skippedEvent
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FEED\tNETWORK\tEVENTS\tSKIPPED\tITEMS\tHISTORY\tCHAIN")
+	for _, feed := range feeds {
+		names := feed.NetworkNames()
+		if name := ctx.String("network"); len(name) > 0 {
+			names = []string{name}
+		}
+
+		keys, err := signer.Keys(feed.Identifier)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			session := pool.Session(feed.Identifier, name)
+			if session == nil {
+				return cli.NewExitError(fmt.Sprintf(
+					"Feed %s doesn't publish into network profile %s",
+					feed.Identifier, name,
+				), exitUsage)
+			}
+
+			network := cfg.Networks[name]
+			verifications, err := sources.Verify(
+				session, network.RoomID, network.EventType(feed.Identifier),
+				feed.Identifier, keys, ctx.Int("limit"),
+			)
+			if err != nil {
+				return err
+			}
+
+			// Restore the events in the order they were published.
+			var events []database.RecoveredEvent
+			for i := len(verifications) - 1; i >= 0; i-- {
+				v := verifications[i]
+				if v.Status != sources.StatusValid {
+					skipped = append(skipped, skippedEvent{feed.Identifier, name, v})
+					continue
+				}
+
+				events = append(events, database.RecoveredEvent{
+					EventID:   v.EventID,
+					ItemURL:   v.Link,
+					Headline:  v.Headline,
+					RoomID:    network.RoomID,
+					EventType: network.EventType(feed.Identifier),
+					KeyID:     v.KeyID,
+					Signature: v.Signature,
+					Hash:      v.Hash,
+					Sequence:  v.Sequence,
+					Timestamp: v.Timestamp,
+				})
+			}
+
+			restored, err := db.RestoreEvents(
+				feed.Identifier, name, events, ctx.Bool("dry-run"),
+			)
+			if err != nil {
+				return err
+			}
+
+			chain := "-"
+			if restored.Sequence > 0 {
+				chain = strconv.FormatInt(restored.Sequence, 10)
+			}
+
+			fmt.Fprintf(
+				w, "%s\t%s\t%d\t%d\t%d\t%d\t%s\n", feed.Identifier, name,
+				len(events), len(verifications)-len(events), restored.Items,
+				restored.History, chain,
+			)
+		}
+	}
+
+	if err = w.Flush(); err != nil {
+		return err
+	}
+
+	return printSkippedEvents(skipped)
+}
+
+// skippedEvent is an event which wasn't restored when rebuilding the database,
+// since its signature isn't valid against the keys of the feed it was found
+// for.
+type skippedEvent struct {
+	feed         string
+	network      string
+	verification sources.Verification
+}
+
+// printSkippedEvents prints out the given skipped events, with the outcome of
+// the verification of their signature (see sources.Verify), so the operator can
+// tell whether the feeder really didn't publish them.
+// Returns an error if writing failed.
+func printSkippedEvents(skipped []skippedEvent) error {
+	if len(skipped) == 0 {
+		return nil
+	}
+
+	fmt.Printf(
+		"\n%d event(s) skipped since their signature isn't valid against the feed's keys:\n",
+		len(skipped),
+	)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FEED\tNETWORK\tEVENT\tSENDER\tSTATUS")
+	for _, s := range skipped {
+		fmt.Fprintf(
+			w, "%s\t%s\t%s\t%s\t%s\n", s.feed, s.network,
+			s.verification.EventID, s.verification.Sender, s.verification.Status,
+		)
+	}
+
+	return w.Flush()
+}
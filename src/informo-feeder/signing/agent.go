@@ -0,0 +1,282 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// agentMethodKeys is the method of the requests asking the agent for the
+	// keys of a source.
+	agentMethodKeys = "keys"
+	// agentMethodSign is the method of the requests asking the agent to sign
+	// a message.
+	agentMethodSign = "sign"
+	// agentMethodSignJSON is the method of the requests asking the agent to
+	// sign a JSON object the way Matrix does.
+	agentMethodSignJSON = "sign_json"
+
+	// agentTimeout is the maximum time a request to the agent can take,
+	// including connecting to it.
+	agentTimeout = 10 * time.Second
+)
+
+// agentRequest is a request sent to the signing agent. Each request is sent
+// as JSON over its own connection to the agent's Unix socket.
+type agentRequest struct {
+	Method     string `json:"method"`
+	Identifier string `json:"identifier"`
+	KeyID      string `json:"key_id,omitempty"`
+	Message    []byte `json:"message,omitempty"` // Encoded as base64
+}
+
+// agentKey is the description of a key sent by the signing agent. The bounds
+// of the validity period are timestamps in seconds, 0 meaning the period isn't
+// bounded on this side.
+type agentKey struct {
+	ID         string `json:"id"`
+	PublicKey  []byte `json:"public_key"` // Encoded as base64
+	ValidFrom  int64  `json:"valid_from,omitempty"`
+	ValidUntil int64  `json:"valid_until,omitempty"`
+}
+
+// agentResponse is the response sent by the signing agent to a request.
+type agentResponse struct {
+	Keys       []agentKey `json:"keys,omitempty"`
+	Signature  []byte     `json:"signature,omitempty"`   // Encoded as base64
+	SignedJSON []byte     `json:"signed_json,omitempty"` // Encoded as base64
+	Error      string     `json:"error,omitempty"`
+}
+
+// AgentSigner is a Signer delegating the signatures to a signing agent
+// listening on a Unix socket, so that the keys never need to be loaded into
+// the feeder's memory.
+type AgentSigner struct {
+	socketPath string
+}
+
+// NewAgentSigner instantiates a new AgentSigner talking to the agent listening
+// on the given Unix socket.
+func NewAgentSigner(socketPath string) *AgentSigner {
+	return &AgentSigner{socketPath: socketPath}
+}
+
+// Keys implements Signer.
+func (s *AgentSigner) Keys(identifier string) (keys []Key, err error) {
+	resp, err := s.request(agentRequest{
+		Method:     agentMethodKeys,
+		Identifier: identifier,
+	})
+	if err != nil {
+		return
+	}
+
+	for _, key := range resp.Keys {
+		keys = append(keys, Key{
+			ID:         key.ID,
+			PublicKey:  key.PublicKey,
+			ValidFrom:  fromTimestamp(key.ValidFrom),
+			ValidUntil: fromTimestamp(key.ValidUntil),
+		})
+	}
+
+	return
+}
+
+// Sign implements Signer.
+func (s *AgentSigner) Sign(
+	identifier string, keyID string, message []byte,
+) ([]byte, error) {
+	resp, err := s.request(agentRequest{
+		Method:     agentMethodSign,
+		Identifier: identifier,
+		KeyID:      keyID,
+		Message:    message,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Signature, nil
+}
+
+// SignJSON implements Signer.
+func (s *AgentSigner) SignJSON(
+	identifier string, keyID string, message []byte,
+) ([]byte, error) {
+	resp, err := s.request(agentRequest{
+		Method:     agentMethodSignJSON,
+		Identifier: identifier,
+		KeyID:      keyID,
+		Message:    message,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.SignedJSON, nil
+}
+
+// request sends the given request to the agent and returns its response.
+// Returns an error if the agent couldn't be reached or replied with an error.
+func (s *AgentSigner) request(req agentRequest) (resp agentResponse, err error) {
+	conn, err := net.DialTimeout("unix", s.socketPath, agentTimeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if err = conn.SetDeadline(time.Now().Add(agentTimeout)); err != nil {
+		return
+	}
+
+	if err = json.NewEncoder(conn).Encode(req); err != nil {
+		return
+	}
+
+	if err = json.NewDecoder(conn).Decode(&resp); err != nil {
+		return
+	}
+
+	if len(resp.Error) > 0 {
+		err = fmt.Errorf("Signing agent error: %s", resp.Error)
+	}
+
+	return
+}
+
+// ServeAgent accepts connections on the given listener and answers the
+// requests sent by AgentSigner instances with the given signer. It only signs
+// with keys that are currently valid.
+// Returns an error if accepting a connection failed.
+func ServeAgent(listener net.Listener, signer Signer) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go handleAgentConn(conn, signer)
+	}
+}
+
+// handleAgentConn reads a request from the given connection, processes it with
+// the given signer and writes the response, then closes the connection.
+func handleAgentConn(conn net.Conn, signer Signer) {
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(agentTimeout)); err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	var req agentRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		logrus.WithField("error", err).Warn("Invalid request")
+		return
+	}
+
+	resp, err := processAgentRequest(req, signer)
+	if err != nil {
+		resp = agentResponse{Error: err.Error()}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"method":     req.Method,
+		"identifier": req.Identifier,
+		"keyID":      req.KeyID,
+		"error":      resp.Error,
+	}).Info("Processed request")
+
+	if err = json.NewEncoder(conn).Encode(resp); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// processAgentRequest processes a request sent to the agent with the given
+// signer.
+// Returns an error if the request is invalid or couldn't be processed.
+func processAgentRequest(req agentRequest, signer Signer) (resp agentResponse, err error) {
+	keys, err := signer.Keys(req.Identifier)
+	if err != nil {
+		return
+	}
+
+	switch req.Method {
+	case agentMethodKeys:
+		for _, key := range keys {
+			resp.Keys = append(resp.Keys, agentKey{
+				ID:         key.ID,
+				PublicKey:  key.PublicKey,
+				ValidFrom:  toTimestamp(key.ValidFrom),
+				ValidUntil: toTimestamp(key.ValidUntil),
+			})
+		}
+
+	case agentMethodSign, agentMethodSignJSON:
+		// Only sign with currently valid keys, so an attacker controlling the
+		// feeder can't sign content with a key which validity has ended.
+		var valid bool
+		for _, key := range keys {
+			if key.ID == req.KeyID && key.ValidAt(time.Now()) {
+				valid = true
+			}
+		}
+
+		if !valid {
+			err = fmt.Errorf("Source %s has no valid key %s", req.Identifier, req.KeyID)
+			return
+		}
+
+		if req.Method == agentMethodSign {
+			resp.Signature, err = signer.Sign(req.Identifier, req.KeyID, req.Message)
+		} else {
+			resp.SignedJSON, err = signer.SignJSON(req.Identifier, req.KeyID, req.Message)
+		}
+
+	default:
+		err = errors.New("Unknown method " + req.Method)
+	}
+
+	return
+}
+
+// toTimestamp converts the given time to a timestamp in seconds, or 0 if it's
+// a zero time.
+func toTimestamp(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.Unix()
+}
+
+// fromTimestamp converts the given timestamp in seconds to a time, or a zero
+// time if it's 0.
+func fromTimestamp(ts int64) time.Time {
+	if ts == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(ts, 0)
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signing
+
+import (
+	"fmt"
+
+	"informo-feeder/config"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+// LocalSigner is a Signer using the keys loaded in memory from the keys
+// directory.
+type LocalSigner struct {
+	keys *config.KeysConfig
+}
+
+// NewLocalSigner instantiates a new LocalSigner using the given keys.
+func NewLocalSigner(keys *config.KeysConfig) *LocalSigner {
+	return &LocalSigner{keys: keys}
+}
+
+// Keys implements Signer.
+func (s *LocalSigner) Keys(identifier string) ([]Key, error) {
+	if err, ok := s.keys.LoadErrors[identifier]; ok {
+		return nil, err
+	}
+
+	sourceKeys, ok := s.keys.Sources[identifier]
+	if !ok {
+		return nil, fmt.Errorf("No key loaded for source %s", identifier)
+	}
+
+	keys := make([]Key, 0, len(sourceKeys))
+	for _, key := range sourceKeys {
+		keys = append(keys, Key{
+			ID:         key.ID,
+			PublicKey:  key.PublicKey,
+			ValidFrom:  key.ValidFrom,
+			ValidUntil: key.ValidUntil,
+		})
+	}
+
+	return keys, nil
+}
+
+// Sign implements Signer.
+func (s *LocalSigner) Sign(
+	identifier string, keyID string, message []byte,
+) ([]byte, error) {
+	key := s.keys.Key(identifier, keyID)
+	if key == nil {
+		return nil, fmt.Errorf("Source %s has no key %s", identifier, keyID)
+	}
+
+	return ed25519.Sign(key.PrivateKey, message), nil
+}
+
+// SignJSON implements Signer.
+func (s *LocalSigner) SignJSON(
+	identifier string, keyID string, message []byte,
+) ([]byte, error) {
+	key := s.keys.Key(identifier, keyID)
+	if key == nil {
+		return nil, fmt.Errorf("Source %s has no key %s", identifier, keyID)
+	}
+
+	return gomatrixserverlib.SignJSON(
+		identifier, gomatrixserverlib.KeyID(keyID), key.PrivateKey, message,
+	)
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signing
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// Key describes one of a source's keys, without its private part.
+type Key struct {
+	ID         string
+	PublicKey  ed25519.PublicKey
+	ValidFrom  time.Time
+	ValidUntil time.Time
+}
+
+// ValidAt returns true if the key is valid at the given time. A zero ValidFrom
+// or ValidUntil means the validity period isn't bounded on this side.
+func (k Key) ValidAt(t time.Time) bool {
+	if !k.ValidFrom.IsZero() && t.Before(k.ValidFrom) {
+		return false
+	}
+
+	return k.ValidUntil.IsZero() || t.Before(k.ValidUntil)
+}
+
+// Signer signs messages on behalf of sources, without necessarily exposing the
+// sources' private keys to the caller.
+type Signer interface {
+	// Keys returns the keys of the given source, sorted by the start of their
+	// validity period.
+	// Returns an error if the source is unknown or its keys couldn't be
+	// retrieved.
+	Keys(identifier string) ([]Key, error)
+	// Sign signs the given message with the key of the given source which ID
+	// is given.
+	// Returns an error if there's no such key or if the message couldn't be
+	// signed.
+	Sign(identifier string, keyID string, message []byte) ([]byte, error)
+	// SignJSON signs the given JSON object with the key of the given source
+	// which ID is given, the way Matrix signs JSON objects (i.e. with
+	// gomatrixserverlib.SignJSON), the source's identifier being the signing
+	// entity. Returns a copy of the object with the signature added to its
+	// "signatures" property.
+	// Returns an error if there's no such key or if the message isn't a JSON
+	// object.
+	SignJSON(identifier string, keyID string, message []byte) ([]byte, error)
+}
+
+// ActiveKey returns the key to sign the given source's content with, i.e. the
+// currently valid key which validity period started last.
+// Returns an error if the keys couldn't be retrieved or if the source has no
+// valid key.
+func ActiveKey(signer Signer, identifier string) (active Key, err error) {
+	keys, err := signer.Keys(identifier)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	var found bool
+	for _, key := range keys {
+		if key.ValidAt(now) {
+			active, found = key, true
+		}
+	}
+
+	if !found {
+		err = fmt.Errorf("Source %s has no valid key", identifier)
+	}
+
+	return
+}
+
+// SignContent signs the canonical JSON serialisation of the given content with
+// the given key of the given source, using the given signer, and returns the
+// signature encoded as base64.
+// Returns an error if the content couldn't be serialised or signed.
+func SignContent(
+	signer Signer, identifier string, keyID string, content interface{},
+) (string, error) {
+	canonical, err := CanonicalJSON(content)
+	if err != nil {
+		return "", err
+	}
+
+	signature, err := signer.Sign(identifier, keyID, canonical)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// SignContentJSON signs the given content with the given key of the given
+// source the way Matrix signs JSON objects, using the given signer, and
+// updates the content with the signed JSON object, which means the content's
+// type must include the "signatures" property.
+// Returns an error if the content couldn't be serialised or signed.
+func SignContentJSON(
+	signer Signer, identifier string, keyID string, content interface{},
+) error {
+	message, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+
+	signed, err := signer.SignJSON(identifier, keyID, message)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(signed, content)
+}
@@ -0,0 +1,145 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signing
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+var (
+	// ErrInvalidSignature is returned if a signature doesn't match the signed
+	// content and the public key it is checked against.
+	ErrInvalidSignature = errors.New("Invalid signature")
+	// ErrMalformedSignature is returned if a signature isn't a base64-encoded
+	// ed25519 signature.
+	ErrMalformedSignature = errors.New("Malformed signature")
+)
+
+// CanonicalJSON serialises the given content as canonical JSON, which is what
+// is signed. The content is expected to omit its signature when serialised if
+// the signature is empty.
+// Returns an error if the content couldn't be serialised.
+func CanonicalJSON(content interface{}) ([]byte, error) {
+	jsonBytes, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+
+	return gomatrixserverlib.CanonicalJSON(jsonBytes)
+}
+
+// Sign signs the canonical JSON serialisation of the given content with the
+// given private key, and returns the signature encoded as base64.
+// Returns an error if the content couldn't be serialised.
+func Sign(priv ed25519.PrivateKey, content interface{}) (string, error) {
+	canonical, err := CanonicalJSON(content)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(priv, canonical)), nil
+}
+
+// Verify checks the given base64-encoded signature against the canonical JSON
+// serialisation of the given content and the given public key.
+// Returns ErrInvalidSignature if the signature doesn't match,
+// ErrMalformedSignature if the signature couldn't be decoded, or an error if
+// the content couldn't be serialised.
+func Verify(pub ed25519.PublicKey, content interface{}, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return ErrMalformedSignature
+	}
+
+	canonical, err := CanonicalJSON(content)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(pub, canonical, sig) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// VerifyJSON checks the signature made with the given key of the given source
+// on the given JSON object, in the format Matrix uses for signed JSON objects,
+// against the key's public key.
+// Returns ErrMalformedSignature if the object has no signature made with this
+// key or if the signature couldn't be decoded, ErrInvalidSignature if the
+// signature doesn't match, or an error if the object couldn't be parsed.
+func VerifyJSON(
+	pub ed25519.PublicKey, identifier string, keyID string, message []byte,
+) error {
+	var object struct {
+		Signatures map[string]map[string]string `json:"signatures"`
+	}
+	if err := json.Unmarshal(message, &object); err != nil {
+		return err
+	}
+
+	// Matrix uses unpadded base64, and the padding would make the check below
+	// fail anyway.
+	sig, err := base64.RawStdEncoding.DecodeString(
+		object.Signatures[identifier][keyID],
+	)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return ErrMalformedSignature
+	}
+
+	err = gomatrixserverlib.VerifyJSON(
+		identifier, gomatrixserverlib.KeyID(keyID), pub, message,
+	)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// Nonce generates a random nonce to include in signed content, encoded as
+// unpadded base64.
+// Returns an error if the random generator failed.
+func Nonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.RawStdEncoding.EncodeToString(nonce), nil
+}
+
+// ContentHash returns the SHA-256 hash of the canonical form of the given JSON
+// content, encoded as unpadded base64. This is the hash the next event of a
+// chain refers to.
+// Returns an error if the content isn't valid JSON.
+func ContentHash(content []byte) (string, error) {
+	canonical, err := gomatrixserverlib.CanonicalJSON(content)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(canonical)
+	return base64.RawStdEncoding.EncodeToString(hash[:]), nil
+}
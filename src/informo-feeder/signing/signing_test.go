@@ -0,0 +1,175 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signing
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+// testContent is signed the way the feeder signs the news: its signature is
+// omitted from the signed JSON when empty.
+type testContent struct {
+	Headline  string `json:"headline"`
+	Link      string `json:"link"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// newTestKey returns a key pair generated from the given seed byte, so the
+// tests are deterministic.
+func newTestKey(b byte) (ed25519.PublicKey, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(bytes.NewReader(bytes.Repeat([]byte{b}, 32)))
+	if err != nil {
+		panic(err)
+	}
+
+	return pub, priv
+}
+
+func TestVerify(t *testing.T) {
+	pub, priv := newTestKey(1)
+	otherPub, _ := newTestKey(2)
+
+	content := testContent{Headline: "Headline", Link: "https://example.org/1"}
+	signature, err := Sign(priv, content)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+
+	altered := content
+	altered.Headline = "Altered headline"
+
+	// Flip a bit of the signature, keeping it well-formed.
+	sig, _ := base64.StdEncoding.DecodeString(signature)
+	sig[0] ^= 1
+	flipped := base64.StdEncoding.EncodeToString(sig)
+
+	tests := []struct {
+		name      string
+		pub       ed25519.PublicKey
+		content   interface{}
+		signature string
+		want      error
+	}{
+		{"valid", pub, content, signature, nil},
+		{"altered content", pub, altered, signature, ErrInvalidSignature},
+		{"other key", otherPub, content, signature, ErrInvalidSignature},
+		{"flipped bit", pub, content, flipped, ErrInvalidSignature},
+		{"not base64", pub, content, "not base64!", ErrMalformedSignature},
+		{"truncated", pub, content, signature[:40], ErrMalformedSignature},
+		{"empty", pub, content, "", ErrMalformedSignature},
+		// The keys' order doesn't matter, since the canonical JSON is signed.
+		{"same JSON", pub, map[string]string{
+			"link": content.Link, "headline": content.Headline,
+		}, signature, nil},
+	}
+
+	for _, test := range tests {
+		if err := Verify(test.pub, test.content, test.signature); err != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestSignOmitsEmptySignature(t *testing.T) {
+	pub, priv := newTestKey(1)
+
+	// A signed content carries its signature, which mustn't be part of what
+	// is verified.
+	content := testContent{Headline: "Headline", Link: "https://example.org/1"}
+	signature, err := Sign(priv, content)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+
+	content.Signature = signature
+	if err = Verify(pub, content, signature); err != ErrInvalidSignature {
+		t.Errorf("got %v verifying with the signature set, want %v", err, ErrInvalidSignature)
+	}
+
+	content.Signature = ""
+	if err = Verify(pub, content, signature); err != nil {
+		t.Errorf("got %v verifying with the signature removed", err)
+	}
+}
+
+func TestVerifyJSON(t *testing.T) {
+	pub, priv := newTestKey(1)
+	otherPub, _ := newTestKey(2)
+
+	message := []byte(`{"headline":"Headline","link":"https://example.org/1"}`)
+	signed, err := gomatrixserverlib.SignJSON("acmenews", "ed25519:1", priv, message)
+	if err != nil {
+		t.Fatalf("SignJSON: %v", err)
+	}
+
+	// Matrix encodes the signatures without padding.
+	sig := signatureOf(t, signed, "acmenews", "ed25519:1")
+	padded := []byte(strings.Replace(string(signed), sig, sig+"==", 1))
+
+	tests := []struct {
+		name       string
+		pub        ed25519.PublicKey
+		identifier string
+		keyID      string
+		message    []byte
+		want       error
+	}{
+		{"valid", pub, "acmenews", "ed25519:1", signed, nil},
+		{"padded signature", pub, "acmenews", "ed25519:1", padded, ErrMalformedSignature},
+		{"other key", otherPub, "acmenews", "ed25519:1", signed, ErrInvalidSignature},
+		{"altered content", pub, "acmenews", "ed25519:1", []byte(
+			strings.Replace(string(signed), "Headline", "Altered", 1),
+		), ErrInvalidSignature},
+		// The signature of a source can't be passed off as another source's.
+		{"other source", pub, "othernews", "ed25519:1", signed, ErrMalformedSignature},
+		{"other key ID", pub, "acmenews", "ed25519:2", signed, ErrMalformedSignature},
+		{"unsigned", pub, "acmenews", "ed25519:1", message, ErrMalformedSignature},
+		{"malformed signature", pub, "acmenews", "ed25519:1", []byte(
+			`{"signatures":{"acmenews":{"ed25519:1":"not base64!"}}}`,
+		), ErrMalformedSignature},
+	}
+
+	for _, test := range tests {
+		err := VerifyJSON(test.pub, test.identifier, test.keyID, test.message)
+		if err != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	if err = VerifyJSON(pub, "acmenews", "ed25519:1", []byte("not JSON")); err == nil {
+		t.Error("got no error verifying a message which isn't JSON")
+	}
+}
+
+// signatureOf returns the signature made with the given key of the given
+// source on the given signed JSON object.
+func signatureOf(t *testing.T, signed []byte, identifier string, keyID string) string {
+	var object struct {
+		Signatures map[string]map[string]string `json:"signatures"`
+	}
+	if err := json.Unmarshal(signed, &object); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	return object.Signatures[identifier][keyID]
+}
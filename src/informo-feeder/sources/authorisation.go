@@ -0,0 +1,238 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sources
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+
+	"informo-feeder/common"
+	"informo-feeder/config"
+	"informo-feeder/matrix"
+	"informo-feeder/signing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Authoriser checks, by reading the sources' registrations from the rooms'
+// state, that the feeder's accounts are authorised to publish the sources it
+// polls into the networks they publish into, and that the sources' public keys
+// match with the registered ones. It keeps track of the outcome of the last
+// check for each source and network.
+type Authoriser struct {
+	cfg    *config.Config
+	pool   *matrix.Pool
+	signer signing.Signer
+	// authorised maps a key identifying a source on a network (as returned by
+	// authorisationKey) to whether the last check succeeded. A missing entry
+	// means the source hasn't been checked on this network yet.
+	authorised map[string]bool
+	mutex      sync.RWMutex
+}
+
+// NewAuthoriser instantiates a new Authoriser.
+func NewAuthoriser(
+	cfg *config.Config, pool *matrix.Pool, signer signing.Signer,
+) *Authoriser {
+	return &Authoriser{
+		cfg:        cfg,
+		pool:       pool,
+		signer:     signer,
+		authorised: make(map[string]bool),
+	}
+}
+
+// Authorised returns false if the feeder must not publish the given source
+// into the given network, i.e. if the authorisation check is enforced and the
+// last check for this source and network didn't succeed (or didn't happen
+// yet). Returns true otherwise.
+func (a *Authoriser) Authorised(identifier string, networkName string) bool {
+	if !a.cfg.Authorisation.Enforced() {
+		return true
+	}
+
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	return a.authorised[authorisationKey(identifier, networkName)]
+}
+
+// Check checks every source on every network it publishes into, logs a
+// diagnostic for each failed check, and records the outcome. If the
+// registration of a source couldn't be retrieved (e.g. because the homeserver
+// can't be reached), the outcome of the previous check is kept. Does nothing
+// if the authorisation check is disabled.
+func (a *Authoriser) Check() {
+	if a.cfg.Authorisation.Mode == config.AuthorisationModeOff {
+		return
+	}
+
+	for _, feed := range a.cfg.Feeds {
+		for _, name := range feed.NetworkNames() {
+			a.checkSource(feed.Identifier, name)
+		}
+	}
+}
+
+// Start starts an infinite loop that checks the sources at the interval
+// specified in the configuration file. It is meant to be run in its own
+// goroutine, after a first call to Check. Does nothing if the authorisation
+// check is disabled.
+func (a *Authoriser) Start() {
+	if a.cfg.Authorisation.Mode == config.AuthorisationModeOff {
+		return
+	}
+
+	interval := time.Duration(a.cfg.Authorisation.CheckInterval) * time.Second
+	for {
+		time.Sleep(interval)
+		a.Check()
+	}
+}
+
+// checkSource checks a source on a network, and logs the outcome.
+func (a *Authoriser) checkSource(identifier string, networkName string) {
+	logger := logrus.WithFields(logrus.Fields{
+		"identifier": identifier,
+		"network":    networkName,
+	})
+
+	session := a.pool.Session(identifier, networkName)
+	if session == nil {
+		return
+	}
+
+	network := a.cfg.Networks[networkName]
+
+	var reg common.SourceRegistration
+	err := requestWithRenewal(session, func() error {
+		return session.Client().StateEvent(
+			network.RoomID, common.SourceEventType, network.EventType(identifier),
+			&reg,
+		)
+	})
+
+	if err != nil && !matrix.IsNotFoundError(err) {
+		logger.WithField("error", err).Error("Couldn't retrieve the source's registration")
+		return
+	}
+
+	var problem string
+	if err != nil {
+		problem = fmt.Sprintf(
+			"The source isn't registered on this network (no %s state event with state key %s)",
+			common.SourceEventType, network.EventType(identifier),
+		)
+	} else {
+		problem = a.checkRegistration(identifier, session.Client().UserID, reg)
+	}
+
+	a.mutex.Lock()
+	a.authorised[authorisationKey(identifier, networkName)] = len(problem) == 0
+	a.mutex.Unlock()
+
+	if len(problem) == 0 {
+		logger.Info("Authorisation checked")
+		return
+	}
+
+	if a.cfg.Authorisation.Enforced() {
+		logger.Error(problem + ", refusing to publish the source on this network")
+	} else {
+		logger.Warn(problem + ", the source's news may not be verified by the users")
+	}
+}
+
+// checkRegistration compares the given registration with the Matrix ID of the
+// account the given source is published with and with the source's valid keys.
+// Also checks the registration's signature. A missing or invalid signature is a
+// problem if the authorisation check is enforced, and only logs a warning
+// otherwise, since the registration may have been edited by an administrator.
+// Returns a description of the problem found, or an empty string if the
+// registration matches.
+func (a *Authoriser) checkRegistration(
+	identifier string, mxid string, reg common.SourceRegistration,
+) string {
+	if reg.Publisher != mxid {
+		return fmt.Sprintf(
+			"%s isn't an authorised publisher for the source (the authorised publisher is %s)",
+			mxid, reg.Publisher,
+		)
+	}
+
+	// The registered key may be any of the source's currently valid keys, since
+	// the registration may not have been updated yet after a key rotation.
+	keys, err := a.signer.Keys(identifier)
+	if err != nil {
+		return fmt.Sprintf("Couldn't retrieve the source's keys: %v", err)
+	}
+
+	key, ok := registeredKey(keys, reg.PublicKey)
+	if !ok {
+		return fmt.Sprintf(
+			"The registered public key (%s) doesn't match with any of the source's valid keys",
+			reg.PublicKey,
+		)
+	}
+
+	if active, err := signing.ActiveKey(a.signer, identifier); err == nil && active.ID != key.ID {
+		logrus.WithFields(logrus.Fields{
+			"identifier":   identifier,
+			"registeredID": key.ID,
+			"activeID":     active.ID,
+		}).Warn("The registered key isn't the source's active key, the registration should be updated")
+	}
+
+	signature := reg.Signature
+	reg.Signature = ""
+
+	var problem string
+	if len(signature) == 0 {
+		problem = "The source's registration isn't signed"
+	} else if err := signing.Verify(key.PublicKey, reg, signature); err != nil {
+		problem = fmt.Sprintf(
+			"The source's registration isn't signed by the source's key: %v", err,
+		)
+	}
+
+	if len(problem) > 0 && !a.cfg.Authorisation.Enforced() {
+		logrus.WithField("identifier", identifier).Warn(problem)
+		return ""
+	}
+
+	return problem
+}
+
+// registeredKey returns the currently valid key among the given ones which
+// public key is the given base64-encoded public key. Returns false if there's
+// none.
+func registeredKey(keys []signing.Key, publicKey string) (signing.Key, bool) {
+	now := time.Now()
+	for _, key := range keys {
+		if key.ValidAt(now) && base64.StdEncoding.EncodeToString(key.PublicKey) == publicKey {
+			return key, true
+		}
+	}
+
+	return signing.Key{}, false
+}
+
+// authorisationKey returns a key identifying a source on a network.
+func authorisationKey(identifier string, networkName string) string {
+	return identifier + " " + networkName
+}
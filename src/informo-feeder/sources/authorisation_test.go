@@ -0,0 +1,138 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sources
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"informo-feeder/common"
+	"informo-feeder/config"
+	"informo-feeder/signing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	testIdentifier = "acmenews"
+	testPublisher  = "@feeder:example.org"
+)
+
+// testKey is a key of the source, and otherKey a key it doesn't know about.
+var testKey, testPriv = newTestKey(1, "key1")
+var _, otherPriv = newTestKey(2, "key1")
+
+// newTestKey returns a key with the given ID generated from the given seed
+// byte, so the tests are deterministic, along with its private part.
+func newTestKey(b byte, id string) (signing.Key, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(bytes.NewReader(bytes.Repeat([]byte{b}, 32)))
+	if err != nil {
+		panic(err)
+	}
+
+	return signing.Key{ID: id, PublicKey: pub}, priv
+}
+
+// testSigner is a signer only knowing about the test source's key.
+type testSigner struct{}
+
+func (testSigner) Keys(identifier string) ([]signing.Key, error) {
+	return []signing.Key{testKey}, nil
+}
+
+func (testSigner) Sign(identifier string, keyID string, message []byte) ([]byte, error) {
+	return ed25519.Sign(testPriv, message), nil
+}
+
+func (testSigner) SignJSON(identifier string, keyID string, message []byte) ([]byte, error) {
+	return nil, errors.New("not implemented")
+}
+
+// signedRegistration returns the test source's registration, signed with the
+// given private key unless it's nil, after applying the given change to it.
+func signedRegistration(
+	t *testing.T, priv ed25519.PrivateKey, alter func(*common.SourceRegistration),
+) common.SourceRegistration {
+	reg := common.SourceRegistration{
+		Identifier: testIdentifier,
+		EventType:  "network.informo.news." + testIdentifier,
+		Name:       "ACME News",
+		FeedURL:    "https://example.org/feed.xml",
+		PublicKey:  base64.StdEncoding.EncodeToString(testKey.PublicKey),
+		KeyID:      testKey.ID,
+		Publisher:  testPublisher,
+	}
+
+	if priv != nil {
+		var err error
+		if reg.Signature, err = signing.Sign(priv, reg); err != nil {
+			t.Fatalf("Sign: %v", err)
+		}
+	}
+
+	if alter != nil {
+		alter(&reg)
+	}
+
+	return reg
+}
+
+func TestCheckRegistration(t *testing.T) {
+	tests := []struct {
+		name string
+		reg  common.SourceRegistration
+		// wantWarn and wantEnforce tell whether a problem is expected in the
+		// warn and enforce modes.
+		wantWarn    bool
+		wantEnforce bool
+	}{
+		{"signed", signedRegistration(t, testPriv, nil), false, false},
+		{"other publisher", signedRegistration(t, testPriv, func(reg *common.SourceRegistration) {
+			reg.Publisher = "@other:example.org"
+		}), true, true},
+		{"unknown key", signedRegistration(t, testPriv, func(reg *common.SourceRegistration) {
+			reg.PublicKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{3}, 32))
+		}), true, true},
+		{"unsigned", signedRegistration(t, nil, nil), false, true},
+		{"signed with another key", signedRegistration(t, otherPriv, nil), false, true},
+		{"altered", signedRegistration(t, testPriv, func(reg *common.SourceRegistration) {
+			reg.Name = "Altered"
+		}), false, true},
+		{"malformed signature", signedRegistration(t, testPriv, func(reg *common.SourceRegistration) {
+			reg.Signature = "not base64!"
+		}), false, true},
+	}
+
+	for _, test := range tests {
+		for _, mode := range []string{config.AuthorisationModeWarn, config.AuthorisationModeEnforce} {
+			a := NewAuthoriser(&config.Config{
+				Authorisation: config.AuthorisationConfig{Mode: mode},
+			}, nil, testSigner{})
+
+			want := test.wantWarn
+			if mode == config.AuthorisationModeEnforce {
+				want = test.wantEnforce
+			}
+
+			problem := a.checkRegistration(testIdentifier, testPublisher, test.reg)
+			if (len(problem) > 0) != want {
+				t.Errorf("%s (%s): got problem %q", test.name, mode, problem)
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sources
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	// ChainGap is the kind of the problem found when events are missing
+	// between two events of a chain.
+	ChainGap = "gap"
+	// ChainBroken is the kind of the problem found when an event doesn't refer
+	// to the hash of the event preceding it in the chain, i.e. when the
+	// preceding event has been altered or replaced.
+	ChainBroken = "broken"
+	// ChainFork is the kind of the problem found when several events have the
+	// same position in a chain.
+	ChainFork = "fork"
+	// ChainReordered is the kind of the problem found when an event appears in
+	// the room after an event which follows it in the chain.
+	ChainReordered = "reordered"
+)
+
+// ChainProblem describes a problem found in the chain of the events published
+// for a source into a room.
+type ChainProblem struct {
+	Kind     string
+	EventID  string
+	Sequence int64
+	Details  string
+}
+
+// CheckChain checks the chain formed by the valid events among the given
+// verifications (from the most recent one, as returned by Verify) which have
+// been signed with a version of the signature scheme which chains the events
+// (i.e. which have a sequence number), i.e. checks that no
+// event is missing, that each event refers to the hash of the event preceding
+// it and that the events appear in the room in the order of the chain. If
+// complete is true, the verifications cover the whole history of the room, so
+// the chain must start at the first event.
+// Returns the problems found, if any.
+func CheckChain(verifications []Verification, complete bool) (problems []ChainProblem) {
+	// Walk the events in the order they appear in the room.
+	var chained []Verification
+	for i := len(verifications) - 1; i >= 0; i-- {
+		v := verifications[i]
+		if v.Status == StatusValid && v.Sequence > 0 {
+			chained = append(chained, v)
+		}
+	}
+
+	if len(chained) == 0 {
+		return
+	}
+
+	var highest int64
+	for _, v := range chained {
+		if v.Sequence < highest {
+			problems = append(problems, ChainProblem{
+				Kind:     ChainReordered,
+				EventID:  v.EventID,
+				Sequence: v.Sequence,
+				Details:  fmt.Sprintf("Appears after event number %d", highest),
+			})
+		} else {
+			highest = v.Sequence
+		}
+	}
+
+	sort.SliceStable(chained, func(i, j int) bool {
+		return chained[i].Sequence < chained[j].Sequence
+	})
+
+	if complete && chained[0].Sequence > 1 {
+		problems = append(problems, ChainProblem{
+			Kind:     ChainGap,
+			EventID:  chained[0].EventID,
+			Sequence: chained[0].Sequence,
+			Details:  missingEvents(1, chained[0].Sequence-1),
+		})
+	}
+
+	for i := 1; i < len(chained); i++ {
+		prev, v := chained[i-1], chained[i]
+
+		switch {
+		case v.Sequence == prev.Sequence:
+			problems = append(problems, ChainProblem{
+				Kind:     ChainFork,
+				EventID:  v.EventID,
+				Sequence: v.Sequence,
+				Details:  fmt.Sprintf("Has the same number as %s", prev.EventID),
+			})
+		case v.Sequence > prev.Sequence+1:
+			problems = append(problems, ChainProblem{
+				Kind:     ChainGap,
+				EventID:  v.EventID,
+				Sequence: v.Sequence,
+				Details:  missingEvents(prev.Sequence+1, v.Sequence-1),
+			})
+		case v.PrevHash != prev.Hash:
+			problems = append(problems, ChainProblem{
+				Kind:     ChainBroken,
+				EventID:  v.EventID,
+				Sequence: v.Sequence,
+				Details:  fmt.Sprintf("Doesn't refer to the hash of %s", prev.EventID),
+			})
+		}
+	}
+
+	return
+}
+
+// missingEvents describes the range of missing events between the given
+// sequence numbers (included).
+func missingEvents(from int64, to int64) string {
+	if from == to {
+		return fmt.Sprintf("Event %d is missing", from)
+	}
+
+	return fmt.Sprintf("Events %d to %d are missing", from, to)
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sources
+
+import (
+	"fmt"
+	"testing"
+)
+
+// link returns the verification of a valid event with the given ID, at the
+// given position of the chain, which refers to the event with the given ID.
+func link(id string, sequence int64, prevID string) Verification {
+	v := Verification{
+		EventID:  id,
+		Sequence: sequence,
+		Hash:     "hash of " + id,
+		Status:   StatusValid,
+	}
+
+	if len(prevID) > 0 {
+		v.PrevHash = "hash of " + prevID
+	}
+
+	return v
+}
+
+// withStatus returns the given verification with the given status.
+func withStatus(v Verification, status string) Verification {
+	v.Status = status
+	return v
+}
+
+func TestCheckChain(t *testing.T) {
+	tests := []struct {
+		name     string
+		events   []Verification // In the order they appear in the room.
+		complete bool
+		want     []string
+	}{
+		{
+			name: "no events",
+		},
+		{
+			name:     "whole chain",
+			events:   []Verification{link("$1", 1, ""), link("$2", 2, "$1"), link("$3", 3, "$2")},
+			complete: true,
+		},
+		{
+			name:     "first events missing",
+			events:   []Verification{link("$2", 2, "$1"), link("$3", 3, "$2")},
+			complete: true,
+			want:     []string{"gap $2 2 Event 1 is missing"},
+		},
+		{
+			name:   "first events not retrieved",
+			events: []Verification{link("$2", 2, "$1"), link("$3", 3, "$2")},
+		},
+		{
+			name:   "one event missing",
+			events: []Verification{link("$1", 1, ""), link("$2", 2, "$1"), link("$4", 4, "$3")},
+			want:   []string{"gap $4 4 Event 3 is missing"},
+		},
+		{
+			name:   "several events missing",
+			events: []Verification{link("$1", 1, ""), link("$4", 4, "$3")},
+			want:   []string{"gap $4 4 Events 2 to 3 are missing"},
+		},
+		{
+			name:   "broken",
+			events: []Verification{link("$1", 1, ""), link("$2", 2, "$1"), link("$3", 3, "$1")},
+			want:   []string{"broken $3 3 Doesn't refer to the hash of $2"},
+		},
+		{
+			name:   "fork",
+			events: []Verification{link("$1", 1, ""), link("$2", 2, "$1"), link("$2b", 2, "$1")},
+			want:   []string{"fork $2b 2 Has the same number as $2"},
+		},
+		{
+			name:   "reordered",
+			events: []Verification{link("$1", 1, ""), link("$3", 3, "$2"), link("$2", 2, "$1")},
+			want:   []string{"reordered $2 2 Appears after event number 3"},
+		},
+		{
+			name: "invalid events ignored",
+			events: []Verification{
+				link("$1", 1, ""),
+				withStatus(link("$x", 2, "$1"), StatusForeign),
+				withStatus(link("$y", 2, "$1"), StatusReplayed),
+				link("$2", 2, "$1"),
+			},
+			complete: true,
+		},
+		{
+			name: "unchained events ignored",
+			events: []Verification{
+				link("$0", 0, ""), link("$1", 1, ""), link("$00", 0, ""), link("$2", 2, "$1"),
+			},
+			complete: true,
+		},
+	}
+
+	for _, test := range tests {
+		// CheckChain expects the most recent event first.
+		var verifications []Verification
+		for i := len(test.events) - 1; i >= 0; i-- {
+			verifications = append(verifications, test.events[i])
+		}
+
+		var got []string
+		for _, p := range CheckChain(verifications, test.complete) {
+			got = append(got, fmt.Sprintf("%s %s %d %s", p.Kind, p.EventID, p.Sequence, p.Details))
+		}
+
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: got problems %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sources
+
+import (
+	"encoding/base64"
+
+	"informo-feeder/common"
+	"informo-feeder/config"
+	"informo-feeder/matrix"
+	"informo-feeder/signing"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+// NewKeyTransition builds the statement announcing the rotation of the given
+// source's key from the given old key to the given new one, and signs it with
+// the old key.
+// Returns an error if the statement couldn't be serialised.
+func NewKeyTransition(
+	identifier string, oldKey *config.SourceKey, newKey *config.SourceKey,
+) (transition common.KeyTransition, err error) {
+	transition = common.KeyTransition{
+		Identifier:   identifier,
+		OldKeyID:     oldKey.ID,
+		OldPublicKey: base64.StdEncoding.EncodeToString(oldKey.PublicKey),
+		OldValidTo:   oldKey.ValidUntil.Unix(),
+		NewKeyID:     newKey.ID,
+		NewPublicKey: base64.StdEncoding.EncodeToString(newKey.PublicKey),
+		NewValidFrom: newKey.ValidFrom.Unix(),
+	}
+
+	transition.Signature, err = signing.Sign(oldKey.PrivateKey, transition)
+	return
+}
+
+// SendKeyTransition sends the given key transition statement into the given
+// room.
+// Returns the ID of the event, or an error if the homeserver rejected it.
+func SendKeyTransition(
+	session *matrix.Session, roomID string, transition common.KeyTransition,
+) (eventID string, err error) {
+	var resp *gomatrix.RespSendEvent
+	err = requestWithRenewal(session, func() (err error) {
+		resp, err = session.Client().SendMessageEvent(
+			roomID, common.KeyTransitionEventType, transition,
+		)
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	return resp.EventID, nil
+}
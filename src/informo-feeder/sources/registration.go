@@ -0,0 +1,177 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sources
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"informo-feeder/common"
+	"informo-feeder/config"
+	"informo-feeder/matrix"
+	"informo-feeder/signing"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/sirupsen/logrus"
+)
+
+// NewRegistration builds the registration payload for the source identified by
+// the given identifier, as published into the given network profile with the
+// given session. If the source has a logo, it is uploaded to the media
+// repository of the session's homeserver first, unless it's already a mxc://
+// URL. The payload is then signed with the source's active key, using the
+// given signer.
+// Returns an error if the source doesn't exist, if it has no valid key, or
+// if the logo couldn't be uploaded.
+func NewRegistration(
+	cfg *config.Config, signer signing.Signer, session *matrix.Session,
+	network *config.Network, identifier string,
+) (reg common.SourceRegistration, err error) {
+	feed, ok := cfg.Feed(identifier)
+	if !ok {
+		err = fmt.Errorf("Unknown feed %s", identifier)
+		return
+	}
+
+	key, err := signing.ActiveKey(signer, identifier)
+	if err != nil {
+		return
+	}
+
+	name := feed.Name
+	if len(name) == 0 {
+		name = identifier
+	}
+
+	reg = common.SourceRegistration{
+		Identifier: identifier,
+		EventType:  network.EventType(identifier),
+		Name:       name,
+		Website:    feed.Website,
+		FeedURL:    feed.URL,
+		PublicKey:  base64.StdEncoding.EncodeToString(key.PublicKey),
+		KeyID:      key.ID,
+		Publisher:  session.Client().UserID,
+	}
+
+	if len(feed.Logo) > 0 {
+		if reg.Logo, err = uploadLogo(session, feed.Logo); err != nil {
+			return
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"logo":  feed.Logo,
+			"mxURL": reg.Logo,
+		}).Info("Logo uploaded")
+	}
+
+	reg.Signature, err = signing.SignContent(signer, identifier, key.ID, reg)
+	return
+}
+
+// Send sends the given registration payload into the room of the given
+// network profile. If asState is true, the payload is sent as a state event
+// which state key is the type of the source's news events, which requires the
+// publisher to have the power level to do so. Otherwise, it is sent as a
+// proposal for the network's administrators to review.
+// Returns the ID of the event, or an error if the homeserver rejected it.
+func Send(
+	session *matrix.Session, network *config.Network,
+	reg common.SourceRegistration, asState bool,
+) (eventID string, err error) {
+	var resp *gomatrix.RespSendEvent
+	err = requestWithRenewal(session, func() (err error) {
+		if asState {
+			resp, err = session.Client().SendStateEvent(
+				network.RoomID, common.SourceEventType, reg.EventType, reg,
+			)
+		} else {
+			resp, err = session.Client().SendMessageEvent(
+				network.RoomID, common.SourceProposalEventType, reg,
+			)
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	return resp.EventID, nil
+}
+
+// uploadLogo uploads the given logo to the media repository of the session's
+// homeserver, and returns its mxc:// URL. The logo can either be a mxc:// URL,
+// in which case it is returned as is, a HTTP(S) URL, or the path to a local
+// file.
+// Returns an error if the logo couldn't be read or uploaded.
+func uploadLogo(session *matrix.Session, logo string) (mxURL string, err error) {
+	if strings.HasPrefix(logo, "mxc://") {
+		return logo, nil
+	}
+
+	var resp *gomatrix.RespMediaUpload
+	err = requestWithRenewal(session, func() (err error) {
+		if strings.HasPrefix(logo, "http://") || strings.HasPrefix(logo, "https://") {
+			resp, err = session.Client().UploadLink(logo)
+		} else {
+			resp, err = uploadFile(session.Client(), logo)
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	return resp.ContentURI, nil
+}
+
+// uploadFile uploads the file at the given path to the media repository.
+// Returns an error if the file couldn't be read or uploaded.
+func uploadFile(client *gomatrix.Client, path string) (*gomatrix.RespMediaUpload, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+
+	return client.UploadToContentRepo(f, contentType, info.Size())
+}
+
+// requestWithRenewal runs the given request, and retries it if the homeserver
+// rejected the access token and a new one could be obtained.
+// Returns the error returned by the last attempt.
+func requestWithRenewal(session *matrix.Session, request func() error) (err error) {
+	for {
+		accessToken := session.AccessToken()
+		if err = request(); err == nil || !session.RenewIfUnknownToken(err, accessToken) {
+			return
+		}
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sources
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"informo-feeder/common"
+	"informo-feeder/config"
+	"informo-feeder/matrix"
+	"informo-feeder/signing"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+const (
+	// StatusValid is the status of an event which signature matches with the
+	// source's public key.
+	StatusValid = "valid"
+	// StatusMissing is the status of an event that isn't signed.
+	StatusMissing = "missing"
+	// StatusInvalid is the status of an event which content couldn't be
+	// parsed, or which signature isn't a valid ed25519 signature.
+	StatusInvalid = "invalid"
+	// StatusForeign is the status of an event which signature doesn't match
+	// with the source's public key, i.e. an event that has either been signed
+	// with another key or altered after being signed.
+	StatusForeign = "foreign"
+	// StatusReplayed is the status of an event which signature matches with
+	// the source's public key, but which has been signed for another source,
+	// event type or room, or which nonce has already been used by an older
+	// event, i.e. an event that has been sent again by someone else.
+	StatusReplayed = "replayed"
+
+	// messagesPageSize is the number of events requested to the homeserver
+	// for each page of the room's history.
+	messagesPageSize = 100
+)
+
+// Verification is the outcome of the verification of a news event. Hash is
+// the hash of the event's content, as referred to by the next event of the
+// chain. Nonce is empty if the event hasn't been signed with the version 2 of
+// the signature scheme or a later one, and Sequence and PrevHash are zero values
+// if it hasn't been signed with the version 3. Signature is the event's
+// signature in the Matrix format if it has one, in the legacy format otherwise.
+type Verification struct {
+	EventID   string
+	Sender    string
+	Timestamp int64
+	Link      string
+	Headline  string
+	KeyID     string
+	Signature string
+	Nonce     string
+	Sequence  int64
+	PrevHash  string
+	Hash      string
+	Status    string
+}
+
+// Verify pages backwards through the history of the given room, and checks
+// the signature of each event of the given type against the given keys of the
+// source which identifier is given, the same way the feeder signs the events it
+// publishes. Events signed in the Matrix format are checked against the keys
+// which IDs the signatures are made with. Otherwise, events that carry a key
+// ID are checked against the key with this ID, the others against any of the
+// keys. Events signed with the version 2 of the signature scheme or a later one
+// must also be bound to the source, the event type and the room, and carry a
+// nonce that isn't used by any older event. Stops after the given number of
+// events of this type (or at the beginning of the room if limit is 0).
+// Returns the outcome of the verification of each event, from the most recent
+// one, or an error if the room's history couldn't be retrieved.
+func Verify(
+	session *matrix.Session, roomID string, eventType string,
+	identifier string, keys []signing.Key, limit int,
+) (verifications []Verification, err error) {
+	from, err := latestToken(session, roomID)
+	if err != nil {
+		return
+	}
+
+	filter, err := json.Marshal(map[string][]string{"types": {eventType}})
+	if err != nil {
+		return
+	}
+
+	// Map each nonce to the index of the last event seen using it, which is
+	// the most recent one since the history is paged backwards.
+	nonces := make(map[string]int)
+
+	for {
+		var resp gomatrix.RespMessages
+		if err = requestWithRenewal(session, func() error {
+			return messages(session.Client(), roomID, from, string(filter), &resp)
+		}); err != nil {
+			return
+		}
+
+		for _, event := range resp.Chunk {
+			// Don't rely on the homeserver having applied the filter.
+			if event.Type != eventType || event.StateKey != nil {
+				continue
+			}
+
+			v := verifyEvent(event, roomID, identifier, keys)
+			if len(v.Nonce) > 0 {
+				// If an older event properly uses the same nonce, the more
+				// recent one is a replay.
+				i, ok := nonces[v.Nonce]
+				if ok && v.Status == StatusValid && verifications[i].Status == StatusValid {
+					verifications[i].Status = StatusReplayed
+				}
+
+				nonces[v.Nonce] = len(verifications)
+			}
+
+			verifications = append(verifications, v)
+			if limit > 0 && len(verifications) >= limit {
+				return
+			}
+		}
+
+		// The beginning of the room has been reached.
+		if len(resp.Chunk) == 0 || len(resp.End) == 0 || resp.End == from {
+			return
+		}
+
+		from = resp.End
+	}
+}
+
+// verifyEvent checks the signature of a news event published for the source
+// which identifier is given into the given room against the given keys. If the
+// event is signed in the Matrix format, only this signature is checked, since
+// it also covers the legacy signature. If the signature is valid and the event
+// has been signed with the version 2 of the signature scheme or a later one,
+// also checks that it has been signed for this source, room and event type. If
+// it has been signed with the version 3, also reads its position in the chain.
+func verifyEvent(
+	event gomatrix.Event, roomID string, identifier string, keys []signing.Key,
+) Verification {
+	v, content := verifySignature(event, identifier, keys)
+	if v.Status != StatusValid {
+		return v
+	}
+
+	switch {
+	case content.SignatureVersion > config.SignatureVersionChained:
+		v.Status = StatusInvalid
+	case content.SignatureVersion >= config.SignatureVersionBound:
+		v.Nonce = content.Nonce
+		if content.Source != identifier || content.EventType != event.Type ||
+			content.RoomID != roomID || len(content.Nonce) == 0 {
+			v.Status = StatusReplayed
+		}
+	}
+
+	if v.Status != StatusInvalid && content.SignatureVersion >= config.SignatureVersionChained {
+		v.Sequence = content.Sequence
+		v.PrevHash = content.PrevHash
+	}
+
+	return v
+}
+
+// verifySignature checks the signature of a news event published for the source
+// which identifier is given against the given keys, and returns the outcome of
+// the verification along with the event's parsed content.
+func verifySignature(
+	event gomatrix.Event, identifier string, keys []signing.Key,
+) (v Verification, content common.NewsContent) {
+	v = Verification{
+		EventID:   event.ID,
+		Sender:    event.Sender,
+		Timestamp: event.Timestamp,
+		Status:    StatusInvalid,
+	}
+
+	// Parse the content the same way the feeder generates it before signing
+	// it, so the canonical JSON is computed the same way.
+	jsonBytes, err := json.Marshal(event.Content)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(jsonBytes, &content); err != nil {
+		return
+	}
+
+	v.Link = content.Link
+	v.Headline = content.Headline
+	v.KeyID = content.KeyID
+	v.Signature = content.Signature
+	if v.Hash, err = signing.ContentHash(jsonBytes); err != nil {
+		return
+	}
+
+	if len(content.Signatures[identifier]) > 0 {
+		if signature, ok := content.Signatures[identifier][content.KeyID]; ok {
+			v.Signature = signature
+		}
+
+		v.Status = verifyMatrixSignatures(
+			jsonBytes, identifier, content.Signatures[identifier], keys,
+		)
+		return
+	}
+
+	if len(content.Signature) == 0 {
+		v.Status = StatusMissing
+		return
+	}
+
+	signature := content.Signature
+	content.Signature = ""
+	content.Signatures = nil
+
+	// If no key matches, the event has been signed with a key the source
+	// doesn't know about.
+	v.Status = StatusForeign
+	for _, key := range keys {
+		if len(content.KeyID) > 0 && content.KeyID != key.ID {
+			continue
+		}
+
+		switch signing.Verify(key.PublicKey, content, signature) {
+		case nil:
+			v.Status = StatusValid
+			return
+		case signing.ErrMalformedSignature:
+			v.Status = StatusInvalid
+			return
+		}
+	}
+
+	return
+}
+
+// verifyMatrixSignatures checks the signatures made in the Matrix format on the
+// given JSON content of a news event by the source which identifier is given,
+// against the keys with the same IDs among the given ones, and returns the
+// status of the event.
+func verifyMatrixSignatures(
+	content []byte, identifier string, signatures map[string]string,
+	keys []signing.Key,
+) string {
+	// If no key matches, the event has been signed with a key the source
+	// doesn't know about.
+	status := StatusForeign
+	for _, key := range keys {
+		if _, ok := signatures[key.ID]; !ok {
+			continue
+		}
+
+		switch signing.VerifyJSON(key.PublicKey, identifier, key.ID, content) {
+		case nil:
+			return StatusValid
+		case signing.ErrMalformedSignature:
+			status = StatusInvalid
+		}
+	}
+
+	return status
+}
+
+// latestToken returns a pagination token pointing to the end of the given
+// room's history, from a sync request filtered so it doesn't return more
+// than one event.
+// Returns an error if the sync request failed.
+func latestToken(session *matrix.Session, roomID string) (token string, err error) {
+	filter, err := json.Marshal(map[string]interface{}{
+		"room": map[string]interface{}{
+			"rooms":    []string{roomID},
+			"timeline": map[string]int{"limit": 1},
+		},
+		"presence":     map[string][]string{"types": {}},
+		"account_data": map[string][]string{"types": {}},
+	})
+	if err != nil {
+		return
+	}
+
+	var resp *gomatrix.RespSync
+	err = requestWithRenewal(session, func() (err error) {
+		resp, err = session.Client().SyncRequest(0, "", string(filter), false, "")
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	return resp.NextBatch, nil
+}
+
+// messages requests a page of the given room's history to the homeserver,
+// backwards from the given token, with the given filter. This isn't done with
+// gomatrix.Client.Messages since it doesn't support filters.
+func messages(
+	client *gomatrix.Client, roomID string, from string, filter string,
+	resp *gomatrix.RespMessages,
+) error {
+	urlPath := client.BuildURLWithQuery(
+		[]string{"rooms", roomID, "messages"},
+		map[string]string{
+			"from":   from,
+			"dir":    "b",
+			"limit":  strconv.Itoa(messagesPageSize),
+			"filter": filter,
+		},
+	)
+
+	_, err := client.MakeRequest("GET", urlPath, nil, resp)
+	return err
+}
@@ -0,0 +1,192 @@
+// Copyright 2018 Informo core team <core@informo.network>
+//
+// Licensed under the GNU Affero General Public License, Version 3.0
+// (the "License"); you may not use this file except in compliance with the
+// License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sources
+
+import (
+	"encoding/json"
+	"testing"
+
+	"informo-feeder/common"
+	"informo-feeder/config"
+	"informo-feeder/signing"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	testRoomID    = "!room:example.org"
+	testEventType = "network.informo.news.acmenews"
+)
+
+// boundContent returns a content signed with the version 2 of the signature
+// scheme for the test source, event type and room, without its signature.
+func boundContent() common.NewsContent {
+	return common.NewsContent{
+		Headline:         "Headline",
+		Link:             "https://example.org/1",
+		Source:           testIdentifier,
+		EventType:        testEventType,
+		RoomID:           testRoomID,
+		SignedAt:         1500000000,
+		Nonce:            "nonce",
+		SignatureVersion: config.SignatureVersionBound,
+		KeyID:            testKey.ID,
+	}
+}
+
+// chainedContent returns a content signed with the version 3 of the signature
+// scheme for the test source, event type and room, at the given position of
+// the chain, without its signature.
+func chainedContent(sequence int64) common.NewsContent {
+	content := boundContent()
+	content.SignatureVersion = config.SignatureVersionChained
+	content.Sequence = sequence
+	content.PrevHash = "prev"
+	return content
+}
+
+// legacyEvent signs the given content in the legacy format with the given
+// private key, and returns the event carrying it, after applying the given
+// change to its content.
+func legacyEvent(
+	t *testing.T, content common.NewsContent, priv ed25519.PrivateKey,
+	alter func(*common.NewsContent),
+) gomatrix.Event {
+	signature, err := signing.Sign(priv, content)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+
+	content.Signature = signature
+	if alter != nil {
+		alter(&content)
+	}
+
+	jsonBytes, err := json.Marshal(content)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	return newTestEvent(t, jsonBytes)
+}
+
+// matrixEvent signs the given content in the Matrix format with the given
+// private key, and returns the event carrying it.
+func matrixEvent(
+	t *testing.T, content common.NewsContent, priv ed25519.PrivateKey,
+) gomatrix.Event {
+	jsonBytes, err := json.Marshal(content)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	signed, err := gomatrixserverlib.SignJSON(
+		testIdentifier, gomatrixserverlib.KeyID(content.KeyID), priv, jsonBytes,
+	)
+	if err != nil {
+		t.Fatalf("SignJSON: %v", err)
+	}
+
+	return newTestEvent(t, signed)
+}
+
+// newTestEvent returns an event of the test type with the given JSON content.
+func newTestEvent(t *testing.T, content []byte) gomatrix.Event {
+	event := gomatrix.Event{ID: "$event:example.org", Type: testEventType}
+	if err := json.Unmarshal(content, &event.Content); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	return event
+}
+
+func TestVerifyEvent(t *testing.T) {
+	unbound := common.NewsContent{
+		Headline: "Headline",
+		Link:     "https://example.org/1",
+		KeyID:    testKey.ID,
+	}
+
+	// Only a version 3 content is chained, even if an older one has a
+	// sequence number.
+	unboundSequence := unbound
+	unboundSequence.Sequence = 3
+	boundSequence := boundContent()
+	boundSequence.Sequence = 3
+
+	otherRoom := boundContent()
+	otherRoom.RoomID = "!other:example.org"
+	otherSource := boundContent()
+	otherSource.Source = "othernews"
+	otherType := boundContent()
+	otherType.EventType = "network.informo.news.othernews"
+	noNonce := boundContent()
+	noNonce.Nonce = ""
+	chainedOtherRoom := chainedContent(3)
+	chainedOtherRoom.RoomID = "!other:example.org"
+	chainedNoNonce := chainedContent(3)
+	chainedNoNonce.Nonce = ""
+	unknownVersion := chainedContent(3)
+	unknownVersion.SignatureVersion = config.SignatureVersionChained + 1
+
+	tests := []struct {
+		name         string
+		event        gomatrix.Event
+		wantStatus   string
+		wantSequence int64
+	}{
+		{"legacy unbound", legacyEvent(t, unbound, testPriv, nil), StatusValid, 0},
+		{"legacy unbound with a sequence", legacyEvent(t, unboundSequence, testPriv, nil), StatusValid, 0},
+		{"legacy bound", legacyEvent(t, boundContent(), testPriv, nil), StatusValid, 0},
+		{"matrix bound", matrixEvent(t, boundContent(), testPriv), StatusValid, 0},
+		{"legacy bound with a sequence", legacyEvent(t, boundSequence, testPriv, nil), StatusValid, 0},
+		{"other room", legacyEvent(t, otherRoom, testPriv, nil), StatusReplayed, 0},
+		{"other source", legacyEvent(t, otherSource, testPriv, nil), StatusReplayed, 0},
+		{"other event type", legacyEvent(t, otherType, testPriv, nil), StatusReplayed, 0},
+		{"no nonce", legacyEvent(t, noNonce, testPriv, nil), StatusReplayed, 0},
+		{"legacy chained", legacyEvent(t, chainedContent(3), testPriv, nil), StatusValid, 3},
+		{"matrix chained", matrixEvent(t, chainedContent(3), testPriv), StatusValid, 3},
+		{"chained other room", legacyEvent(t, chainedOtherRoom, testPriv, nil), StatusReplayed, 3},
+		{"chained no nonce", matrixEvent(t, chainedNoNonce, testPriv), StatusReplayed, 3},
+		{"unknown version", legacyEvent(t, unknownVersion, testPriv, nil), StatusInvalid, 0},
+		{"unsigned", newTestEvent(t, []byte(`{"headline":"Headline"}`)), StatusMissing, 0},
+		{"unknown key", legacyEvent(t, chainedContent(3), otherPriv, nil), StatusForeign, 0},
+		{"matrix unknown key", matrixEvent(t, chainedContent(3), otherPriv), StatusForeign, 0},
+		{"altered", legacyEvent(t, boundContent(), testPriv, func(c *common.NewsContent) {
+			c.Headline = "Altered"
+		}), StatusForeign, 0},
+		{"altered sequence", legacyEvent(t, chainedContent(3), testPriv, func(c *common.NewsContent) {
+			c.Sequence = 4
+		}), StatusForeign, 0},
+		{"malformed signature", legacyEvent(t, boundContent(), testPriv, func(c *common.NewsContent) {
+			c.Signature = "not base64!"
+		}), StatusInvalid, 0},
+		{"malformed content", newTestEvent(t, []byte(`{"headline":1}`)), StatusInvalid, 0},
+	}
+
+	for _, test := range tests {
+		v := verifyEvent(test.event, testRoomID, testIdentifier, []signing.Key{testKey})
+		if v.Status != test.wantStatus {
+			t.Errorf("%s: got status %s, want %s", test.name, v.Status, test.wantStatus)
+		}
+
+		if v.Sequence != test.wantSequence {
+			t.Errorf("%s: got sequence %d, want %d", test.name, v.Sequence, test.wantSequence)
+		}
+	}
+}